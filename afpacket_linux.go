@@ -0,0 +1,110 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"io"
+	"sync"
+)
+
+// Room in each AF_PACKET frame for the header the kernel puts before the packet data
+const afpacketFrameOverhead = 128
+
+// An AF_PACKET capture, which avoids the overhead of libpcap on busy networks
+type afpacketHandle struct {
+	mu      sync.Mutex // Keeps the ring from being unmapped by Close while a packet is being read from it
+	tpacket *afpacket.TPacket
+	closed  bool
+}
+
+// Open an AF_PACKET capture on the named device, filtering for WOL packets and capturing at most snaplen bytes of each
+// The filter is compiled by libpcap, since AF_PACKET only understands raw BPF instructions
+func openAFPacket(name string, snaplen int32, filter string) (packetHandle, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, int(snaplen), filter)
+	if err != nil {
+		return nil, fmt.Errorf("Something in the BPF went wrong on %s!: %w", name, err)
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		raw[i] = bpf.RawInstruction{Op: instruction.Code, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+
+	frameSize, blockSize := afpacketSizes(snaplen)
+	tpacket, err := afpacket.NewTPacket(afpacket.OptInterface(name), afpacket.OptPollTimeout(captureTimeout),
+		afpacket.OptFrameSize(frameSize), afpacket.OptBlockSize(blockSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %w", name, err)
+	}
+	if err := tpacket.SetBPF(raw); err != nil {
+		tpacket.Close()
+		return nil, fmt.Errorf("Something in the BPF went wrong on %s!: %w", name, err)
+	}
+
+	return &afpacketHandle{tpacket: tpacket}, nil
+}
+
+// Return the size of the AF_PACKET frames holding snaplen bytes of each packet, and of the blocks holding the frames
+// The frame size is a power of two, so the block size (which the kernel needs to be a multiple of it) can be too
+func afpacketSizes(snaplen int32) (int, int) {
+	frameSize := 1
+	for frameSize < int(snaplen)+afpacketFrameOverhead {
+		frameSize *= 2
+	}
+	return frameSize, max(frameSize, afpacket.DefaultBlockSize)
+}
+
+// Read the next packet, or io.EOF once the capture has been closed
+// Timeouts are reported as libpcap's, so both backends' timeouts can be told apart from failures
+func (h *afpacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data, ci, err := h.tpacket.ReadPacketData()
+	if errors.Is(err, afpacket.ErrTimeout) {
+		err = pcap.NextErrorTimeoutExpired
+	}
+	return data, ci, err
+}
+
+// AF_PACKET captures on Ethernet devices always see Ethernet frames
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// Return the socket statistics in the same form as libpcap's, so they're reported the same way
+func (h *afpacketHandle) Stats() (*pcap.Stats, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, io.EOF
+	}
+
+	// Only the statistics for the version of TPACKET in use are filled in, the others are zero
+	stats, statsV3, err := h.tpacket.SocketStats()
+	if err != nil {
+		return nil, err
+	}
+	return &pcap.Stats{
+		PacketsReceived: int(stats.Packets() + statsV3.Packets()),
+		PacketsDropped:  int(stats.Drops() + statsV3.Drops()),
+	}, nil
+}
+
+// Close the capture, waiting for any read in progress to finish
+func (h *afpacketHandle) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		h.closed = true
+		h.tpacket.Close()
+	}
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/pcap"
+	"testing"
+	"time"
+)
+
+func TestAFPacketSizes(t *testing.T) {
+	tests := []struct {
+		snaplen       int32
+		wantFrameSize int
+		wantBlockSize int
+	}{
+		{128, 256, afpacket.DefaultBlockSize},
+		{1600, 2048, afpacket.DefaultBlockSize},
+		{65535, 131072, afpacket.DefaultBlockSize},
+		{1 << 20, 1 << 21, 1 << 21},
+	}
+
+	for _, tt := range tests {
+		frameSize, blockSize := afpacketSizes(tt.snaplen)
+		if frameSize != tt.wantFrameSize || blockSize != tt.wantBlockSize {
+			t.Errorf("afpacketSizes(%d) = %d, %d, want %d, %d", tt.snaplen, frameSize, blockSize, tt.wantFrameSize, tt.wantBlockSize)
+		}
+		if frameSize < int(tt.snaplen)+afpacketFrameOverhead || blockSize%frameSize != 0 {
+			t.Errorf("afpacketSizes(%d) = %d, %d, which can't hold a whole packet in whole frames", tt.snaplen, frameSize, blockSize)
+		}
+	}
+}
+
+func TestOpenCaptureBackend(t *testing.T) {
+	tests := []struct {
+		backend  string
+		wantLive bool
+	}{
+		{"pcap", true},
+		{"afpacket", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			opened := false
+			original := openLive
+			openLive = func(device string, snaplen int32, promisc bool, timeout time.Duration) (*pcap.Handle, error) {
+				opened = true
+				return nil, errors.New("no such device")
+			}
+			t.Cleanup(func() { openLive = original })
+
+			// The device doesn't exist, so either backend fails, but only after choosing how to open it
+			if handle, err := openCapture("virtwold-test0", tt.backend, 1600, false, "udp"); err == nil {
+				handle.Close()
+				t.Fatal("openCapture() succeeded on a missing device")
+			}
+			if opened != tt.wantLive {
+				t.Errorf("opened with libpcap = %t, want %t", opened, tt.wantLive)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// AF_PACKET only exists on Linux
+func openAFPacket(name string, snaplen int32, filter string) (packetHandle, error) {
+	return nil, errors.New("the afpacket capture backend is only available on Linux")
+}
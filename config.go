@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Settings loaded from a YAML configuration file
+// Any setting given as a flag on the command line overrides the one from the file
+type Config struct {
+	Interface  string       `yaml:"interface"`   // Interface to listen on
+	Interfaces []string     `yaml:"interfaces"`  // Interfaces to listen on, in addition to Interface
+	LibvirtURI string       `yaml:"libvirt_uri"` // URI to the libvirt daemon
+	Ports      []int        `yaml:"ports"`       // UDP ports to listen for WOL packets on
+	Password   string       `yaml:"password"`    // SecureOn password required to wake any VM
+	Allow      []string     `yaml:"allow"`       // MACs allowed to be woken, or empty to allow every MAC
+	VLAN       bool         `yaml:"vlan"`        // Also listen for WOL packets carrying an 802.1Q VLAN tag
+	Mappings   []Mapping    `yaml:"mappings"`    // Per-MAC settings
+	Targets    []TargetRule `yaml:"targets"`     // Rules waking domains by the target device of their interface
+	Profiles   []Profile    `yaml:"profiles"`    // Per-interface capture settings
+	Groups     []Group      `yaml:"groups"`      // Named sets of domains woken together by a single MAC
+}
+
+// Settings for a single MAC
+type Mapping struct {
+	MAC      string `yaml:"mac"`       // MAC address the settings apply to
+	Password string `yaml:"password"`  // SecureOn password required to wake this MAC, overriding the global password
+	PreWake  string `yaml:"pre_wake"`  // Shell command run before waking this MAC's VM, aborting the wake if it fails
+	PostWake string `yaml:"post_wake"` // Shell command run after waking this MAC's VM, whose failure is only logged
+}
+
+// A rule waking the domain with an interface on a target device (<target dev='...'/>) for WOL packets arriving on
+// a capture interface, for VMs identified by their target device rather than their MAC
+type TargetRule struct {
+	Interface string `yaml:"interface"` // Capture interface the WOL packet must arrive on
+	MAC       string `yaml:"mac"`       // MAC the WOL packet must be for, or empty for any MAC
+	Target    string `yaml:"target"`    // Target device of the interface of the domain to wake
+}
+
+// A named set of domains all woken, in order, by WOL packets for a trigger MAC
+type Group struct {
+	Name    string   `yaml:"name"`    // Name of the group, for logs
+	MAC     string   `yaml:"mac"`     // MAC whose WOL packets wake the group, instead of any VM with it
+	Domains []string `yaml:"domains"` // Names of the domains to wake, in order
+}
+
+// Capture settings for a single interface, such as a VLAN filter for a trunk port
+type Profile struct {
+	Interface string `yaml:"interface"` // Interface the settings apply to
+	Filter    string `yaml:"filter"`    // BPF filter to capture with, or empty for the global filter
+	Snaplen   int    `yaml:"snaplen"`   // Bytes of each packet to capture, or 0 for the global snaplen
+}
+
+// Load and validate the YAML configuration file at path
+// Unknown keys are rejected, so typos don't silently get ignored
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+
+	config := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("malformed configuration %s: %w", path, err)
+	}
+
+	for i, mapping := range config.Mappings {
+		if _, err := net.ParseMAC(mapping.MAC); err != nil {
+			return nil, fmt.Errorf("invalid MAC in mapping %d of %s: %q", i+1, path, mapping.MAC)
+		}
+	}
+
+	for i, rule := range config.Targets {
+		if rule.Interface == "" || rule.Target == "" {
+			return nil, fmt.Errorf("target rule %d of %s needs both an interface and a target", i+1, path)
+		}
+		if rule.MAC != "" {
+			hwaddr, err := net.ParseMAC(rule.MAC)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MAC in target rule %d of %s: %q", i+1, path, rule.MAC)
+			}
+			config.Targets[i].MAC = hwaddr.String()
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, profile := range config.Profiles {
+		if profile.Interface == "" {
+			return nil, fmt.Errorf("profile %d of %s needs an interface", i+1, path)
+		}
+		if seen[profile.Interface] {
+			return nil, fmt.Errorf("more than one profile for interface %s in %s", profile.Interface, path)
+		}
+		seen[profile.Interface] = true
+		if profile.Snaplen != 0 {
+			if err := checkSnaplen(profile.Snaplen); err != nil {
+				return nil, fmt.Errorf("invalid snaplen in profile for %s in %s: %w", profile.Interface, path, err)
+			}
+		}
+		if profile.Filter != "" {
+			snaplen := profile.Snaplen
+			if snaplen == 0 {
+				snaplen = defaultSnaplen
+			}
+			if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, profile.Filter); err != nil {
+				return nil, fmt.Errorf("invalid BPF filter in profile for %s in %s: %w", profile.Interface, path, err)
+			}
+		}
+	}
+
+	groupMACs := make(map[string]bool)
+	for i, group := range config.Groups {
+		if group.Name == "" || len(group.Domains) == 0 {
+			return nil, fmt.Errorf("group %d of %s needs a name and at least one domain", i+1, path)
+		}
+		hwaddr, err := net.ParseMAC(group.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC in group %s of %s: %q", group.Name, path, group.MAC)
+		}
+		if groupMACs[hwaddr.String()] {
+			return nil, fmt.Errorf("more than one group for MAC %s in %s", hwaddr, path)
+		}
+		groupMACs[hwaddr.String()] = true
+		config.Groups[i].MAC = hwaddr.String()
+	}
+
+	return config, nil
+}
+
+// Return the groups keyed by their (normalized) trigger MAC
+func (c *Config) groupMap() map[string]Group {
+	groups := make(map[string]Group)
+	for _, group := range c.Groups {
+		groups[group.MAC] = group
+	}
+	return groups
+}
+
+// Return the hooks for each MAC with any, keyed by normalized MAC
+func (c *Config) hookMap() map[string]wakeHooks {
+	hooks := make(map[string]wakeHooks)
+	for _, mapping := range c.Mappings {
+		if mapping.PreWake != "" || mapping.PostWake != "" {
+			hooks[virtwold.NormalizeMAC(mapping.MAC)] = wakeHooks{preWake: mapping.PreWake, postWake: mapping.PostWake}
+		}
+	}
+	return hooks
+}
+
+// Return the capture settings for each interface with a profile, keyed by interface name
+func (c *Config) profileMap() map[string]Profile {
+	profiles := make(map[string]Profile)
+	for _, profile := range c.Profiles {
+		profiles[profile.Interface] = profile
+	}
+	return profiles
+}
+
+// Load a file mapping MACs to the names of their VMs, with a MAC and a name on each line
+// Blank lines and lines starting with # are ignored
+// Returns the names keyed by normalized MAC
+func LoadMappingFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping file: %w", err)
+	}
+
+	mappings := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d of %s should be a MAC and a domain name: %q", i+1, path, line)
+		}
+		hwaddr, err := net.ParseMAC(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC on line %d of %s: %q", i+1, path, fields[0])
+		}
+		mappings[hwaddr.String()] = fields[1]
+	}
+
+	return mappings, nil
+}
+
+// Order in which the sources of each setting are used, for error messages
+const precedence = "flags override environment variables, which override the configuration file"
+
+// Environment variables that can be used in place of flags, and the flags they stand in for
+var envFlags = map[string]string{
+	"VIRTWOLD_INTERFACE":   "interface",
+	"VIRTWOLD_LIBVIRT_URI": "libvirturi",
+	"VIRTWOLD_PORTS":       "ports",
+	"VIRTWOLD_PASSWORD":    "password",
+}
+
+// Resolve each setting from, in order of precedence, flags, environment variables, the configuration file, and the defaults
+// Returns a description of where each setting came from, keyed by flag name, for use in error messages, along with
+// the loaded configuration file, or nil if there isn't one
+func resolveConfig(fs *flag.FlagSet, configpath string) (map[string]string, *Config, error) {
+	sources := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = "default"
+	})
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag -" + f.Name
+	})
+
+	for env, name := range envFlags {
+		value, ok := os.LookupEnv(env)
+		if !ok || sources[name] != "default" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, nil, fmt.Errorf("invalid environment variable %s (%s): %w", env, precedence, err)
+		}
+		sources[name] = "environment variable " + env
+	}
+
+	var config *Config
+	if configpath != "" {
+		var err error
+		if config, err = LoadConfig(configpath); err != nil {
+			return nil, nil, err
+		}
+
+		for name, value := range config.flagValues() {
+			if value == "" || sources[name] != "default" {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s in configuration (%s): %w", name, precedence, err)
+			}
+			sources[name] = "configuration file " + configpath
+		}
+	}
+
+	// Fall back to libvirt's own default URI, as virsh does, before using the built-in one
+	if uri := os.Getenv("LIBVIRT_DEFAULT_URI"); uri != "" && sources["libvirturi"] == "default" {
+		if err := fs.Set("libvirturi", uri); err != nil {
+			return nil, nil, fmt.Errorf("invalid LIBVIRT_DEFAULT_URI: %w", err)
+		}
+		sources["libvirturi"] = "environment variable LIBVIRT_DEFAULT_URI"
+	}
+
+	return sources, config, nil
+}
+
+// Settings that only take effect when the capture handles and libvirt connections are opened, so need a restart
+var restartFlags = []string{"interface", "libvirturi", "ports", "vlan"}
+
+// Reload the configuration file, returning the SecureOn passwords and allowlist it now gives, along with the
+// configuration itself
+// Settings that came from flags or environment variables keep their values, as they still take precedence
+// Changes to settings that can't be applied without a restart are logged, rather than silently ignored
+func reloadConfig(fs *flag.FlagSet, configpath string, sources map[string]string) (passwordConfig, allowlist, *Config, error) {
+	config, err := LoadConfig(configpath)
+	if err != nil {
+		return passwordConfig{}, nil, nil, err
+	}
+	values := config.flagValues()
+
+	// Settings from the file (or defaults, which the file may now override) take their new value from the file
+	value := func(name string) string {
+		f := fs.Lookup(name)
+		if !strings.HasPrefix(sources[name], "configuration file") && sources[name] != "default" {
+			return f.Value.String()
+		}
+		if values[name] != "" {
+			return values[name]
+		}
+		return f.DefValue
+	}
+
+	for _, name := range restartFlags {
+		if value(name) != fs.Lookup(name).Value.String() {
+			slog.Warn("Setting changed in configuration file, restart needed to apply it", "event", "restart_needed", "setting", name)
+		}
+	}
+
+	passwords, err := parsePasswordConfig(value("password"), value("mac-passwords"))
+	if err != nil {
+		return passwordConfig{}, nil, nil, fmt.Errorf("invalid password configuration in %s: %w", configpath, err)
+	}
+
+	allowed, err := parseAllowlist(value("allow"))
+	if err != nil {
+		return passwordConfig{}, nil, nil, fmt.Errorf("invalid allowlist in %s: %w", configpath, err)
+	}
+
+	return passwords, allowed, config, nil
+}
+
+// Encode a SecureOn password in hex, so one written as ASCII characters such as , or = survives being joined
+// into the -mac-passwords list
+// An invalid password is left as it is, to be reported when the list is parsed
+func encodePassword(password string) string {
+	pw, err := parsePassword(password)
+	if err != nil {
+		return password
+	}
+	return hex.EncodeToString(pw)
+}
+
+// Return the configuration file's settings as the values of the equivalent flags
+func (c *Config) flagValues() map[string]string {
+	ifaces := c.Interfaces
+	if c.Interface != "" {
+		ifaces = append([]string{c.Interface}, ifaces...)
+	}
+
+	var ports []string
+	for _, port := range c.Ports {
+		ports = append(ports, strconv.Itoa(port))
+	}
+
+	var macpasswords []string
+	for _, mapping := range c.Mappings {
+		if mapping.Password != "" {
+			macpasswords = append(macpasswords, mapping.MAC+"="+encodePassword(mapping.Password))
+		}
+	}
+
+	var vlan string
+	if c.VLAN {
+		vlan = "true"
+	}
+
+	return map[string]string{
+		"interface":     strings.Join(ifaces, ","),
+		"libvirturi":    c.LibvirtURI,
+		"ports":         strings.Join(ports, ","),
+		"password":      c.Password,
+		"mac-passwords": strings.Join(macpasswords, ","),
+		"allow":         strings.Join(c.Allow, ","),
+		"vlan":          vlan,
+	}
+}
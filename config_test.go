@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Write the YAML configuration to a file in a temporary directory, returning its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "virtwold.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write configuration: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	content := `
+interface: br0
+libvirt_uri: qemu:///system
+ports: [7, 9]
+password: "hunter"
+mappings:
+  - mac: 52:54:00:12:34:56
+    password: "secret"
+`
+	config, err := LoadConfig(writeConfig(t, content))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	want := &Config{
+		Interface:  "br0",
+		LibvirtURI: "qemu:///system",
+		Ports:      []int{7, 9},
+		Password:   "hunter",
+		Mappings:   []Mapping{{MAC: "52:54:00:12:34:56", Password: "secret"}},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("LoadConfig() = %+v, want %+v", config, want)
+	}
+}
+
+func TestLoadConfigEmpty(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, ""))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if !reflect.DeepEqual(config, &Config{}) {
+		t.Errorf("LoadConfig() = %+v, want an empty configuration", config)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"malformed", "interface: [br0", "malformed configuration"},
+		{"unknown key", "interfce: br0", "field interfce not found"},
+		{"wrong type", "ports: nine", "malformed configuration"},
+		{"bad mapping MAC", "mappings:\n  - mac: nonsense", `invalid MAC in mapping 1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadConfig() of a missing file succeeded, want an error")
+	}
+}
+
+func TestResolveConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		config      string
+		wantValues  map[string]string
+		wantSources map[string]string
+	}{
+		{
+			name:        "defaults",
+			wantValues:  map[string]string{"interface": "eth0", "ports": "7,9,0"},
+			wantSources: map[string]string{"interface": "default", "ports": "default"},
+		},
+		{
+			name:        "environment",
+			env:         map[string]string{"VIRTWOLD_INTERFACE": "br0", "VIRTWOLD_PORTS": "9"},
+			wantValues:  map[string]string{"interface": "br0", "ports": "9"},
+			wantSources: map[string]string{"interface": "environment variable VIRTWOLD_INTERFACE", "ports": "environment variable VIRTWOLD_PORTS"},
+		},
+		{
+			name:        "flag overrides environment",
+			args:        []string{"-interface", "eth1"},
+			env:         map[string]string{"VIRTWOLD_INTERFACE": "br0", "VIRTWOLD_PASSWORD": "secret"},
+			wantValues:  map[string]string{"interface": "eth1", "password": "secret"},
+			wantSources: map[string]string{"interface": "flag -interface", "password": "environment variable VIRTWOLD_PASSWORD"},
+		},
+		{
+			name:        "environment overrides configuration file",
+			env:         map[string]string{"VIRTWOLD_LIBVIRT_URI": "qemu:///session"},
+			config:      "libvirt_uri: qemu:///system\nports: [9]\n",
+			wantValues:  map[string]string{"libvirturi": "qemu:///session", "ports": "9"},
+			wantSources: map[string]string{"libvirturi": "environment variable VIRTWOLD_LIBVIRT_URI"},
+		},
+		{
+			name:        "libvirt default URI",
+			env:         map[string]string{"LIBVIRT_DEFAULT_URI": "qemu+ssh://host/system"},
+			wantValues:  map[string]string{"libvirturi": "qemu+ssh://host/system"},
+			wantSources: map[string]string{"libvirturi": "environment variable LIBVIRT_DEFAULT_URI"},
+		},
+		{
+			name:        "flag overrides libvirt default URI",
+			args:        []string{"-libvirturi", "qemu:///system"},
+			env:         map[string]string{"LIBVIRT_DEFAULT_URI": "qemu+ssh://host/system"},
+			wantValues:  map[string]string{"libvirturi": "qemu:///system"},
+			wantSources: map[string]string{"libvirturi": "flag -libvirturi"},
+		},
+		{
+			name:        "flag set to the default overrides libvirt default URI",
+			args:        []string{"-libvirturi", "qemu+tcp:///system"},
+			env:         map[string]string{"LIBVIRT_DEFAULT_URI": "qemu+ssh://host/system"},
+			wantValues:  map[string]string{"libvirturi": "qemu+tcp:///system"},
+			wantSources: map[string]string{"libvirturi": "flag -libvirturi"},
+		},
+		{
+			name:        "virtwold environment overrides libvirt default URI",
+			env:         map[string]string{"LIBVIRT_DEFAULT_URI": "qemu+ssh://host/system", "VIRTWOLD_LIBVIRT_URI": "qemu:///session"},
+			wantValues:  map[string]string{"libvirturi": "qemu:///session"},
+			wantSources: map[string]string{"libvirturi": "environment variable VIRTWOLD_LIBVIRT_URI"},
+		},
+		{
+			name:       "configuration file overrides libvirt default URI",
+			env:        map[string]string{"LIBVIRT_DEFAULT_URI": "qemu+ssh://host/system"},
+			config:     "libvirt_uri: qemu:///system\n",
+			wantValues: map[string]string{"libvirturi": "qemu:///system"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for env := range envFlags {
+				t.Setenv(env, "")
+				os.Unsetenv(env)
+			}
+			t.Setenv("LIBVIRT_DEFAULT_URI", "")
+			for env, value := range tt.env {
+				t.Setenv(env, value)
+			}
+			configpath := ""
+			if tt.config != "" {
+				configpath = writeConfig(t, tt.config)
+			}
+
+			fs := newTestFlagSet(t, tt.args...)
+			sources, config, err := resolveConfig(fs, configpath)
+			if err != nil {
+				t.Fatalf("resolveConfig() error = %v", err)
+			}
+			if (config != nil) != (configpath != "") {
+				t.Errorf("resolveConfig() config = %v, want one only when a file is given", config)
+			}
+			for name, want := range tt.wantValues {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("-%s = %q, want %q", name, got, want)
+				}
+			}
+			for name, want := range tt.wantSources {
+				if sources[name] != want {
+					t.Errorf("source of -%s = %q, want %q", name, sources[name], want)
+				}
+			}
+		})
+	}
+}
+
+// Create a flag set with the settings resolveConfig resolves, with their usual defaults, parsing args into it
+func newTestFlagSet(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("virtwold", flag.ContinueOnError)
+	fs.String("interface", "eth0", "")
+	fs.String("libvirturi", "qemu+tcp:///system", "")
+	fs.String("ports", "7,9,0", "")
+	fs.String("password", "", "")
+	fs.String("mac-passwords", "", "")
+	fs.String("allow", "", "")
+	fs.Bool("vlan", false, "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+	return fs
+}
+
+// Replace the configuration file's contents, then send SIGHUP to reload it
+func hangup(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	for env := range envFlags {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	path := writeConfig(t, "allow: [52:54:00:00:35:01]\nmappings:\n  - mac: 52:54:00:00:35:01\n    password: 73:33:63:72:33:74\n")
+	fs := newTestFlagSet(t)
+	sources, config, err := resolveConfig(fs, path)
+	if err != nil {
+		t.Fatalf("resolveConfig() error = %v", err)
+	}
+	passwords, allowed, _, err := reloadConfig(fs, path, sources)
+	if err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+	w := newTestWaker()
+	w.SetPasswords(passwords)
+	l := newTestListener(nil)
+	l.SetAllowlist(allowed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloadOnHangup(ctx, fs, path, sources, config, w, l)
+
+	// An invalid configuration keeps the current settings
+	hangup(t, path, "allow: [nonsense]\n")
+	time.Sleep(100 * time.Millisecond)
+	if !l.allowed.Load().isAllowed("52:54:00:00:35:01") {
+		t.Fatal("invalid configuration replaced the allowlist")
+	}
+
+	hangup(t, path, "allow: [52:54:00:00:35:02]\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.allowed.Load().isAllowed("52:54:00:00:35:02") {
+		if time.Now().After(deadline) {
+			t.Fatal("allowlist not reloaded after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l.allowed.Load().isAllowed("52:54:00:00:35:01") {
+		t.Error("MAC removed from the allowlist is still allowed after SIGHUP")
+	}
+	if _, ok := w.passwords.Load().perMAC["52:54:00:00:35:01"]; ok {
+		t.Error("password removed from the configuration is still required after SIGHUP")
+	}
+}
+
+func TestLoadMappingFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "comments and styles",
+			content: "# MAC name\n52:54:00:00:48:01 web\n\n52-54-00-00-48-02   db  \n",
+			want:    map[string]string{"52:54:00:00:48:01": "web", "52:54:00:00:48:02": "db"},
+		},
+		{name: "missing name", content: "52:54:00:00:48:01\n", wantErr: "line 1"},
+		{name: "invalid MAC", content: "# header\nnonsense web\n", wantErr: "invalid MAC on line 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings, err := LoadMappingFile(writeConfig(t, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadMappingFile() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(mappings, tt.want) {
+				t.Errorf("LoadMappingFile() = %v, %v, want %v", mappings, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"colon hex", "aa:bb:cc:dd:ee:ff", "aabbccddeeff"},
+		{"ASCII", "s3cr3t", "733363723374"},
+		{"ASCII with separators", "a,b=c:", "612c623d633a"},
+		{"invalid", "abc", "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := encodePassword(tt.password)
+			if encoded != tt.want {
+				t.Fatalf("encodePassword(%q) = %q, want %q", tt.password, encoded, tt.want)
+			}
+
+			// The encoded password has to parse back to the same bytes, even from within the -mac-passwords list
+			original, err := parsePassword(tt.password)
+			if err != nil {
+				return
+			}
+			passwords, err := parsePasswordConfig("", "52:54:00:00:67:01="+encoded)
+			if err != nil {
+				t.Fatalf("parsePasswordConfig() error = %v", err)
+			}
+			if got := passwords.perMAC["52:54:00:00:67:01"]; !bytes.Equal(got, original) {
+				t.Errorf("password parsed back as %x, want %x", got, original)
+			}
+		})
+	}
+}
+
+func TestLoadConfigProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		bpf     bool // Whether the profiles have filters, which need libpcap to compile them
+		want    []Profile
+		wantErr string
+	}{
+		{
+			name:    "snaplen only",
+			content: "profiles:\n  - interface: eth1\n    snaplen: 512\n",
+			want:    []Profile{{Interface: "eth1", Snaplen: 512}},
+		},
+		{
+			name:    "filter and snaplen",
+			content: "profiles:\n  - interface: trunk0\n    filter: vlan 20 and udp\n    snaplen: 2048\n  - interface: eth0\n    filter: udp port 9\n",
+			bpf:     true,
+			want:    []Profile{{Interface: "trunk0", Filter: "vlan 20 and udp", Snaplen: 2048}, {Interface: "eth0", Filter: "udp port 9"}},
+		},
+		{
+			name:    "no interface",
+			content: "profiles:\n  - snaplen: 512\n",
+			wantErr: "profile 1 of",
+		},
+		{
+			name:    "duplicate interface",
+			content: "profiles:\n  - interface: eth1\n  - interface: eth1\n",
+			wantErr: "more than one profile for interface eth1",
+		},
+		{
+			name:    "snaplen too small",
+			content: "profiles:\n  - interface: eth1\n    snaplen: 64\n",
+			wantErr: "invalid snaplen in profile for eth1",
+		},
+		{
+			name:    "invalid filter",
+			content: "profiles:\n  - interface: eth1\n    filter: not a filter\n",
+			bpf:     true,
+			wantErr: "invalid BPF filter in profile for eth1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.bpf {
+				requireBPF(t)
+			}
+			config, err := LoadConfig(writeConfig(t, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(config.Profiles, tt.want) {
+				t.Errorf("profiles = %+v, want %+v", config.Profiles, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// A reply to a control socket command, written as a line of JSON
+type controlResponse struct {
+	Result any    `json:"result,omitempty"` // What the command returned, if it succeeded
+	Error  string `json:"error,omitempty"`  // Why the command failed, if it did
+}
+
+// The state of the daemon, as returned by the status command
+type controlStatus struct {
+	Capturing bool         `json:"capturing"` // Whether packets are being captured and handled
+	Hosts     []hostStatus `json:"hosts"`     // The libvirt hosts, in search order
+}
+
+// Whether the connection to one libvirt host is up
+type hostStatus struct {
+	URI string `json:"uri"` // URI to the libvirt daemon
+	Up  bool   `json:"up"`  // Whether the connection is up
+}
+
+// Answers commands from local tools on a Unix domain socket
+type controlServer struct {
+	waker    *Waker
+	listener *Listener
+}
+
+// Listen on a Unix domain socket at path, answering each line sent to it as a command, until the context is cancelled
+// A socket left behind by a previous run is replaced
+func serveControl(ctx context.Context, path string, waker *Waker, listener *Listener) error {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %w", path, err)
+	}
+	// Anyone who can connect can wake VMs, so keep it to the daemon's own user
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to restrict control socket %s: %w", path, err)
+	}
+
+	server := &controlServer{waker: waker, listener: listener}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		slog.Info("Serving control socket", "event", "control_started", "path", path)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error("Control socket failed", "event", "control_failed", "error", err)
+				}
+				return
+			}
+			go server.serveConn(ctx, conn)
+		}
+	}()
+	return nil
+}
+
+// Answer each command sent on the connection until it's closed
+func (s *controlServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if err := encoder.Encode(s.dispatch(ctx, scanner.Text())); err != nil {
+			slog.Warn("Failed to write control response", "event", "control_failed", "error", err)
+			return
+		}
+	}
+}
+
+// Run a single command: status, domains, or wake <mac> [password]
+func (s *controlServer) dispatch(ctx context.Context, line string) controlResponse {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return controlResponse{Error: "no command given"}
+	}
+
+	switch command, args := fields[0], fields[1:]; command {
+	case "status":
+		status := controlStatus{Capturing: s.listener.Healthy() == nil, Hosts: []hostStatus{}}
+		for _, host := range s.waker.hosts {
+			status.Hosts = append(status.Hosts, hostStatus{URI: host.uri, Up: host.up.Load()})
+		}
+		return controlResponse{Result: status}
+
+	case "domains":
+		return controlResponse{Result: s.waker.ListDomains()}
+
+	case "wake":
+		if len(args) < 1 || len(args) > 2 {
+			return controlResponse{Error: "usage: wake <mac> [password]"}
+		}
+		hwaddr, err := net.ParseMAC(args[0])
+		if err != nil {
+			return controlResponse{Error: fmt.Sprintf("invalid MAC: %q", args[0])}
+		}
+		wol := &virtwold.MagicPacket{MAC: hwaddr.String()}
+		if len(args) == 2 {
+			if wol.Password, err = parsePassword(args[1]); err != nil {
+				return controlResponse{Error: err.Error()}
+			}
+		}
+		if !s.listener.allowed.Load().isAllowed(wol.MAC) {
+			return controlResponse{Error: fmt.Sprintf("MAC not in allowlist: %s", wol.MAC)}
+		}
+
+		slog.Info("Waking from control socket", "event", "control_wake", "mac", wol.MAC)
+		result, err := s.waker.WakeVirtualMachine(ctx, wol)
+		logWakeResult(wol.MAC, result)
+		if err != nil {
+			wakeErrors.Inc()
+			return controlResponse{Result: result, Error: err.Error()}
+		}
+		return controlResponse{Result: result}
+
+	default:
+		return controlResponse{Error: fmt.Sprintf("unknown command: %q", command)}
+	}
+}
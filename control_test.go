@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Send the command to the control socket at path, decoding the reply's result into result
+func controlCommand(t *testing.T, path string, command string, result any) controlResponse {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect to control socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		t.Fatalf("failed to send %q: %v", command, err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("failed to read the reply to %q: %v", command, err)
+	}
+	response := controlResponse{Result: result}
+	if err := json.Unmarshal(line, &response); err != nil {
+		t.Fatalf("failed to decode %q: %v", line, err)
+	}
+	return response
+}
+
+func TestControlSocketStatus(t *testing.T) {
+	w, _ := newFakeHostWaker(t)
+	l := newTestListener(w.WakeVirtualMachine)
+	l.beat()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	if err := serveControl(ctx, path, w, l); err != nil {
+		t.Fatalf("serveControl() error = %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("control socket missing: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("control socket mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	var status controlStatus
+	if response := controlCommand(t, path, "status", &status); response.Error != "" {
+		t.Fatalf("status error = %s", response.Error)
+	}
+	want := controlStatus{Capturing: true, Hosts: []hostStatus{{URI: "test:///default", Up: true}}}
+	if status.Capturing != want.Capturing || !slices.Equal(status.Hosts, want.Hosts) {
+		t.Errorf("status = %+v, want %+v", status, want)
+	}
+}
+
+func TestControlDispatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     string
+		wantError   string
+		wantOutcome WakeOutcome
+	}{
+		{"empty", "", "no command given", ""},
+		{"unknown", "reboot", `unknown command: "reboot"`, ""},
+		{"wake without a MAC", "wake", "usage: wake <mac> [password]", ""},
+		{"wake with an invalid MAC", "wake vm", `invalid MAC: "vm"`, ""},
+		{"wake", "wake 52:54:00:00:70:01", "", WakeStarted},
+		{"wake a missing domain", "wake 52:54:00:00:70:02", "", WakeNoMatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:70:01")
+			w, _ := newFakeHostWaker(t, fake)
+			server := &controlServer{waker: w, listener: newTestListener(w.WakeVirtualMachine)}
+
+			response := server.dispatch(context.Background(), tt.command)
+			if response.Error != tt.wantError {
+				t.Errorf("dispatch(%q) error = %q, want %q", tt.command, response.Error, tt.wantError)
+			}
+			if tt.wantOutcome == "" {
+				return
+			}
+			if result, ok := response.Result.(WakeResult); !ok || result.Outcome != tt.wantOutcome {
+				t.Errorf("dispatch(%q) result = %+v, want %s", tt.command, response.Result, tt.wantOutcome)
+			}
+		})
+	}
+}
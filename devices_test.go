@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Replace the device list pcap reports for the rest of the test
+func withDevices(t *testing.T, devices ...pcap.Interface) {
+	t.Helper()
+	original := findAllDevs
+	findAllDevs = func() ([]pcap.Interface, error) { return devices, nil }
+	t.Cleanup(func() { findAllDevs = original })
+}
+
+func TestCheckDevice(t *testing.T) {
+	withDevices(t,
+		pcap.Interface{Name: "eth0"},
+		pcap.Interface{Name: "br0"},
+		pcap.Interface{Name: "lo", Flags: pcapIfLoopback},
+	)
+
+	tests := []struct {
+		name    string
+		device  string
+		wantErr string
+	}{
+		{name: "present", device: "br0"},
+		{name: "loopback", device: "lo"},
+		{name: "any", device: "any"},
+		{name: "missing", device: "eth1", wantErr: "eth1 not found (valid devices: eth0, br0, lo)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDevice(tt.device)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("checkDevice(%q) = %v, want nil", tt.device, err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("checkDevice(%q) = %v, want %q", tt.device, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCaptureDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []pcap.Interface
+		want    []string
+	}{
+		{name: "none"},
+		{
+			name: "skips loopback and any",
+			devices: []pcap.Interface{
+				{Name: "eth0"},
+				{Name: "any"},
+				{Name: "lo", Flags: pcapIfLoopback},
+				{Name: "virbr0"},
+			},
+			want: []string{"eth0", "virbr0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDevices(t, tt.devices...)
+			if got := captureDevices(); !slices.Equal(got, tt.want) {
+				t.Errorf("captureDevices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []pcap.Interface
+		want    string
+	}{
+		{name: "none", want: ""},
+		{
+			name: "descriptions and addresses",
+			devices: []pcap.Interface{
+				{Name: "eth0", Description: "Ethernet", Addresses: []pcap.InterfaceAddress{{IP: net.IPv4(192, 168, 1, 10)}, {IP: net.ParseIP("fe80::1")}}},
+				{Name: "br0"},
+				{Name: "lo", Flags: pcapIfLoopback, Addresses: []pcap.InterfaceAddress{{IP: net.IPv4(127, 0, 0, 1)}}},
+			},
+			want: "1.eth0 (Ethernet)\n\t192.168.1.10\n\tfe80::1\n2.br0\n3.lo [Loopback]\n\t127.0.0.1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			printDevices(&out, tt.devices)
+			if out.String() != tt.want {
+				t.Errorf("printDevices() = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenCapturePromiscuous(t *testing.T) {
+	for _, promiscuous := range []bool{false, true} {
+		t.Run(strconv.FormatBool(promiscuous), func(t *testing.T) {
+			var gotDevice string
+			var gotSnaplen int32
+			var gotPromiscuous bool
+			original := openLive
+			openLive = func(device string, snaplen int32, promisc bool, timeout time.Duration) (*pcap.Handle, error) {
+				gotDevice, gotSnaplen, gotPromiscuous = device, snaplen, promisc
+				return nil, errors.New("no such device")
+			}
+			t.Cleanup(func() { openLive = original })
+
+			if _, err := openCapture("eth0", "pcap", 400, promiscuous, "udp"); err == nil {
+				t.Fatal("openCapture() succeeded, want the error from opening the device")
+			}
+			if gotDevice != "eth0" || gotSnaplen != 400 || gotPromiscuous != promiscuous {
+				t.Errorf("opened %s with snaplen %d and promiscuous %t, want eth0 with 400 and %t", gotDevice, gotSnaplen, gotPromiscuous, promiscuous)
+			}
+		})
+	}
+}
+
+func TestWaitForDevices(t *testing.T) {
+	tests := []struct {
+		name      string
+		appearsOn int // Poll on which virbr0 first appears, or 0 if it never does
+		timeout   time.Duration
+		wantPolls int
+	}{
+		{"already present", 1, time.Minute, 1},
+		{"appears on the second poll", 2, time.Minute, 2},
+		{"never appears", 0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polls := 0
+			original := findAllDevs
+			findAllDevs = func() ([]pcap.Interface, error) {
+				polls++
+				devices := []pcap.Interface{{Name: "eth0"}}
+				if tt.appearsOn != 0 && polls >= tt.appearsOn {
+					devices = append(devices, pcap.Interface{Name: "virbr0"})
+				}
+				return devices, nil
+			}
+			t.Cleanup(func() { findAllDevs = original })
+
+			waitForDevices([]string{"virbr0"}, tt.timeout)
+			if polls != tt.wantPolls {
+				t.Errorf("polled %d times, want %d", polls, tt.wantPolls)
+			}
+			if err := checkDevice("virbr0"); (err == nil) != (tt.appearsOn != 0) {
+				t.Errorf("checkDevice() after waiting = %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenInterfacesMissing(t *testing.T) {
+	withDevices(t, pcap.Interface{Name: "eth0"}, pcap.Interface{Name: "virbr0"})
+
+	tests := []struct {
+		name  string
+		iface string
+	}{
+		{"single", "br0"},
+		{"one of several", "eth0,br0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handles, err := openInterfaces(tt.iface, "pcap", 1600, false, "", nil, 0)
+			if err == nil {
+				for _, handle := range handles {
+					handle.Close()
+				}
+				t.Fatalf("openInterfaces(%q) succeeded, want an error", tt.iface)
+			}
+			for _, want := range []string{"Unable to open device", "br0 not found", "eth0, virbr0"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("openInterfaces(%q) error = %q, want it to contain %q", tt.iface, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenCapturePermissionHint(t *testing.T) {
+	const hint = "capturing needs root or the CAP_NET_RAW capability"
+	tests := []struct {
+		name     string
+		err      error
+		wantHint bool
+	}{
+		{"libpcap message", errors.New("eth0: You don't have permission to perform this capture on that device (socket: Operation not permitted)"), true},
+		{"EPERM", fmt.Errorf("socket: %w", syscall.EPERM), true},
+		{"EACCES", fmt.Errorf("open /dev/bpf0: %w", syscall.EACCES), true},
+		{"missing device", errors.New("eth9: No such device exists (SIOCGIFHWADDR: No such device)"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := openLive
+			openLive = func(device string, snaplen int32, promisc bool, timeout time.Duration) (*pcap.Handle, error) {
+				return nil, tt.err
+			}
+			t.Cleanup(func() { openLive = original })
+
+			_, err := openCapture("eth0", "pcap", 1600, false, "udp")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("openCapture() error = %v, want it to wrap %v", err, tt.err)
+			}
+			if got := strings.Contains(err.Error(), hint); got != tt.wantHint {
+				t.Errorf("openCapture() error = %q, hint given = %t, want %t", err, got, tt.wantHint)
+			}
+		})
+	}
+}
+
+func TestOpenInterfacesProfiles(t *testing.T) {
+	withDevices(t, pcap.Interface{Name: "eth0"}, pcap.Interface{Name: "trunk0"}, pcap.Interface{Name: "eth1"})
+	type settings struct {
+		snaplen int32
+		filter  string
+	}
+	opened := make(map[string]settings)
+	original := openDevice
+	openDevice = func(name string, backend string, snaplen int32, promiscuous bool, filter string) (packetHandle, error) {
+		opened[name] = settings{snaplen, filter}
+		return &fakeHandle{}, nil
+	}
+	t.Cleanup(func() { openDevice = original })
+
+	profiles := map[string]Profile{
+		"trunk0": {Interface: "trunk0", Filter: "vlan 20 and udp", Snaplen: 2048},
+		"eth1":   {Interface: "eth1", Snaplen: 512},
+	}
+	handles, err := openInterfaces("eth0,trunk0,eth1", "pcap", 1600, false, "udp", profiles, 0)
+	if err != nil {
+		t.Fatalf("openInterfaces() error = %v", err)
+	}
+	for _, handle := range handles {
+		handle.Close()
+	}
+
+	want := map[string]settings{
+		"eth0":   {1600, "udp"},
+		"trunk0": {2048, "vlan 20 and udp"},
+		"eth1":   {512, "udp"},
+	}
+	if !reflect.DeepEqual(opened, want) {
+		t.Errorf("opened %+v, want %+v", opened, want)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Print every valid magic packet captured, without waking anything, to check that a sender's packets reach the host
+// Usage: virtwold discover [-interface any] [-ports 7,9,0] [-capture-backend pcap]
+func runDiscover(args []string) error {
+	var iface string          // Comma-separated list of interfaces to listen on
+	var portlist string       // Comma-separated list of UDP ports to listen for WOL packets on
+	var capturebackend string // How to capture packets: pcap or afpacket
+
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	fs.StringVar(&iface, "interface", "any", "Network interface name to listen on, or a comma-separated list of names")
+	fs.StringVar(&portlist, "ports", "7,9,0", "Comma-separated list of UDP ports to listen for WOL packets on")
+	fs.StringVar(&capturebackend, "capture-backend", "pcap", "How to capture packets, pcap or afpacket (Linux only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ports, err := parsePorts(portlist)
+	if err != nil {
+		return fmt.Errorf("invalid port list: %w", err)
+	}
+	// Capture any length and VLAN, so packets the daemon's filter would miss are shown too
+	filter, err := buildBPFFilter(ports, true, 0, true)
+	if err != nil {
+		return fmt.Errorf("unable to build BPF filter: %w", err)
+	}
+
+	handles, err := openInterfaces(iface, capturebackend, defaultSnaplen, false, filter, nil, 0)
+	if err != nil {
+		return err
+	}
+	for _, handle := range handles {
+		defer handle.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "Listening for magic packets on %s, press Ctrl-C to stop\n", iface)
+	printMagicPackets(ctx, os.Stdout, mergePackets(ctx, handles))
+	return nil
+}
+
+// Print the MAC, variant, sender, and interface of each valid magic packet from the source, until the context is
+// cancelled or the source runs out of packets
+func printMagicPackets(ctx context.Context, w io.Writer, source PacketSource) {
+	packets := source.Packets()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+			wol, err := virtwold.GrabMACAddr(packet)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "%s %s variant=%s from=%s interface=%s\n", time.Now().Format(time.RFC3339), wol.MAC,
+				wol.Variant, orUnknown(packetSource(packet)), orUnknown(ingressInterface(packet)))
+		}
+	}
+}
+
+// Return the IP address the packet was sent from, or its source MAC for a raw Ethernet frame
+func packetSource(packet gopacket.Packet) string {
+	if network := packet.NetworkLayer(); network != nil {
+		return network.NetworkFlow().Src().String()
+	}
+	return sourceMAC(packet)
+}
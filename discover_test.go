@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPrintMagicPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []string // Each printed line, without its timestamp; fake frames have no interface index
+	}{
+		{
+			name:   "udp",
+			frames: [][]byte{udpPacket(t, magicPayload(t, "52:54:00:00:95:01")).Data()},
+			want:   []string{"52:54:00:00:95:01 variant=plain from=192.168.1.2 interface=unknown"},
+		},
+		{
+			name:   "raw ethernet",
+			frames: [][]byte{rawFrame(t, magicPayload(t, "52:54:00:00:95:02")).Data()},
+			want:   []string{"52:54:00:00:95:02 variant=plain from=02:00:00:00:00:01 interface=unknown"},
+		},
+		{
+			name: "invalid packets are skipped",
+			frames: [][]byte{
+				udpPacket(t, []byte("not a magic packet")).Data(),
+				udpPacket(t, magicPayload(t, "52:54:00:00:95:03")).Data(),
+				udpPacket(t, magicPayload(t, "52:54:00:00:95:04")).Data(),
+			},
+			want: []string{
+				"52:54:00:00:95:03 variant=plain from=192.168.1.2 interface=unknown",
+				"52:54:00:00:95:04 variant=plain from=192.168.1.2 interface=unknown",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var buf bytes.Buffer
+			printMagicPackets(ctx, &buf, mergePackets(ctx, []captureHandle{{&fakeHandle{frames: tt.frames}, "fake0"}}))
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+				if _, rest, ok := strings.Cut(line, " "); ok {
+					got = append(got, rest)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("printed:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How many of the most recent wake events are kept for /events
+const eventHistory = 50
+
+// A record of handling a WOL packet, as returned by /events
+type wakeEvent struct {
+	Time    time.Time   `json:"time"`              // When the packet was handled
+	MAC     string      `json:"mac"`               // Normalized MAC from the packet
+	Domains []string    `json:"domains,omitempty"` // Names of the matching VMs
+	Outcome WakeOutcome `json:"outcome"`           // What happened to the matching VMs
+	Error   string      `json:"error,omitempty"`   // Why waking failed, if it did
+}
+
+// A fixed-size buffer of the most recent wake events, overwriting the oldest once full
+type eventRing struct {
+	mu     sync.Mutex  // Protects events and next, which are shared by packet handling and the HTTP server
+	events []wakeEvent // The events, wrapping around at next once full
+	next   int         // Where the next event goes
+	size   int         // Most events kept
+}
+
+// Create an eventRing keeping the last size events
+func newEventRing(size int) *eventRing {
+	return &eventRing{size: size}
+}
+
+// Record an event, dropping the oldest if the buffer is full
+func (r *eventRing) add(event wakeEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.events) < r.size {
+		r.events = append(r.events, event)
+	} else {
+		r.events[r.next] = event
+	}
+	r.next = (r.next + 1) % r.size
+}
+
+// Return the recorded events, newest first
+func (r *eventRing) list() []wakeEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make([]wakeEvent, 0, len(r.events))
+	for i := 1; i <= len(r.events); i++ {
+		events = append(events, r.events[(r.next-i+len(r.events))%len(r.events)])
+	}
+	return events
+}
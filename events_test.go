@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestEventRing(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		events int
+		want   []string
+	}{
+		{"empty", 3, 0, []string{}},
+		{"partly full", 3, 2, []string{"mac-2", "mac-1"}},
+		{"full", 3, 3, []string{"mac-3", "mac-2", "mac-1"}},
+		{"wrapped", 3, 7, []string{"mac-7", "mac-6", "mac-5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := newEventRing(tt.size)
+			for i := 1; i <= tt.events; i++ {
+				ring.add(wakeEvent{MAC: fmt.Sprintf("mac-%d", i)})
+			}
+
+			macs := []string{}
+			for _, event := range ring.list() {
+				macs = append(macs, event.MAC)
+			}
+			if !slices.Equal(macs, tt.want) {
+				t.Errorf("list() = %v, want %v", macs, tt.want)
+			}
+		})
+	}
+}
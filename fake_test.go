@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"io"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A domain standing in for a libvirt one, recording the wake calls made on it
+type fakeDomain struct {
+	mu         sync.Mutex          // Protects the fields below, as domains may be woken from several goroutines
+	name       string              // Name of the domain
+	uuid       string              // UUID of the domain
+	xml        string              // Domain XML returned by GetXMLDesc
+	state      libvirt.DomainState // State returned by GetState
+	autostart  bool                // Whether the domain starts when the host boots
+	persistent bool                // Whether the domain is defined, rather than transient
+	wakeErrs   []error             // Errors returned by the next wake calls, after which they succeed
+	calls      []string            // Names of the wake calls made, in order
+}
+
+// Number of fake domains created, to give each a different UUID
+var fakeDomains int
+
+// Create a shut off, persistent fake domain with a bridged interface for each of the MACs
+func newFakeDomain(t testing.TB, name string, macs ...string) *fakeDomain {
+	t.Helper()
+	return newFakeDomainConfig(t, &libvirtxml.Domain{Type: "kvm", Name: name, Devices: fakeInterfaces(macs...)})
+}
+
+// Return devices with a bridged interface for each of the MACs
+func fakeInterfaces(macs ...string) *libvirtxml.DomainDeviceList {
+	devices := &libvirtxml.DomainDeviceList{}
+	for _, mac := range macs {
+		devices.Interfaces = append(devices.Interfaces, libvirtxml.DomainInterface{
+			MAC:    &libvirtxml.DomainInterfaceMAC{Address: mac},
+			Source: &libvirtxml.DomainInterfaceSource{Bridge: &libvirtxml.DomainInterfaceSourceBridge{Bridge: "br0"}},
+		})
+	}
+	return devices
+}
+
+// Create a shut off, persistent fake domain with the configuration, giving it a UUID if it has none
+func newFakeDomainConfig(t testing.TB, domcfg *libvirtxml.Domain) *fakeDomain {
+	t.Helper()
+	if domcfg.UUID == "" {
+		fakeDomains++
+		domcfg.UUID = fmt.Sprintf("00000000-0000-0000-0000-%012d", fakeDomains)
+	}
+	xml, err := domcfg.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal domain XML: %v", err)
+	}
+	return &fakeDomain{name: domcfg.Name, uuid: domcfg.UUID, xml: xml, state: libvirt.DOMAIN_SHUTOFF, persistent: true}
+}
+
+// Describe the fake domain as a virtwold.WakeableDomain, as listing it would
+func (d *fakeDomain) wakeable(t testing.TB) virtwold.WakeableDomain {
+	t.Helper()
+	details, err := virtwold.DescribeDomain(d)
+	if err != nil {
+		t.Fatalf("DescribeDomain(%s) error = %v", d.name, err)
+	}
+	return details
+}
+
+// Return the wake calls made so far
+func (d *fakeDomain) wakeCalls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.calls...)
+}
+
+// Record a wake call, failing it with the next error if any, or otherwise moving the domain to the state
+func (d *fakeDomain) wake(method string, state libvirt.DomainState) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, method)
+	if len(d.wakeErrs) > 0 {
+		err := d.wakeErrs[0]
+		d.wakeErrs = d.wakeErrs[1:]
+		return err
+	}
+	d.state = state
+	return nil
+}
+
+func (d *fakeDomain) Create() error {
+	return d.wake("Create", libvirt.DOMAIN_RUNNING)
+}
+
+func (d *fakeDomain) PMWakeup(flags uint32) error {
+	return d.wake("PMWakeup", libvirt.DOMAIN_RUNNING)
+}
+
+func (d *fakeDomain) Resume() error {
+	return d.wake("Resume", libvirt.DOMAIN_RUNNING)
+}
+
+func (d *fakeDomain) Reboot(flags libvirt.DomainRebootFlagValues) error {
+	return d.wake("Reboot", libvirt.DOMAIN_RUNNING)
+}
+
+func (d *fakeDomain) GetState() (libvirt.DomainState, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state, 0, nil
+}
+
+func (d *fakeDomain) GetXMLDesc(flags libvirt.DomainXMLFlags) (string, error) {
+	return d.xml, nil
+}
+
+func (d *fakeDomain) GetUUIDString() (string, error) {
+	return d.uuid, nil
+}
+
+func (d *fakeDomain) GetAutostart() (bool, error) {
+	return d.autostart, nil
+}
+
+func (d *fakeDomain) IsPersistent() (bool, error) {
+	return d.persistent, nil
+}
+
+func (d *fakeDomain) Ref() error {
+	return nil
+}
+
+func (d *fakeDomain) Free() error {
+	return nil
+}
+
+// A libvirt connection standing in for one to a daemon with the fake domains
+type fakeConnection struct {
+	mu      sync.Mutex                 // Protects the fields below, as connections may be used from several goroutines
+	domains []*fakeDomain              // Domains defined on the daemon
+	leases  []libvirt.NetworkDHCPLease // DHCP leases on the daemon's networks
+	dead    bool                       // Whether the connection has dropped, so IsAlive reports false
+	listErr error                      // Error returned by listing domains, or nil to list them
+	lists   int                        // Number of times the domains were listed
+	closed  int                        // Number of times the connection was closed
+}
+
+func (c *fakeConnection) IsAlive() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.dead, nil
+}
+
+func (c *fakeConnection) Close() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed++
+	return 0, nil
+}
+
+func (c *fakeConnection) wakeableDomains(configs *virtwold.ConfigCache, running bool) ([]virtwold.WakeableDomain, error) {
+	c.mu.Lock()
+	c.lists++
+	domains, err := slices.Clone(c.domains), c.listErr
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var wakeable []virtwold.WakeableDomain
+	for _, domain := range domains {
+		if state, _, _ := domain.GetState(); state == libvirt.DOMAIN_RUNNING && !running {
+			continue
+		}
+		details, err := configs.DescribeDomain(domain)
+		if err != nil {
+			virtwold.FreeWakeable(wakeable)
+			return nil, err
+		}
+		wakeable = append(wakeable, details)
+	}
+	return wakeable, nil
+}
+
+// Return the domain for which match returns true, or libvirt's error for a missing domain
+func (c *fakeConnection) findDomain(match func(*fakeDomain) bool) (virtwold.Domain, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, domain := range c.domains {
+		if match(domain) {
+			return domain, nil
+		}
+	}
+	return nil, libvirt.Error{Code: libvirt.ERR_NO_DOMAIN, Message: "Domain not found"}
+}
+
+func (c *fakeConnection) domainByName(name string) (virtwold.Domain, error) {
+	return c.findDomain(func(domain *fakeDomain) bool { return domain.name == name })
+}
+
+func (c *fakeConnection) domainByUUID(uuid string) (virtwold.Domain, error) {
+	return c.findDomain(func(domain *fakeDomain) bool { return domain.uuid == uuid })
+}
+
+func (c *fakeConnection) activeUUIDs() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var uuids []string
+	for _, domain := range c.domains {
+		if state, _, _ := domain.GetState(); state != libvirt.DOMAIN_SHUTOFF {
+			uuids = append(uuids, domain.uuid)
+		}
+	}
+	return uuids, nil
+}
+
+func (c *fakeConnection) dhcpLeases() ([]libvirt.NetworkDHCPLease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leases, nil
+}
+
+// Make connecting to each URI open its fake connection for the rest of the test, failing for URIs without one
+// Returns the number of times each URI was connected to
+func withFakeHosts(t *testing.T, connections map[string]*fakeConnection) map[string]int {
+	t.Helper()
+	var mu sync.Mutex
+	dials := make(map[string]int)
+	original := dialHost
+	dialHost = func(uri string, timeout time.Duration, readOnly bool) (hostConnection, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials[uri]++
+		if connection, ok := connections[uri]; ok {
+			return connection, nil
+		}
+		return nil, fmt.Errorf("no fake host at %s", uri)
+	}
+	t.Cleanup(func() { dialHost = original })
+	return dials
+}
+
+// Create a Waker connected to a single fake libvirt host with the domains
+func newFakeHostWaker(t *testing.T, domains ...*fakeDomain) (*Waker, *fakeConnection) {
+	t.Helper()
+	connection := &fakeConnection{domains: domains}
+	withFakeHosts(t, map[string]*fakeConnection{"test:///default": connection})
+	w, err := NewWaker([]string{"test:///default"}, 0, false, passwordConfig{perMAC: make(map[string][]byte)})
+	if err != nil {
+		t.Fatalf("NewWaker() error = %v", err)
+	}
+	return w, connection
+}
+
+// Create a Waker with no libvirt host, for testing waking domains directly
+func newTestWaker() *Waker {
+	w := &Waker{}
+	w.rules.Store(&configRules{})
+	return w
+}
+
+// Return a magic packet for the MAC, followed by extra
+func magicPayload(t testing.TB, mac string, extra ...byte) []byte {
+	t.Helper()
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{0xff}, 6)
+	payload = append(payload, bytes.Repeat(hwaddr, 16)...)
+	return append(payload, extra...)
+}
+
+// Serialize the layers into a packet decoded from Ethernet, as captured
+func serializePacket(t testing.TB, layerList ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, layerList...); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// Return a raw Ethernet WOL frame (EtherType 0x0842) carrying the payload
+func rawFrame(t testing.TB, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: virtwold.EtherType,
+	}
+	return serializePacket(t, eth, gopacket.Payload(payload))
+}
+
+// Return a broadcast IPv4 UDP packet to port 9 carrying the payload
+func udpPacket(t testing.TB, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 168, 1, 2), DstIP: net.IPv4bcast}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	return serializePacket(t, eth, ip, udp, gopacket.Payload(payload))
+}
+
+// Return an IPv6 UDP packet to port 9 of the destination, such as the ff02::1 multicast group, carrying the payload
+func udp6Packet(t testing.TB, dst net.IP, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("fe80::2"), DstIP: dst}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	return serializePacket(t, eth, ip, udp, gopacket.Payload(payload))
+}
+
+// Return a broadcast IPv4 UDP packet to port 9 carrying the payload, tagged with the 802.1Q VLAN ID
+func vlanUDPPacket(t testing.TB, vlanID uint16, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	tag := &layers.Dot1Q{VLANIdentifier: vlanID, Type: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 168, 1, 2), DstIP: net.IPv4bcast}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	return serializePacket(t, eth, tag, ip, udp, gopacket.Payload(payload))
+}
+
+// A capture handle standing in for one on a device, delivering the frames and then failing with err
+type fakeHandle struct {
+	frames [][]byte    // Frames left to deliver
+	err    error       // Error returned once the frames run out, io.EOF if nil
+	stats  *pcap.Stats // Statistics returned by Stats
+	closed atomic.Bool // Whether the handle has been closed
+}
+
+func (h *fakeHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(h.frames) == 0 {
+		if h.err != nil {
+			return nil, gopacket.CaptureInfo{}, h.err
+		}
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	frame := h.frames[0]
+	h.frames = h.frames[1:]
+	return frame, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}, nil
+}
+
+func (h *fakeHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (h *fakeHandle) Stats() (*pcap.Stats, error) {
+	if h.stats == nil {
+		return nil, errors.New("no statistics")
+	}
+	return h.stats, nil
+}
+
+func (h *fakeHandle) Close() {
+	h.closed.Store(true)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const hookTimeout = 5 * time.Minute // Longest a pre_wake or post_wake hook may run, such as to revert a snapshot
+
+// Commands run around waking the VM for a MAC, from the configuration file
+type wakeHooks struct {
+	preWake  string // Shell command run before waking, aborting the wake if it fails, or empty for none
+	postWake string // Shell command run after waking, whose failure is only logged, or empty for none
+}
+
+// Runs a hook's shell command with the extra environment variables, returning its output,
+// replaceable so hooks can be checked without running anything
+var runHook = func(ctx context.Context, command string, env []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.CombinedOutput()
+}
+
+// Run the named hook for waking the domain for the (normalized) MAC, with both in its environment
+func runWakeHook(kind string, command string, mac string, domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	output, err := runHook(ctx, command, []string{"VIRTWOLD_MAC=" + mac, "VIRTWOLD_DOMAIN=" + domain})
+	if err != nil {
+		return fmt.Errorf("%s hook %q failed: %w: %s", kind, command, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"slices"
+	"testing"
+)
+
+func TestWakeHooks(t *testing.T) {
+	tests := []struct {
+		name        string
+		mapping     Mapping
+		failing     string // Hook command that fails, or empty for none
+		wantHooks   []string
+		wantOutcome WakeOutcome
+		wantErr     bool
+		wantCalls   []string
+	}{
+		{"no hooks", Mapping{}, "", nil, WakeStarted, false, []string{"Create"}},
+		{"both hooks", Mapping{PreWake: "revert", PostWake: "attach"}, "", []string{"revert", "attach"}, WakeStarted, false, []string{"Create"}},
+		{"pre_wake failure aborts", Mapping{PreWake: "revert", PostWake: "attach"}, "revert", []string{"revert"}, WakeFailed, true, nil},
+		{"post_wake failure only logs", Mapping{PreWake: "revert", PostWake: "attach"}, "attach", []string{"revert", "attach"}, WakeStarted, false, []string{"Create"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:92:01")
+			w, _ := newFakeHostWaker(t, fake)
+			tt.mapping.MAC = "52-54-00-00-92-01"
+			w.SetConfigRules(&Config{Mappings: []Mapping{tt.mapping}})
+
+			var hooks []string
+			original := runHook
+			t.Cleanup(func() { runHook = original })
+			runHook = func(ctx context.Context, command string, env []string) ([]byte, error) {
+				hooks = append(hooks, command)
+				if want := []string{"VIRTWOLD_MAC=52:54:00:00:92:01", "VIRTWOLD_DOMAIN=vm"}; !slices.Equal(env, want) {
+					t.Errorf("%s hook env = %v, want %v", command, env, want)
+				}
+				if command == tt.failing {
+					return []byte("snapshot missing\n"), errors.New("exit status 1")
+				}
+				return nil, nil
+			}
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:92:01"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WakeVirtualMachine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if !slices.Equal(hooks, tt.wantHooks) {
+				t.Errorf("hooks run = %v, want %v", hooks, tt.wantHooks)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRunWakeHookError(t *testing.T) {
+	original := runHook
+	t.Cleanup(func() { runHook = original })
+	runHook = func(ctx context.Context, command string, env []string) ([]byte, error) {
+		return []byte("snapshot missing\n"), errors.New("exit status 1")
+	}
+
+	err := runWakeHook("pre_wake", "revert", "52:54:00:00:92:01", "vm")
+	if want := `pre_wake hook "revert" failed: exit status 1: snapshot missing`; err == nil || err.Error() != want {
+		t.Errorf("runWakeHook() error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"go.opentelemetry.io/otel/attribute"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reconnectAttempts       = 5                // Number of times to try reconnecting to libvirt before giving up on a packet
+	reconnectInitialBackoff = time.Second      // Delay before the second reconnect attempt, doubled after each failure
+	reconnectMaxBackoff     = 30 * time.Second // Upper bound on the delay between reconnect attempts
+)
+
+// Waits between reconnect attempts, replaceable so tests don't wait out the backoff
+var reconnectSleep = time.Sleep
+
+// A persistent connection to one libvirt daemon
+type libvirtHost struct {
+	uri            string                // URI to the libvirt daemon
+	connectTimeout time.Duration         // How long to wait for a connection to open, or 0 to wait forever
+	readOnly       bool                  // Open the connection read-only, which can list domains but not start them
+	ifaceTypes     map[string]bool       // Only match MACs of interfaces of these types, or of any type if empty
+	configs        *virtwold.ConfigCache // Parsed configurations of the host's domains, reused while their XML is unchanged
+	connection     hostConnection        // Connection to the libvirt daemon, reused across wakes
+	mu             sync.Mutex            // Protects connection and index, which are shared by packet handling and the HTTP server
+	index          map[string][]string   // Names of the domains with each (normalized) MAC, as of the last listing
+	up             atomic.Bool           // Whether the last connection attempt succeeded and the connection is still alive
+}
+
+// Record whether the connection is up, for health checks and metrics
+func (h *libvirtHost) setUp(up bool) {
+	h.up.Store(up)
+	if up {
+		libvirtUp.WithLabelValues(h.uri).Set(1)
+	} else {
+		libvirtUp.WithLabelValues(h.uri).Set(0)
+	}
+}
+
+// The parts of a libvirt connection a host uses, so hosts can be tested without a libvirt daemon
+type hostConnection interface {
+	IsAlive() (bool, error)
+	Close() (int, error)
+	wakeableDomains(configs *virtwold.ConfigCache, running bool) ([]virtwold.WakeableDomain, error) // As ConfigCache.ListWakeableDomains
+	domainByName(name string) (virtwold.Domain, error)                                              // Look up a domain by name
+	domainByUUID(uuid string) (virtwold.Domain, error)                                              // Look up a domain by UUID
+	activeUUIDs() ([]string, error)                                                                 // UUIDs of the active domains
+	dhcpLeases() ([]libvirt.NetworkDHCPLease, error)                                                // DHCP leases on every active network
+}
+
+// A hostConnection to a libvirt daemon
+type libvirtConnection struct {
+	*libvirt.Connect
+}
+
+func (c libvirtConnection) wakeableDomains(configs *virtwold.ConfigCache, running bool) ([]virtwold.WakeableDomain, error) {
+	return configs.ListWakeableDomains(c.Connect, running)
+}
+
+func (c libvirtConnection) domainByName(name string) (virtwold.Domain, error) {
+	domain, err := c.LookupDomainByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (c libvirtConnection) domainByUUID(uuid string) (virtwold.Domain, error) {
+	domain, err := c.LookupDomainByUUIDString(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (c libvirtConnection) activeUUIDs() ([]string, error) {
+	domains, err := c.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	for _, domain := range domains {
+		if uuid, err := domain.GetUUIDString(); err == nil {
+			uuids = append(uuids, uuid)
+		}
+		domain.Free()
+	}
+	return uuids, nil
+}
+
+func (c libvirtConnection) dhcpLeases() ([]libvirt.NetworkDHCPLease, error) {
+	networks, err := c.ListAllNetworks(libvirt.CONNECT_LIST_NETWORKS_ACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	defer func() {
+		for _, network := range networks {
+			network.Free()
+		}
+	}()
+
+	var leases []libvirt.NetworkDHCPLease
+	for _, network := range networks {
+		networkLeases, err := network.GetDHCPLeases()
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, networkLeases...)
+	}
+	return leases, nil
+}
+
+// Opens a connection to the libvirt daemon at uri within timeout, replaceable so hosts can be tested without one
+var dialHost = func(uri string, timeout time.Duration, readOnly bool) (hostConnection, error) {
+	connection, err := dialLibvirt(uri, timeout, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return libvirtConnection{connection}, nil
+}
+
+// Open a new connection to the libvirt daemon
+func (h *libvirtHost) connect() error {
+	connection, err := dialHost(h.uri, h.connectTimeout, h.readOnly)
+	if err != nil {
+		h.setUp(false)
+		return fmt.Errorf("failed to connect to %s: %w", h.uri, err)
+	}
+	h.connection = connection
+	h.setUp(true)
+	return nil
+}
+
+// Connect to the libvirt daemon at uri, read-only or read-write, giving up after timeout (or never, if timeout is 0)
+// libvirt.NewConnect can block for a long time on an unreachable remote host, so it runs in its own goroutine
+// to keep one dead host from hanging the whole listener
+func dialLibvirt(uri string, timeout time.Duration, readOnly bool) (*libvirt.Connect, error) {
+	open := libvirt.NewConnect
+	if readOnly {
+		open = libvirt.NewConnectReadOnly
+	}
+	return openWithTimeout(uri, timeout, open)
+}
+
+// Open a connection to uri with open, giving up after timeout (or never, if timeout is 0)
+func openWithTimeout(uri string, timeout time.Duration, open func(string) (*libvirt.Connect, error)) (*libvirt.Connect, error) {
+	if timeout <= 0 {
+		return open(uri)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		connection *libvirt.Connect
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		connection, err := open(uri)
+		done <- result{connection, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.connection, r.err
+
+	case <-ctx.Done():
+		// Close the connection if it does eventually open, since nothing will use it
+		go func() {
+			if r := <-done; r.connection != nil {
+				r.connection.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %s connecting to %s", timeout, uri)
+	}
+}
+
+// Make sure the libvirt connection is usable, reconnecting if it has dropped
+func (h *libvirtHost) ensureConnected() error {
+	if h.connection != nil {
+		if alive, err := h.connection.IsAlive(); err == nil && alive {
+			return nil
+		}
+		h.setUp(false)
+		slog.Warn("libvirt connection is no longer alive", "event", "libvirt_dead", "uri", h.uri)
+	}
+	return h.reconnect()
+}
+
+// Drop the current libvirt connection and open a new one, retrying with exponential backoff
+// The caller must hold h.mu, which is released while waiting between attempts
+func (h *libvirtHost) reconnect() error {
+	if h.connection != nil {
+		h.connection.Close()
+		h.connection = nil
+	}
+
+	var err error
+	backoff := reconnectInitialBackoff
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		slog.Info("Reconnecting to libvirt", "event", "libvirt_reconnect", "uri", h.uri, "attempt", attempt, "attempts", reconnectAttempts)
+		if err = h.connect(); err == nil {
+			slog.Info("Reconnected to libvirt", "event", "libvirt_reconnected", "uri", h.uri)
+			return nil
+		}
+		slog.Warn("Reconnect failed", "event", "libvirt_reconnect_failed", "uri", h.uri, "error", err)
+
+		if attempt < reconnectAttempts {
+			// Don't hold the lock through the backoff, or the HTTP server and every other packet would wait on it too
+			h.mu.Unlock()
+			reconnectSleep(backoff)
+			h.mu.Lock()
+
+			// Another caller may have reconnected while this one waited
+			if h.connection != nil {
+				return nil
+			}
+
+			backoff *= 2
+			if backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+		}
+	}
+
+	return fmt.Errorf("giving up on %s after %d reconnect attempts: %w", h.uri, reconnectAttempts, err)
+}
+
+// Close the libvirt connection
+func (h *libvirtHost) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.connection != nil {
+		h.connection.Close()
+		h.connection = nil
+	}
+	h.setUp(false)
+}
+
+// List the wakeable domains on the host, plus running ones if running is set, reconnecting first if needed
+// The caller must free the domains returned
+func (h *libvirtHost) listDomains(running bool) ([]virtwold.WakeableDomain, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Reconnect first if libvirtd restarted or the link to it dropped since the last packet
+	if err := h.ensureConnected(); err != nil {
+		return nil, err
+	}
+
+	// If listing fails the connection may have gone away, so reconnect once and try again
+	domains, err := h.connection.wakeableDomains(h.configs, running)
+	if err != nil {
+		slog.Warn("Failed to retrieve domains, reconnecting", "event", "list_domains_failed", "uri", h.uri, "error", err)
+		if err := h.reconnect(); err != nil {
+			return nil, err
+		}
+		domains, err = h.connection.wakeableDomains(h.configs, running)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve domains from %s: %w", h.uri, err)
+		}
+	}
+
+	// Every listing refreshes the index, so a lookup that missed it and fell back to listing updates it too
+	h.index = make(map[string][]string)
+	for _, domain := range domains {
+		for _, mac := range domain.MACs {
+			h.index[mac] = append(h.index[mac], domain.Name)
+		}
+	}
+
+	return domains, nil
+}
+
+// Find the wakeable domains on the host with an interface matching the (normalized) MAC, using the index
+// to look them up by name if it knows the MAC, and otherwise listing every domain
+// The caller must free the domains returned
+func (h *libvirtHost) findDomainsIndexed(mac string) ([]virtwold.WakeableDomain, error) {
+	h.mu.Lock()
+	names := h.index[mac]
+	h.mu.Unlock()
+	if len(names) == 0 {
+		return h.findDomains(mac)
+	}
+
+	var matches []virtwold.WakeableDomain
+	for _, name := range names {
+		domains, err := h.lookupDomain(name)
+		if err != nil {
+			virtwold.FreeWakeable(matches)
+			return nil, err
+		}
+		for _, domain := range domains {
+			if virtwold.DomainHasMACOfType(domain.Config(), mac, h.ifaceTypes) {
+				matches = append(matches, domain)
+			} else {
+				domain.Free()
+			}
+		}
+	}
+
+	// The index is stale if the domains were renamed, undefined, or had their MAC changed since it was built
+	if len(matches) == 0 {
+		slog.Debug("Domain index is stale, listing every domain", "event", "index_stale", "uri", h.uri, "mac", mac)
+		return h.findDomains(mac)
+	}
+	return matches, nil
+}
+
+// Find the wakeable domains on the host with an interface matching the (normalized) MAC
+// The caller must free the domains returned
+func (h *libvirtHost) findDomains(mac string) ([]virtwold.WakeableDomain, error) {
+	// Check every interface of the domain, since a VM may have several NICs and any of them may match
+	return h.filterDomains(func(domain virtwold.WakeableDomain) bool {
+		return virtwold.DomainHasMACOfType(domain.Config(), mac, h.ifaceTypes)
+	})
+}
+
+// Find the wakeable domain on the host with the given name
+// The caller must free the domains returned
+func (h *libvirtHost) findDomainsNamed(name string) ([]virtwold.WakeableDomain, error) {
+	return h.filterDomains(func(domain virtwold.WakeableDomain) bool {
+		return domain.Name == name
+	})
+}
+
+// Find the wakeable domains on the host with an interface on the given target device
+// The caller must free the domains returned
+func (h *libvirtHost) findDomainsTarget(target string) ([]virtwold.WakeableDomain, error) {
+	return h.filterDomains(func(domain virtwold.WakeableDomain) bool {
+		return virtwold.DomainHasTarget(domain.Config(), target)
+	})
+}
+
+// Look up the domain with the given name on the host directly, without listing every domain
+// Returns no domains if the host has no domain with that name
+// The caller must free the domains returned
+func (h *libvirtHost) lookupDomain(name string) ([]virtwold.WakeableDomain, error) {
+	return h.lookupDomainBy(name, hostConnection.domainByName)
+}
+
+// Look up the domain with the given UUID on the host directly, without listing every domain
+// Returns no domains if the host has no domain with that UUID
+// The caller must free the domains returned
+func (h *libvirtHost) lookupDomainUUID(uuid string) ([]virtwold.WakeableDomain, error) {
+	return h.lookupDomainBy(uuid, hostConnection.domainByUUID)
+}
+
+// Look up a single domain on the host with lookup, describing it as key in errors
+// The caller must free the domains returned
+func (h *libvirtHost) lookupDomainBy(key string, lookup func(hostConnection, string) (virtwold.Domain, error)) ([]virtwold.WakeableDomain, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.ensureConnected(); err != nil {
+		return nil, err
+	}
+
+	domain, err := lookup(h.connection, key)
+	var lverr libvirt.Error
+	if errors.As(err, &lverr) && lverr.Code == libvirt.ERR_NO_DOMAIN {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up domain %s on %s: %w", key, h.uri, err)
+	}
+
+	details, err := h.configs.DescribeDomain(domain)
+	if err != nil {
+		domain.Free()
+		return nil, err
+	}
+	return []virtwold.WakeableDomain{details}, nil
+}
+
+// Find the domains on the host with find, tracing connecting to libvirt separately from the lookup
+// Connecting is only done first when tracing, since find connects anyway
+func (h *libvirtHost) findTraced(ctx context.Context, find func(*libvirtHost) ([]virtwold.WakeableDomain, error)) ([]virtwold.WakeableDomain, error) {
+	if _, span := startSpan(ctx, "libvirt.connect", attribute.String("uri", h.uri)); span.IsRecording() {
+		h.mu.Lock()
+		err := h.ensureConnected()
+		h.mu.Unlock()
+		endSpan(span, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, span := startSpan(ctx, "domain.lookup", attribute.String("uri", h.uri))
+	matches, err := find(h)
+	span.SetAttributes(attribute.Int("domains", len(matches)))
+	endSpan(span, err)
+	return matches, err
+}
+
+// Return the UUIDs of the domains on the host that are running, or otherwise active
+// Unlike lookups for packets, this never reconnects, so polling it can't keep the connection locked while
+// reconnecting backs off, which would hold up packet handling for as long as libvirt is down
+func (h *libvirtHost) activeUUIDs() ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.connection == nil || !h.up.Load() {
+		return nil, fmt.Errorf("not connected to %s", h.uri)
+	}
+
+	uuids, err := h.connection.activeUUIDs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list running domains on %s: %w", h.uri, err)
+	}
+	return uuids, nil
+}
+
+// Find the domain that was leased the (normalized) MAC by a DHCP server on one of the host's libvirt networks,
+// by the hostname it gave the DHCP server, for domains whose effective MAC differs from their configuration
+// The caller must free the domains returned
+func (h *libvirtHost) findDomainsLeased(mac string) ([]virtwold.WakeableDomain, error) {
+	hostname, err := h.leasedHostname(mac)
+	if err != nil || hostname == "" {
+		return nil, err
+	}
+	return h.lookupDomain(hostname)
+}
+
+// Return the hostname given with the DHCP lease of the (normalized) MAC on any of the host's networks,
+// or empty if there's no such lease
+func (h *libvirtHost) leasedHostname(mac string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.ensureConnected(); err != nil {
+		return "", err
+	}
+
+	leases, err := h.connection.dhcpLeases()
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve DHCP leases on %s: %w", h.uri, err)
+	}
+	return leaseHostname(leases, mac), nil
+}
+
+// Return the hostname given with the lease of the (normalized) MAC, or empty if none of the leases are for it
+func leaseHostname(leases []libvirt.NetworkDHCPLease, mac string) string {
+	for _, lease := range leases {
+		if virtwold.NormalizeMAC(lease.Mac) == mac && lease.Hostname != "" {
+			return lease.Hostname
+		}
+	}
+	return ""
+}
+
+// List the wakeable and running domains on the host for which keep returns true, freeing the rest
+// Running domains can't be woken, but matching them tells a packet for a running VM apart from one for no VM
+// The caller must free the domains returned
+func (h *libvirtHost) filterDomains(keep func(virtwold.WakeableDomain) bool) ([]virtwold.WakeableDomain, error) {
+	domains, err := h.listDomains(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []virtwold.WakeableDomain
+	for _, domain := range domains {
+		if keep(domain) {
+			matches = append(matches, domain)
+		} else {
+			domain.Free()
+		}
+	}
+
+	return matches, nil
+}
+
+// Return the lifecycle policy of the domain that says it shouldn't be started from its current state, if any
+// A preserve action keeps a domain that powered off or crashed around for inspection, so starting it would lose that
+func lifecyclePolicy(domcfg *libvirtxml.Domain, state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_SHUTDOWN, libvirt.DOMAIN_SHUTOFF:
+		if domcfg.OnPoweroff == "preserve" {
+			return "on_poweroff=" + domcfg.OnPoweroff
+		}
+	case libvirt.DOMAIN_CRASHED:
+		if domcfg.OnCrash == "preserve" || domcfg.OnCrash == "coredump-preserve" {
+			return "on_crash=" + domcfg.OnCrash
+		}
+	}
+	return ""
+}
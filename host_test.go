@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"libvirt.org/go/libvirt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionReused(t *testing.T) {
+	first := newFakeDomain(t, "first", "52:54:00:00:00:01")
+	second := newFakeDomain(t, "second", "52:54:00:00:00:02")
+	connection := &fakeConnection{domains: []*fakeDomain{first, second}}
+	dials := withFakeHosts(t, map[string]*fakeConnection{"test:///default": connection})
+
+	w, err := NewWaker([]string{"test:///default"}, 0, false, passwordConfig{perMAC: make(map[string][]byte)})
+	if err != nil {
+		t.Fatalf("NewWaker() error = %v", err)
+	}
+
+	macs := []string{"52:54:00:00:00:01", "52:54:00:00:00:02", "52:54:00:00:00:03"}
+	for _, mac := range macs {
+		if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: mac}); err != nil {
+			t.Fatalf("WakeVirtualMachine(%s) error = %v", mac, err)
+		}
+	}
+
+	if dials["test:///default"] != 1 {
+		t.Errorf("connected %d times, want 1", dials["test:///default"])
+	}
+	if connection.lists != len(macs) {
+		t.Errorf("listed domains %d times, want %d", connection.lists, len(macs))
+	}
+	for _, fake := range []*fakeDomain{first, second} {
+		if calls := fake.wakeCalls(); !slices.Equal(calls, []string{"Create"}) {
+			t.Errorf("%s calls = %v, want [Create]", fake.name, calls)
+		}
+	}
+
+	// A dropped connection is replaced, and the new one reused
+	connection.dead = true
+	if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:00:04"}); err != nil {
+		t.Fatalf("WakeVirtualMachine() error = %v", err)
+	}
+	if dials["test:///default"] != 2 || connection.closed != 1 {
+		t.Errorf("after the connection dropped, connected %d times and closed %d, want 2 and 1", dials["test:///default"], connection.closed)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		wantDials  int
+		wantSleeps []time.Duration
+		wantErr    string
+	}{
+		{"first attempt", 0, 1, nil, ""},
+		{"after two failures", 2, 3, []time.Duration{time.Second, 2 * time.Second}, ""},
+		{"gives up", reconnectAttempts, reconnectAttempts, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, "giving up on test:///default after 5 reconnect attempts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sleeps []time.Duration
+			originalSleep := reconnectSleep
+			reconnectSleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+			t.Cleanup(func() { reconnectSleep = originalSleep })
+
+			dials := 0
+			originalDial := dialHost
+			dialHost = func(uri string, timeout time.Duration, readOnly bool) (hostConnection, error) {
+				dials++
+				if dials <= tt.failures {
+					return nil, errors.New("connection refused")
+				}
+				return &fakeConnection{}, nil
+			}
+			t.Cleanup(func() { dialHost = originalDial })
+
+			h := &libvirtHost{uri: "test:///default"}
+			h.mu.Lock()
+			err := h.reconnect()
+			h.mu.Unlock()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("reconnect() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("reconnect() error = %v, want %q", err, tt.wantErr)
+			}
+			if dials != tt.wantDials {
+				t.Errorf("connected %d times, want %d", dials, tt.wantDials)
+			}
+			if !slices.Equal(sleeps, tt.wantSleeps) {
+				t.Errorf("slept %v, want %v", sleeps, tt.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestReconnectReleasesLock(t *testing.T) {
+	dials := 0
+	originalDial := dialHost
+	dialHost = func(uri string, timeout time.Duration, readOnly bool) (hostConnection, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	}
+	t.Cleanup(func() { dialHost = originalDial })
+
+	// Stand in for another caller, which takes the lock during the backoff and reconnects
+	h := &libvirtHost{uri: "test:///default"}
+	originalSleep := reconnectSleep
+	reconnectSleep = func(time.Duration) {
+		if !h.mu.TryLock() {
+			t.Fatal("reconnect() held the lock while waiting")
+		}
+		h.connection = &fakeConnection{}
+		h.mu.Unlock()
+	}
+	t.Cleanup(func() { reconnectSleep = originalSleep })
+
+	h.mu.Lock()
+	err := h.reconnect()
+	h.mu.Unlock()
+	if err != nil {
+		t.Fatalf("reconnect() error = %v", err)
+	}
+	if dials != 1 {
+		t.Errorf("connected %d times, want 1 as the other caller's connection is reused", dials)
+	}
+}
+
+func TestWakeAcrossHosts(t *testing.T) {
+	tests := []struct {
+		name       string
+		firstMACs  []string
+		wantFirst  []string
+		wantSecond []string
+	}{
+		{"only on second host", nil, nil, []string{"Create"}},
+		// Only the first match is woken, so the second host's domain is left alone
+		{"on both hosts", []string{"52:54:00:00:25:01"}, []string{"Create"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := newFakeDomain(t, "first", tt.firstMACs...)
+			second := newFakeDomain(t, "second", "52:54:00:00:25:01")
+			withFakeHosts(t, map[string]*fakeConnection{
+				"test:///first":  {domains: []*fakeDomain{first}},
+				"test:///second": {domains: []*fakeDomain{second}},
+			})
+			w, err := NewWaker([]string{"test:///first", "test:///second"}, 0, false, passwordConfig{perMAC: make(map[string][]byte)})
+			if err != nil {
+				t.Fatalf("NewWaker() error = %v", err)
+			}
+
+			if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:25:01"}); err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if calls := first.wakeCalls(); !slices.Equal(calls, tt.wantFirst) {
+				t.Errorf("first host calls = %v, want %v", calls, tt.wantFirst)
+			}
+			if calls := second.wakeCalls(); !slices.Equal(calls, tt.wantSecond) {
+				t.Errorf("second host calls = %v, want %v", calls, tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestNewWakerUnreachableHost(t *testing.T) {
+	withFakeHosts(t, map[string]*fakeConnection{"test:///up": {}})
+
+	// One unreachable host is retried later, but none being reachable is an error
+	if _, err := NewWaker([]string{"test:///down", "test:///up"}, 0, false, passwordConfig{}); err != nil {
+		t.Errorf("NewWaker() with one host down error = %v, want nil", err)
+	}
+	if _, err := NewWaker([]string{"test:///down"}, 0, false, passwordConfig{}); err == nil {
+		t.Error("NewWaker() with every host down succeeded, want an error")
+	}
+}
+
+func TestOpenWithTimeout(t *testing.T) {
+	failure := errors.New("connection refused")
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		err     error
+		timeout time.Duration
+		wantErr string
+	}{
+		{"slow connect times out", time.Second, nil, 10 * time.Millisecond, "timed out after 10ms connecting to test:///slow"},
+		{"fast failure", 0, failure, time.Second, "connection refused"},
+		{"no timeout", 10 * time.Millisecond, failure, 0, "connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The slow open outlives the subtest, so it mustn't read tt once the next one starts
+			delay, openErr := tt.delay, tt.err
+			open := func(uri string) (*libvirt.Connect, error) {
+				time.Sleep(delay)
+				return nil, openErr
+			}
+
+			start := time.Now()
+			_, err := openWithTimeout("test:///slow", tt.timeout, open)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("openWithTimeout() error = %v, want %q", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); tt.timeout > 0 && tt.delay > tt.timeout && elapsed >= tt.delay {
+				t.Errorf("openWithTimeout() took %s, want it to give up after %s", elapsed, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestQueueDuringOutage(t *testing.T) {
+	fake := newFakeDomain(t, "vm", "52:54:00:00:37:01")
+	w, connection := newFakeHostWaker(t, fake)
+	w.queueDepth = 2
+	outage := errors.New("cannot recv data: Connection reset by peer")
+	connection.listErr = outage
+
+	// Repeated packets for the same MAC are only queued once, and the oldest wake is dropped when the queue is full
+	for _, mac := range []string{"52:54:00:00:37:01", "52:54:00:00:37:02", "52:54:00:00:37:01", "52:54:00:00:37:03"} {
+		if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: mac}); err != nil {
+			t.Fatalf("WakeVirtualMachine(%s) during outage error = %v, want the wake queued", mac, err)
+		}
+	}
+	var queued []string
+	for _, item := range w.queue {
+		queued = append(queued, item.mac)
+	}
+	if want := []string{"52:54:00:00:37:01", "52:54:00:00:37:03"}; !slices.Equal(queued, want) {
+		t.Errorf("queued MACs = %v, want %v", queued, want)
+	}
+	if calls := fake.wakeCalls(); len(calls) != 0 {
+		t.Fatalf("calls during outage = %v, want none", calls)
+	}
+
+	connection.mu.Lock()
+	connection.listErr = nil
+	connection.mu.Unlock()
+	w.retryQueued(context.Background())
+
+	if calls := fake.wakeCalls(); !slices.Equal(calls, []string{"Create"}) {
+		t.Errorf("calls after reconnecting = %v, want [Create]", calls)
+	}
+	if len(w.queue) != 0 {
+		t.Errorf("queue = %v after retrying, want it empty", w.queue)
+	}
+}
+
+func TestMappingLookup(t *testing.T) {
+	tests := []struct {
+		name      string
+		mappings  map[string]string
+		wantLists int
+	}{
+		{"hit", map[string]string{"52:54:00:00:48:01": "web"}, 0},
+		{"miss", map[string]string{"52:54:00:00:48:ff": "other"}, 1},
+		{"stale mapping", map[string]string{"52:54:00:00:48:01": "renamed"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			web := newFakeDomain(t, "web", "52:54:00:00:48:01")
+			w, connection := newFakeHostWaker(t, newFakeDomain(t, "db", "52:54:00:00:48:02"), web)
+			w.mappings = tt.mappings
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:48:01"})
+			if err != nil || result.Outcome != WakeStarted {
+				t.Fatalf("WakeVirtualMachine() = %+v, %v, want %s", result, err, WakeStarted)
+			}
+			if calls := web.wakeCalls(); !slices.Equal(calls, []string{"Create"}) {
+				t.Errorf("calls = %v, want [Create]", calls)
+			}
+			// A hit looks the domain up by name, without listing every domain
+			if connection.lists != tt.wantLists {
+				t.Errorf("listed domains %d times, want %d", connection.lists, tt.wantLists)
+			}
+		})
+	}
+}
+
+func TestIndexRefresh(t *testing.T) {
+	web := newFakeDomain(t, "web", "52:54:00:00:49:01")
+	w, connection := newFakeHostWaker(t, web)
+	host := w.hosts[0]
+
+	find := func(mac string) []string {
+		t.Helper()
+		domains, err := host.findDomainsIndexed(mac)
+		if err != nil {
+			t.Fatalf("findDomainsIndexed(%s) error = %v", mac, err)
+		}
+		defer virtwold.FreeWakeable(domains)
+		var names []string
+		for _, domain := range domains {
+			names = append(names, domain.Name)
+		}
+		return names
+	}
+
+	// The first lookup misses the empty index, so lists every domain and builds it
+	if names := find("52:54:00:00:49:01"); !slices.Equal(names, []string{"web"}) || connection.lists != 1 {
+		t.Fatalf("first lookup = %v after %d listings, want [web] after 1", names, connection.lists)
+	}
+	// Later lookups are answered from the index
+	if names := find("52:54:00:00:49:01"); !slices.Equal(names, []string{"web"}) || connection.lists != 1 {
+		t.Errorf("indexed lookup = %v after %d listings, want [web] after 1", names, connection.lists)
+	}
+
+	// A domain defined since the index was built is found by listing again, which refreshes the index
+	connection.mu.Lock()
+	connection.domains = append(connection.domains, newFakeDomain(t, "db", "52:54:00:00:49:02"))
+	connection.mu.Unlock()
+	if names := find("52:54:00:00:49:02"); !slices.Equal(names, []string{"db"}) || connection.lists != 2 {
+		t.Errorf("lookup of a new domain = %v after %d listings, want [db] after 2", names, connection.lists)
+	}
+	if names := host.index["52:54:00:00:49:02"]; !slices.Equal(names, []string{"db"}) {
+		t.Errorf("index = %v for the new domain, want [db]", names)
+	}
+
+	// A domain whose MAC changed makes the index stale, so it's listed again rather than matched wrongly
+	web.mu.Lock()
+	web.xml = newFakeDomain(t, "web", "52:54:00:00:49:03").xml
+	web.mu.Unlock()
+	if names := find("52:54:00:00:49:01"); len(names) != 0 || connection.lists != 3 {
+		t.Errorf("lookup of a changed MAC = %v after %d listings, want none after 3", names, connection.lists)
+	}
+}
+
+func BenchmarkFindDomains(b *testing.B) {
+	var domains []*fakeDomain
+	for i := 0; i < 500; i++ {
+		domains = append(domains, newFakeDomain(b, fmt.Sprintf("vm%03d", i), fmt.Sprintf("52:54:00:00:%02x:%02x", i/256, i%256)))
+	}
+	mac := "52:54:00:00:01:f3"
+	host := &libvirtHost{uri: "test:///default", connection: &fakeConnection{domains: domains}}
+
+	b.Run("listing", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matches, err := host.findDomains(mac)
+			if err != nil || len(matches) != 1 {
+				b.Fatalf("findDomains() = %d domains, %v", len(matches), err)
+			}
+			virtwold.FreeWakeable(matches)
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matches, err := host.findDomainsIndexed(mac)
+			if err != nil || len(matches) != 1 {
+				b.Fatalf("findDomainsIndexed() = %d domains, %v", len(matches), err)
+			}
+			virtwold.FreeWakeable(matches)
+		}
+	})
+}
+
+func TestDHCPLeases(t *testing.T) {
+	leases := []libvirt.NetworkDHCPLease{
+		{Iface: "virbr0", Mac: "52:54:00:AA:54:01", Hostname: "vm"},
+		{Iface: "virbr0", Mac: "52:54:00:aa:54:02", Hostname: "gone"},
+	}
+
+	tests := []struct {
+		name        string
+		useLeases   bool
+		mac         string
+		wantOutcome WakeOutcome
+		wantCalls   []string
+	}{
+		{"static MAC", false, "52:54:00:00:54:01", WakeStarted, []string{"Create"}},
+		{"leased MAC without the flag", false, "52:54:00:aa:54:01", WakeNoMatch, nil},
+		{"leased MAC", true, "52:54:00:aa:54:01", WakeStarted, []string{"Create"}},
+		{"lease for a missing domain", true, "52:54:00:aa:54:02", WakeNoMatch, nil},
+		{"no lease", true, "52:54:00:aa:54:03", WakeNoMatch, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:54:01")
+			w, connection := newFakeHostWaker(t, fake)
+			connection.leases = leases
+			w.useLeases = tt.useLeases
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: tt.mac})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestReadOnlyConnection(t *testing.T) {
+	tests := []struct {
+		name        string
+		readOnly    bool
+		wantOutcome WakeOutcome
+		wantCalls   []string
+	}{
+		{"read-write", false, WakeStarted, []string{"Create"}},
+		{"read-only", true, WakeSkipped, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:62:01")
+			connection := &fakeConnection{domains: []*fakeDomain{fake}}
+			var dialedReadOnly []bool
+			original := dialHost
+			dialHost = func(uri string, timeout time.Duration, readOnly bool) (hostConnection, error) {
+				dialedReadOnly = append(dialedReadOnly, readOnly)
+				return connection, nil
+			}
+			t.Cleanup(func() { dialHost = original })
+
+			w, err := NewWaker([]string{"test:///default"}, 0, tt.readOnly, passwordConfig{})
+			if err != nil {
+				t.Fatalf("NewWaker() error = %v", err)
+			}
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:62:01"})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+
+			if len(dialedReadOnly) == 0 {
+				t.Fatal("no connection was opened")
+			}
+			for _, readOnly := range dialedReadOnly {
+				if readOnly != tt.readOnly {
+					t.Errorf("connection opened with readOnly = %v, want %v", readOnly, tt.readOnly)
+				}
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if !slices.Equal(result.Domains, []string{"vm"}) {
+				t.Errorf("matched %v, want [vm]", result.Domains)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	heartbeatInterval = time.Second            // How often Run records that it's alive while waiting for packets, for the systemd watchdog
+	duplicateWindow   = 500 * time.Millisecond // How long an identical magic packet is treated as a copy of the first, such as the same broadcast captured on several bridges
+)
+
+// Returned by Listener.Run when the packet source has no more packets, such as at the end of a pcap file
+var errSourceClosed = errors.New("packet source closed")
+
+// A source of captured packets, satisfied by gopacket.PacketSource
+type PacketSource interface {
+	Packets() chan gopacket.Packet
+}
+
+// A channel of packets, as a PacketSource
+type packetChan chan gopacket.Packet
+
+// Return the channel itself
+func (c packetChan) Packets() chan gopacket.Packet {
+	return c
+}
+
+// Validates captured WOL packets and hands them off to be woken
+type Listener struct {
+	allowed atomic.Pointer[allowlist]                                        // MACs allowed to be woken, replaced on reload
+	wake    func(context.Context, *virtwold.MagicPacket) (WakeResult, error) // Wakes the VM for a valid WOL packet, such as Waker.WakeVirtualMachine
+	seen    map[string]time.Time                                             // When each distinct magic packet was last handled, for spotting duplicates
+	local   map[string]bool                                                  // (Normalized) MACs of the host's own interfaces, whose packets are ignored
+	vlanID  int                                                              // Only handle packets tagged with this VLAN ID, or 0 to handle packets on any VLAN
+	limiter *rateLimiter                                                     // Limits how often packets are handed off to be woken, or nil for no limit
+
+	heartbeat atomic.Int64 // When Run last went round its loop, in Unix nanoseconds, or 0 if it isn't running
+}
+
+// Check that packets are being captured and handled
+func (l *Listener) Healthy() error {
+	if l.heartbeat.Load() == 0 {
+		return errors.New("not capturing packets")
+	}
+	return nil
+}
+
+// Create a Listener waking the VMs for valid WOL packets with wake
+func NewListener(allowed allowlist, wake func(context.Context, *virtwold.MagicPacket) (WakeResult, error)) *Listener {
+	l := &Listener{wake: wake, seen: make(map[string]time.Time)}
+	l.SetAllowlist(allowed)
+	return l
+}
+
+// Replace the MACs allowed to be woken, such as after reloading the configuration
+func (l *Listener) SetAllowlist(allowed allowlist) {
+	l.allowed.Store(&allowed)
+}
+
+// Handle every packet from the source until the context is cancelled, returning nil,
+// or the source runs out of packets, returning errSourceClosed
+func (l *Listener) Run(ctx context.Context, source PacketSource) error {
+	packets := source.Packets()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	l.beat()
+	defer l.heartbeat.Store(0)
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down", "event", "shutdown")
+			return nil
+
+		case <-ticker.C:
+			// Nothing to do but record that the loop is still going
+
+		case packet, ok := <-packets:
+			if !ok {
+				return errSourceClosed
+			}
+			l.handlePacket(ctx, packet)
+		}
+		l.beat()
+	}
+}
+
+// Record that Run is still going round its loop
+func (l *Listener) beat() {
+	l.heartbeat.Store(time.Now().UnixNano())
+}
+
+// Check whether Run has gone round its loop within maxAge, so is still handling packets
+func (l *Listener) Alive(maxAge time.Duration) bool {
+	last := l.heartbeat.Load()
+	return last != 0 && time.Since(time.Unix(0, last)) <= maxAge
+}
+
+// Called for each packet received, with a context cancelled on shutdown
+func (l *Listener) handlePacket(ctx context.Context, packet gopacket.Packet) {
+	received := time.Now()
+	packetsReceived.Inc()
+	slog.Debug("Received potential WOL packet", "event", "packet_received")
+	// Dumping is comparatively slow, so skip even building the dump unless it will be logged
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug("Packet contents", "event", "packet_dump", "dump", hex.Dump(packetContents(packet)))
+	}
+	if source := sourceMAC(packet); source != "" && l.local[source] {
+		slog.Debug("Ignoring packet sent by this host", "event", "packet_local", "source", source)
+		return
+	}
+	// The capture filter normally does this, but not with a custom -bpf filter
+	if l.vlanID != 0 && packetVLAN(packet) != l.vlanID {
+		slog.Debug("Ignoring packet from another VLAN", "event", "packet_other_vlan", "vlan", packetVLAN(packet))
+		return
+	}
+	ctx, span := startSpan(ctx, "packet")
+	defer span.End()
+	_, parseSpan := startSpan(ctx, "packet.parse")
+	wol, err := virtwold.GrabMACAddr(packet)
+	endSpan(parseSpan, err)
+	if err != nil {
+		slog.Warn("Error with packet", "event", "packet_invalid", "error", err)
+		return
+	}
+	span.SetAttributes(attribute.String("mac", wol.MAC), attribute.String("variant", wol.Variant))
+	wol.Interface = ingressInterface(packet)
+	validMagicPackets.WithLabelValues(wol.Variant).Inc()
+	slog.Debug("Validated WOL packet for MAC", "event", "packet_validated", "mac", wol.MAC, "variant", wol.Variant)
+	if l.isDuplicate(wol) {
+		slog.Debug("Ignoring duplicate of a recent packet", "event", "packet_duplicate", "mac", wol.MAC)
+		return
+	}
+	if !l.allowed.Load().isAllowed(wol.MAC) {
+		slog.Info("MAC not in allowlist", "event", "not_allowed", "mac", wol.MAC)
+		return
+	}
+	if l.limiter != nil && !l.limiter.allow(time.Now()) {
+		packetsRateLimited.Inc()
+		slog.Warn("Dropping packet over the rate limit", "event", "rate_limited", "mac", wol.MAC)
+		return
+	}
+	result, err := l.wake(ctx, wol)
+	span.SetAttributes(attribute.String("outcome", string(result.Outcome)))
+	if err != nil {
+		wakeErrors.Inc()
+		slog.Error("Error waking system", "event", "wake_failed", "mac", wol.MAC, "error", err)
+	}
+	logWakeResult(virtwold.NormalizeMAC(wol.MAC), result)
+	observeWakeDuration(received, wol.MAC, result.Outcome)
+}
+
+// Record how long it took from receiving the packet to finishing acting on it, to spot slow libvirt hosts
+// The capture timestamp isn't used, since packets replayed from a pcap file were captured long ago
+func observeWakeDuration(received time.Time, mac string, outcome WakeOutcome) {
+	duration := time.Since(received)
+	wakeDuration.WithLabelValues(string(outcome)).Observe(duration.Seconds())
+	slog.Debug("Finished acting on WOL packet", "event", "wake_duration", "mac", mac, "outcome", outcome, "duration", duration)
+}
+
+// A token bucket, allowing a steady rate of events with bursts of up to a second's worth
+// Only used from Run, so needs no locking
+type rateLimiter struct {
+	rate   float64   // Events allowed per second
+	burst  float64   // Most events allowed at once
+	tokens float64   // Events allowed right now
+	last   time.Time // When tokens was last topped up
+}
+
+// Create a rateLimiter allowing rate events per second, starting with a full bucket
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(1, math.Ceil(rate))
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// Check whether an event at now is within the rate, and if so use up a token for it
+func (r *rateLimiter) allow(now time.Time) bool {
+	if !r.last.IsZero() {
+		r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// Return the (normalized) Ethernet source MAC of the packet, or empty if it has no Ethernet layer
+func sourceMAC(packet gopacket.Packet) string {
+	if ethernet, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		return virtwold.NormalizeMAC(ethernet.SrcMAC.String())
+	}
+	return ""
+}
+
+// Return the name of the interface the packet arrived on, or empty if unknown, such as when replaying a pcap file
+func ingressInterface(packet gopacket.Packet) string {
+	if index := packet.Metadata().InterfaceIndex; index != 0 {
+		if iface, err := net.InterfaceByIndex(index); err == nil {
+			return iface.Name
+		}
+	}
+	return ""
+}
+
+// Return the ID of the (outermost) 802.1Q VLAN tag of the packet, or 0 if it isn't tagged
+func packetVLAN(packet gopacket.Packet) int {
+	if tag, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok {
+		return int(tag.VLANIdentifier)
+	}
+	return 0
+}
+
+// Check whether an identical magic packet was handled within the duplicate window, and if not record this one
+// Only called from Run, so needs no locking
+func (l *Listener) isDuplicate(wol *virtwold.MagicPacket) bool {
+	now := time.Now()
+	for key, last := range l.seen {
+		if now.Sub(last) >= duplicateWindow {
+			delete(l.seen, key)
+		}
+	}
+
+	key := virtwold.NormalizeMAC(wol.MAC) + "/" + string(wol.Password) + "/" + wol.UUID + "/" + wol.Name
+	if _, ok := l.seen[key]; ok {
+		return true
+	}
+	l.seen[key] = now
+	return false
+}
+
+// Return the part of the packet that should hold the magic packet, for dumping
+// That's the application layer payload if there is one, or the whole frame otherwise
+func packetContents(packet gopacket.Packet) []byte {
+	if app := packet.ApplicationLayer(); app != nil {
+		return app.Payload()
+	}
+	return packet.Data()
+}
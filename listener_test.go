@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a Listener allowing every MAC, which hands each packet to be woken to wake
+func newTestListener(wake func(context.Context, *virtwold.MagicPacket) (WakeResult, error)) *Listener {
+	if wake == nil {
+		wake = func(context.Context, *virtwold.MagicPacket) (WakeResult, error) { return WakeResult{}, nil }
+	}
+	return NewListener(allowlist{}, wake)
+}
+
+func TestListenerRunStops(t *testing.T) {
+	tests := []struct {
+		name    string
+		stop    func(cancel context.CancelFunc, packets packetChan)
+		wantErr error
+	}{
+		{"context cancelled", func(cancel context.CancelFunc, packets packetChan) { cancel() }, nil},
+		{"source closed", func(cancel context.CancelFunc, packets packetChan) { close(packets) }, errSourceClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			packets := make(packetChan)
+			l := newTestListener(nil)
+
+			done := make(chan error, 1)
+			go func() { done <- l.Run(ctx, packets) }()
+			tt.stop(cancel, packets)
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Run() = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not return")
+			}
+		})
+	}
+}
+
+// Run the listener over the packets until they're all handled, returning the MACs of the packets handed off to be woken
+func runPackets(t *testing.T, l *Listener, packetList ...gopacket.Packet) []string {
+	t.Helper()
+	var macs []string
+	wake := l.wake
+	l.wake = func(ctx context.Context, wol *virtwold.MagicPacket) (WakeResult, error) {
+		macs = append(macs, wol.MAC)
+		return wake(ctx, wol)
+	}
+
+	packets := make(packetChan, len(packetList))
+	for _, packet := range packetList {
+		packets <- packet
+	}
+	close(packets)
+	if err := l.Run(context.Background(), packets); !errors.Is(err, errSourceClosed) {
+		t.Fatalf("Run() = %v, want %v", err, errSourceClosed)
+	}
+	return macs
+}
+
+func TestListenerRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		packets  func(t *testing.T) []gopacket.Packet
+		wantMACs []string
+	}{
+		{
+			name: "UDP and raw Ethernet",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return []gopacket.Packet{udpPacket(t, magicPayload(t, "52:54:00:00:32:01")), rawFrame(t, magicPayload(t, "52:54:00:00:32:02"))}
+			},
+			wantMACs: []string{"52:54:00:00:32:01", "52:54:00:00:32:02"},
+		},
+		{
+			name: "invalid packet skipped",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return []gopacket.Packet{udpPacket(t, []byte("not a magic packet")), udpPacket(t, magicPayload(t, "52:54:00:00:32:03"))}
+			},
+			wantMACs: []string{"52:54:00:00:32:03"},
+		},
+		{
+			name:    "no packets",
+			packets: func(t *testing.T) []gopacket.Packet { return nil },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if macs := runPackets(t, newTestListener(nil), tt.packets(t)...); !slices.Equal(macs, tt.wantMACs) {
+				t.Errorf("woken MACs = %v, want %v", macs, tt.wantMACs)
+			}
+		})
+	}
+}
+
+func TestListenerIPv6(t *testing.T) {
+	tests := []struct {
+		name string
+		dst  string
+	}{
+		{"multicast", "ff02::1"},
+		{"all-routers multicast", "ff02::2"},
+		{"site-local multicast", "ff05::1"},
+		{"unicast", "2001:db8::10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:33:01")
+			w, _ := newFakeHostWaker(t, fake)
+			l := newTestListener(w.WakeVirtualMachine)
+
+			macs := runPackets(t, l, udp6Packet(t, net.ParseIP(tt.dst), magicPayload(t, "52:54:00:00:33:01")))
+			if !slices.Equal(macs, []string{"52:54:00:00:33:01"}) {
+				t.Errorf("woken MACs = %v, want [52:54:00:00:33:01]", macs)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, []string{"Create"}) {
+				t.Errorf("calls = %v, want [Create]", calls)
+			}
+		})
+	}
+}
+
+func TestListenerAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := make(packetChan)
+	l := newTestListener(nil)
+	if l.Alive(time.Minute) {
+		t.Error("Alive() before Run = true, want false")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- l.Run(ctx, packets) }()
+	packets <- udpPacket(t, magicPayload(t, "52:54:00:00:34:01"))
+	if !l.Alive(time.Minute) {
+		t.Error("Alive() while running = false, want true")
+	}
+
+	cancel()
+	<-done
+	if l.Alive(time.Minute) {
+		t.Error("Alive() after Run returned = true, want false")
+	}
+}
+
+func TestListenerDuplicate(t *testing.T) {
+	packet := udpPacket(t, magicPayload(t, "52:54:00:00:53:01"))
+	secured := udpPacket(t, magicPayload(t, "52:54:00:00:53:01", 1, 2, 3, 4, 5, 6))
+	other := udpPacket(t, magicPayload(t, "52:54:00:00:53:02"))
+	uuid := udpPacket(t, magicPayload(t, "52:54:00:00:53:01", append([]byte(virtwold.UUIDPrefix), make([]byte, virtwold.UUIDSize)...)...))
+
+	// Packets captured on several interfaces are merged into one stream, so copies arrive back to back
+	tests := []struct {
+		name      string
+		packets   []gopacket.Packet
+		wantWakes int
+	}{
+		{"same packet twice", []gopacket.Packet{packet, packet}, 1},
+		{"different MACs", []gopacket.Packet{packet, other}, 2},
+		{"different passwords", []gopacket.Packet{packet, secured}, 2},
+		{"different UUIDs", []gopacket.Packet{packet, uuid}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if macs := runPackets(t, newTestListener(nil), tt.packets...); len(macs) != tt.wantWakes {
+				t.Errorf("woke %v, want %d wakes", macs, tt.wantWakes)
+			}
+		})
+	}
+}
+
+func TestListenerIgnoreLocal(t *testing.T) {
+	// The test frames are all sent from 02:00:00:00:00:01
+	tests := []struct {
+		name     string
+		local    map[string]bool
+		wantMACs []string
+	}{
+		{"not ignoring", nil, []string{"52:54:00:00:64:01", "52:54:00:00:64:02"}},
+		{"other host", map[string]bool{"02:00:00:00:00:02": true}, []string{"52:54:00:00:64:01", "52:54:00:00:64:02"}},
+		{"this host", map[string]bool{"02:00:00:00:00:01": true}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestListener(nil)
+			l.local = tt.local
+			if macs := runPackets(t, l, udpPacket(t, magicPayload(t, "52:54:00:00:64:01")), rawFrame(t, magicPayload(t, "52:54:00:00:64:02"))); !slices.Equal(macs, tt.wantMACs) {
+				t.Errorf("woken MACs = %v, want %v", macs, tt.wantMACs)
+			}
+		})
+	}
+}
+
+func TestLocalMACs(t *testing.T) {
+	macs, err := localMACs()
+	if err != nil {
+		t.Fatalf("localMACs() error = %v", err)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) != 0 && !macs[virtwold.NormalizeMAC(iface.HardwareAddr.String())] {
+			t.Errorf("localMACs() lacks %s of %s", iface.HardwareAddr, iface.Name)
+		}
+	}
+}
+
+func TestListenerVLANID(t *testing.T) {
+	tests := []struct {
+		name     string
+		vlanID   int
+		wantMACs []string
+	}{
+		{"any VLAN", 0, []string{"52:54:00:00:72:14", "52:54:00:00:72:1e", "52:54:00:00:72:01"}},
+		{"VLAN 20", 20, []string{"52:54:00:00:72:14"}},
+		{"VLAN 40", 40, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestListener(nil)
+			l.vlanID = tt.vlanID
+			packets := []gopacket.Packet{
+				vlanUDPPacket(t, 20, magicPayload(t, "52:54:00:00:72:14")),
+				vlanUDPPacket(t, 30, magicPayload(t, "52:54:00:00:72:1e")),
+				udpPacket(t, magicPayload(t, "52:54:00:00:72:01")),
+			}
+			if macs := runPackets(t, l, packets...); !slices.Equal(macs, tt.wantMACs) {
+				t.Errorf("woken MACs = %v, want %v", macs, tt.wantMACs)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		rate    float64
+		offsets []time.Duration // When each event happens, relative to the first
+		want    []bool
+	}{
+		{"burst", 2, []time.Duration{0, 0, 0, 0}, []bool{true, true, false, false}},
+		{"refill", 2, []time.Duration{0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond}, []bool{true, true, false, true, false}},
+		{"refill capped at the burst", 2, []time.Duration{0, 0, time.Minute, time.Minute, time.Minute}, []bool{true, true, true, true, false}},
+		{"under one per second", 0.5, []time.Duration{0, time.Second, 2 * time.Second}, []bool{true, false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(tt.rate)
+			var got []bool
+			for _, offset := range tt.offsets {
+				got = append(got, limiter.allow(start.Add(offset)))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("allowed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenerRateLimit(t *testing.T) {
+	l := newTestListener(nil)
+	l.limiter = newRateLimiter(3)
+
+	// Different MACs, so none are dropped as duplicates
+	var packets []gopacket.Packet
+	for i := 0; i < 10; i++ {
+		packets = append(packets, udpPacket(t, magicPayload(t, fmt.Sprintf("52:54:00:00:73:%02x", i))))
+	}
+	if macs := runPackets(t, l, packets...); len(macs) != 3 {
+		t.Errorf("woke %v, want the first 3 of the burst", macs)
+	}
+}
+
+func TestWakeDurationObserved(t *testing.T) {
+	const count = `virtwold_wake_duration_seconds_count{outcome="started"}`
+	const sum = `virtwold_wake_duration_seconds_sum{outcome="started"}`
+	const delay = 50 * time.Millisecond
+	logs := captureLogs(t, "text", "debug")
+	l := newTestListener(func(ctx context.Context, wol *virtwold.MagicPacket) (WakeResult, error) {
+		// Stands in for a slow libvirt host
+		time.Sleep(delay)
+		return WakeResult{Outcome: WakeStarted, Domains: []string{"vm"}}, nil
+	})
+	countBefore, sumBefore := metricValue(t, count), metricValue(t, sum)
+
+	runPackets(t, l, udpPacket(t, magicPayload(t, "52:54:00:00:90:01")))
+
+	if got := metricValue(t, count) - countBefore; got != 1 {
+		t.Errorf("%s went up by %v, want 1", count, got)
+	}
+	if got := metricValue(t, sum) - sumBefore; got < delay.Seconds() {
+		t.Errorf("%s went up by %v, want at least %v", sum, got, delay.Seconds())
+	}
+	if !strings.Contains(logs.String(), "event=wake_duration mac=52:54:00:00:90:01 outcome=started") {
+		t.Errorf("logs = %q, want a wake_duration event", logs.String())
+	}
+}
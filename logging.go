@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Create a logger writing to w in the given format, either "text" or "json", and at the given level
+// The JSON format emits one object per line, with fields such as mac, domain, event, and error
+// The level is one of debug, info, warn, or error
+func newLogger(format string, level string, w io.Writer) (*slog.Logger, error) {
+	var minlevel slog.Level
+	if err := minlevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q, expected debug, info, warn, or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: minlevel}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+}
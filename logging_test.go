@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger("json", "info", &buf)
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+	logger.Info("Waking system", "event", "waking", "domain", "vm", "mac", "52:54:00:12:34:56")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	for key, want := range map[string]string{"msg": "Waking system", "event": "waking", "domain": "vm", "mac": "52:54:00:12:34:56"} {
+		if entry[key] != want {
+			t.Errorf("%s = %v, want %q", key, entry[key], want)
+		}
+	}
+
+	buf.Reset()
+	if logger, err = newLogger("text", "info", &buf); err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+	logger.Info("Waking system", "event", "waking")
+	if !strings.Contains(buf.String(), `msg="Waking system" event=waking`) {
+		t.Errorf("text log = %q, want key=value pairs", buf.String())
+	}
+
+	if _, err := newLogger("xml", "info", &buf); err == nil || !strings.Contains(err.Error(), `unknown log format "xml"`) {
+		t.Errorf("newLogger(xml) error = %v, want an unknown format error", err)
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	tests := []struct {
+		level     string
+		wantDebug bool
+		wantInfo  bool
+		wantError bool
+	}{
+		{"debug", true, true, true},
+		{"info", false, true, true},
+		{"warn", false, false, true},
+		{"error", false, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := newLogger("text", tt.level, &buf)
+			if err != nil {
+				t.Fatalf("newLogger() error = %v", err)
+			}
+			logger.Debug("debug message")
+			logger.Info("info message")
+			logger.Error("error message")
+
+			for msg, want := range map[string]bool{"debug message": tt.wantDebug, "info message": tt.wantInfo, "error message": tt.wantError} {
+				if got := strings.Contains(buf.String(), msg); got != want {
+					t.Errorf("logged %q = %v, want %v", msg, got, want)
+				}
+			}
+		})
+	}
+
+	if _, err := newLogger("text", "verbose", &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), `unknown log level "verbose"`) {
+		t.Errorf("newLogger(verbose) error = %v, want an unknown level error", err)
+	}
+}
+
+// A buffer that's safe to log to from several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Send the default logger's output to a buffer in the format and at the level for the rest of the test
+func captureLogs(t *testing.T, format string, level string) *syncBuffer {
+	t.Helper()
+	logs := &syncBuffer{}
+	logger, err := newLogger(format, level, logs)
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+	original := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(original) })
+	return logs
+}
+
+func TestPacketDump(t *testing.T) {
+	tests := []struct {
+		level    string
+		wantDump bool
+	}{
+		{"debug", true},
+		{"info", false},
+		{"warn", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			logs := captureLogs(t, "text", tt.level)
+			runPackets(t, newTestListener(nil), udpPacket(t, magicPayload(t, "52:54:00:00:42:01")))
+
+			// hex.Dump starts with the offset, then the sync stream and the first copy of the MAC
+			dumped := strings.Contains(logs.String(), "event=packet_dump") &&
+				strings.Contains(logs.String(), "00000000  ff ff ff ff ff ff 52 54  00 00 42 01")
+			if dumped != tt.wantDump {
+				t.Errorf("packet dumped = %t at %s level, want %t; logs:\n%s", dumped, tt.level, tt.wantDump, logs)
+			}
+		})
+	}
+}
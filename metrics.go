@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served when -metrics-addr is set
+var (
+	packetsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "virtwold_packets_received_total",
+		Help: "Packets received that matched the capture filter",
+	})
+	validMagicPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "virtwold_valid_magic_packets_total",
+		Help: "Received packets that were valid WOL magic packets, by variant (plain, secureon, uuid, named, or oversized)",
+	}, []string{"variant"})
+	packetsRateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "virtwold_packets_rate_limited_total",
+		Help: "Valid magic packets dropped for exceeding the rate limit",
+	})
+	wakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "virtwold_wakes_total",
+		Help: "Domains successfully woken",
+	}, []string{"domain"})
+	wakeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "virtwold_wake_errors_total",
+		Help: "Wake attempts that failed",
+	})
+	wakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "virtwold_wake_duration_seconds",
+		Help:    "Time from receiving a WOL packet to finishing acting on it, by outcome",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"outcome"})
+	libvirtUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "virtwold_libvirt_connection_up",
+		Help: "Whether the connection to each libvirt daemon is up (1) or down (0)",
+	}, []string{"uri"})
+	captureReceived = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "virtwold_capture_packets_received",
+		Help: "Packets received by the capture on each interface, as of the last statistics report",
+	}, []string{"interface"})
+	captureDropped = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "virtwold_capture_packets_dropped",
+		Help: "Packets dropped by the capture on each interface for lack of buffer space, as of the last statistics report",
+	}, []string{"interface"})
+	captureIfDropped = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "virtwold_capture_packets_if_dropped",
+		Help: "Packets dropped by each interface or its driver, as of the last statistics report",
+	}, []string{"interface"})
+)
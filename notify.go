@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Send a state update, such as READY=1, to systemd's notification socket
+// Does nothing if not started by systemd with Type=notify, in which case NOTIFY_SOCKET is unset
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// A leading @ means a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Return how often systemd expects a watchdog ping, or 0 if the watchdog isn't enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// The watchdog may be meant for a different process, such as a parent shell
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Tell systemd the daemon is ready, then keep pinging its watchdog (if enabled) until the context is cancelled
+// Each ping is only sent if alive reports packets were handled within the watchdog interval, so systemd restarts a
+// daemon whose packet handling has hung rather than one that's merely still running
+func notifyReady(ctx context.Context, alive func(maxAge time.Duration) bool) {
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Failed to notify systemd of readiness", "event", "sd_notify_failed", "error", err)
+	}
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	// Ping at half the interval, so a late ping doesn't get the daemon killed
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !alive(interval) {
+					slog.Warn("Packet handling has stalled, not pinging systemd watchdog", "event", "watchdog_stalled", "interval", interval)
+					continue
+				}
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					slog.Warn("Failed to ping systemd watchdog", "event", "sd_notify_failed", "error", err)
+				}
+			}
+		}
+	}()
+}
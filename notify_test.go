@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Listen on a unix datagram socket as systemd does, pointing NOTIFY_SOCKET at it for the rest of the test
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// Read the next state update sent to the socket
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read state update: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifyReady(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "")
+
+	notifyReady(context.Background(), func(time.Duration) bool { return true })
+	if state := readNotify(t, conn); state != "READY=1" {
+		t.Errorf("state = %q, want READY=1", state)
+	}
+}
+
+func TestNotifyWatchdog(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifyReady(ctx, func(maxAge time.Duration) bool { return maxAge == 20*time.Millisecond })
+	for _, want := range []string{"READY=1", "WATCHDOG=1", "WATCHDOG=1"} {
+		if state := readNotify(t, conn); state != want {
+			t.Errorf("state = %q, want %q", state, want)
+		}
+	}
+}
+
+func TestNotifyWatchdogStalled(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifyReady(ctx, func(time.Duration) bool { return false })
+	if state := readNotify(t, conn); state != "READY=1" {
+		t.Errorf("state = %q, want READY=1", state)
+	}
+
+	// Several ping intervals pass without packet handling being alive, so none should be sent
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 256)); err == nil {
+		t.Errorf("received a state update of %d bytes while packet handling was stalled, want none", n)
+	}
+}
+
+func TestSdNotifyUnset(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET = %v, want nil", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{"unset", "", "", 0},
+		{"enabled", "30000000", "", 30 * time.Second},
+		{"for this process", "30000000", pid, 30 * time.Second},
+		{"for another process", "30000000", strconv.Itoa(os.Getpid() + 1), 0},
+		{"invalid", "soon", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := watchdogInterval(); got != tt.want {
+				t.Errorf("watchdogInterval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package virtwold
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// The parsed configuration of a domain, along with a hash of the XML it was parsed from
+type cachedConfig struct {
+	hash   [sha256.Size]byte  // SHA-256 of the domain's XML
+	config *libvirtxml.Domain // The configuration parsed from that XML, which must not be modified
+	used   time.Time          // When the configuration was last parsed or reused
+}
+
+// How long a cached configuration is kept without being used, such as after its domain is undefined
+const configCacheExpiry = time.Hour
+
+// Parsing domain XML is by far the slowest part of listing domains on hosts with hundreds of them, and the XML
+// rarely changes, so a ConfigCache keeps the parsed configurations by UUID and reuses them while the XML is unchanged
+// Each connection should have its own, since UUIDs are only unique on a single host
+// A nil ConfigCache parses the XML every time
+type ConfigCache struct {
+	mu      sync.Mutex              // Protects configs
+	configs map[string]cachedConfig // Parsed configurations by domain UUID
+}
+
+// Create an empty ConfigCache
+func NewConfigCache() *ConfigCache {
+	return &ConfigCache{configs: make(map[string]cachedConfig)}
+}
+
+// The libvirt calls made on a domain, which *libvirt.Domain implements
+// Another implementation can stand in for a libvirt domain, such as to test code waking domains without libvirt
+type Domain interface {
+	Create() error
+	PMWakeup(flags uint32) error
+	Resume() error
+	Reboot(flags libvirt.DomainRebootFlagValues) error
+	GetState() (libvirt.DomainState, int, error)
+	GetXMLDesc(flags libvirt.DomainXMLFlags) (string, error)
+	GetUUIDString() (string, error)
+	GetAutostart() (bool, error)
+	IsPersistent() (bool, error)
+	Ref() error
+	Free() error
+}
+
+// A domain that could be woken, along with the MACs of its interfaces
+type WakeableDomain struct {
+	Name       string   `json:"name"`       // Name of the domain
+	State      string   `json:"state"`      // Current state of the domain, such as shutoff
+	MACs       []string `json:"macs"`       // MACs of the domain's interfaces
+	Autostart  bool     `json:"autostart"`  // Whether the domain starts when the host boots
+	Persistent bool     `json:"persistent"` // Whether the domain is defined, rather than transient
+
+	state  libvirt.DomainState // Current state of the domain
+	config *libvirtxml.Domain  // Configuration of the domain
+	domain Domain              // The domain itself, which must be freed once done with
+}
+
+// Return the current state of the domain, as libvirt reports it
+func (d WakeableDomain) DomainState() libvirt.DomainState {
+	return d.state
+}
+
+// Return the configuration of the domain, which is shared and must not be modified
+func (d WakeableDomain) Config() *libvirtxml.Domain {
+	return d.config
+}
+
+// Return the libvirt domain itself, which is freed along with the WakeableDomain
+func (d WakeableDomain) Domain() Domain {
+	return d.domain
+}
+
+// Free the underlying libvirt domain
+func (d WakeableDomain) Free() {
+	d.domain.Free()
+}
+
+// List all the VMs (aka Domains) configured on the connection that could be woken, along with their state and MACs
+// That's those that are shut off, paused, suspended, or in any other state but running, plus the running ones if
+// running is set, and the state of each decides how it's woken
+// The caller must free the domains returned
+func ListWakeableDomains(connection *libvirt.Connect, running bool) ([]WakeableDomain, error) {
+	return (*ConfigCache)(nil).ListWakeableDomains(connection, running)
+}
+
+// List the domains on the connection that could be woken, as ListWakeableDomains does, reusing the cached
+// configurations of domains whose XML hasn't changed
+// The caller must free the domains returned
+func (c *ConfigCache) ListWakeableDomains(connection *libvirt.Connect, running bool) ([]WakeableDomain, error) {
+	domains, err := connection.ListAllDomains(wakeableListFlags(running))
+	if err != nil {
+		return nil, err
+	}
+
+	var wakeable []WakeableDomain
+	for i := range domains {
+		details, err := c.DescribeDomain(&domains[i])
+		if err != nil {
+			freeDomains(domains[i:])
+			FreeWakeable(wakeable)
+			return nil, err
+		}
+		wakeable = append(wakeable, details)
+	}
+	c.expire(time.Now())
+
+	return wakeable, nil
+}
+
+// Return the flags listing the domains in every state that could be woken, plus running ones if running is set
+// libvirt ANDs flags from different groups, so the states are all given from the state group
+func wakeableListFlags(running bool) libvirt.ConnectListAllDomainsFlags {
+	flags := libvirt.CONNECT_LIST_DOMAINS_SHUTOFF | libvirt.CONNECT_LIST_DOMAINS_PAUSED | libvirt.CONNECT_LIST_DOMAINS_OTHER
+	if running {
+		flags |= libvirt.CONNECT_LIST_DOMAINS_RUNNING
+	}
+	return flags
+}
+
+// Look up the domain's configuration, state, and settings
+// On success, the returned WakeableDomain takes over the domain, so freeing it frees the domain
+func DescribeDomain(domain Domain) (WakeableDomain, error) {
+	return (*ConfigCache)(nil).DescribeDomain(domain)
+}
+
+// Look up the domain's configuration, state, and settings, as DescribeDomain does, reusing its cached configuration
+// if its XML hasn't changed
+// On success, the returned WakeableDomain takes over the domain, so freeing it frees the domain
+func (c *ConfigCache) DescribeDomain(domain Domain) (WakeableDomain, error) {
+	// Now we get the XML Description for the domain
+	xmldesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return WakeableDomain{}, fmt.Errorf("failed retrieving XML: %w", err)
+	}
+
+	// Get the details for the domain
+	domcfg, err := c.parse(domain, xmldesc)
+	if err != nil {
+		return WakeableDomain{}, fmt.Errorf("failed retrieving domain configuration: %w", err)
+	}
+
+	state, _, err := domain.GetState()
+	if err != nil {
+		return WakeableDomain{}, fmt.Errorf("failed to check domain state: %w", err)
+	}
+
+	autostart, err := domain.GetAutostart()
+	if err != nil {
+		return WakeableDomain{}, fmt.Errorf("failed to check domain autostart: %w", err)
+	}
+
+	persistent, err := domain.IsPersistent()
+	if err != nil {
+		return WakeableDomain{}, fmt.Errorf("failed to check whether domain is persistent: %w", err)
+	}
+
+	return WakeableDomain{
+		Name:       domcfg.Name,
+		State:      StateName(state),
+		MACs:       DomainMACs(domcfg),
+		Autostart:  autostart,
+		Persistent: persistent,
+		state:      state,
+		config:     domcfg,
+		domain:     domain,
+	}, nil
+}
+
+// Parse the domain's XML, reusing the configuration parsed last time if the XML hasn't changed since
+func (c *ConfigCache) parse(domain Domain, xmldesc string) (*libvirtxml.Domain, error) {
+	if c == nil {
+		domcfg := &libvirtxml.Domain{}
+		return domcfg, domcfg.Unmarshal(xmldesc)
+	}
+
+	uuid, err := domain.GetUUIDString()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(xmldesc))
+
+	c.mu.Lock()
+	cached, ok := c.configs[uuid]
+	if ok && cached.hash == hash {
+		cached.used = time.Now()
+		c.configs[uuid] = cached
+		c.mu.Unlock()
+		return cached.config, nil
+	}
+	c.mu.Unlock()
+
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(xmldesc); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.configs[uuid] = cachedConfig{hash: hash, config: domcfg, used: time.Now()}
+	c.mu.Unlock()
+	return domcfg, nil
+}
+
+// Forget the cached configurations that haven't been used within the expiry, so the cache doesn't keep growing
+func (c *ConfigCache) expire(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for uuid, cached := range c.configs {
+		if now.Sub(cached.used) > configCacheExpiry {
+			delete(c.configs, uuid)
+		}
+	}
+}
+
+// Return the (normalized) MACs of each of the domain's interfaces
+func DomainMACs(domcfg *libvirtxml.Domain) []string {
+	return DomainMACsOfType(domcfg, nil)
+}
+
+// Return the (normalized) MACs of each of the domain's interfaces of the given types (<interface type='...'>),
+// or of every interface if types is empty
+func DomainMACsOfType(domcfg *libvirtxml.Domain, types map[string]bool) []string {
+	var macs []string
+	if domcfg.Devices == nil {
+		return macs
+	}
+	for _, iface := range domcfg.Devices.Interfaces {
+		if len(types) > 0 && !types[InterfaceType(iface)] {
+			continue
+		}
+		// Some kinds of interface, such as hostdev passthrough, may not have a MAC in the configuration
+		if iface.MAC == nil || iface.MAC.Address == "" {
+			slog.Debug("Skipping interface without a MAC", "event", "interface_no_mac", "domain", domcfg.Name)
+			continue
+		}
+		macs = append(macs, NormalizeMAC(iface.MAC.Address))
+	}
+	return macs
+}
+
+// Check whether any interface of the domain has the given (normalized) MAC
+func DomainHasMAC(domcfg *libvirtxml.Domain, mac string) bool {
+	return DomainHasMACOfType(domcfg, mac, nil)
+}
+
+// Whether the domain has an interface of the given types with the (normalized) MAC, or of any type if types is empty
+func DomainHasMACOfType(domcfg *libvirtxml.Domain, mac string, types map[string]bool) bool {
+	for _, domainmac := range DomainMACsOfType(domcfg, types) {
+		if domainmac == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// Interface types, as in <interface type='...'>, which libvirtxml records as the kind of source the interface has
+var InterfaceTypes = []string{"user", "ethernet", "vhostuser", "server", "client", "mcast", "network", "bridge",
+	"internal", "direct", "hostdev", "udp", "vdpa", "null", "vds"}
+
+// Return the type of the interface, as in <interface type='...'>, such as bridge or network, or empty if unknown
+func InterfaceType(iface libvirtxml.DomainInterface) string {
+	source := iface.Source
+	switch {
+	case source == nil:
+		return ""
+	case source.User != nil:
+		return "user"
+	case source.Ethernet != nil:
+		return "ethernet"
+	case source.VHostUser != nil:
+		return "vhostuser"
+	case source.Server != nil:
+		return "server"
+	case source.Client != nil:
+		return "client"
+	case source.MCast != nil:
+		return "mcast"
+	case source.Network != nil:
+		return "network"
+	case source.Bridge != nil:
+		return "bridge"
+	case source.Internal != nil:
+		return "internal"
+	case source.Direct != nil:
+		return "direct"
+	case source.Hostdev != nil:
+		return "hostdev"
+	case source.UDP != nil:
+		return "udp"
+	case source.VDPA != nil:
+		return "vdpa"
+	case source.Null != nil:
+		return "null"
+	case source.VDS != nil:
+		return "vds"
+	default:
+		return ""
+	}
+}
+
+// Check whether any of the domain's interfaces is on the target device
+func DomainHasTarget(domcfg *libvirtxml.Domain, target string) bool {
+	if domcfg.Devices == nil {
+		return false
+	}
+	for _, iface := range domcfg.Devices.Interfaces {
+		if iface.Target != nil && iface.Target.Dev == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a readable name for a domain state
+func StateName(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_NOSTATE:
+		return "nostate"
+	case libvirt.DOMAIN_RUNNING:
+		return "running"
+	case libvirt.DOMAIN_BLOCKED:
+		return "blocked"
+	case libvirt.DOMAIN_PAUSED:
+		return "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		return "shutdown"
+	case libvirt.DOMAIN_SHUTOFF:
+		return "shutoff"
+	case libvirt.DOMAIN_CRASHED:
+		return "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "pmsuspended"
+	default:
+		return fmt.Sprintf("unknown (%d)", state)
+	}
+}
+
+// Free each of the domains
+func freeDomains(domains []libvirt.Domain) {
+	for _, domain := range domains {
+		domain.Free()
+	}
+}
+
+// Free each of the wakeable domains
+func FreeWakeable(domains []WakeableDomain) {
+	for _, domain := range domains {
+		domain.Free()
+	}
+}
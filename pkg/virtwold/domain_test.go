@@ -0,0 +1,315 @@
+package virtwold
+
+import (
+	"fmt"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+	"testing"
+	"time"
+)
+
+func TestConfigCache(t *testing.T) {
+	fake := newFakeDomain(t, "vm", fakeUUID(1), "52:54:00:12:34:56")
+	cache := NewConfigCache()
+
+	first := fake.wakeableWith(t, cache)
+	second := fake.wakeableWith(t, cache)
+	if first.Config() != second.Config() {
+		t.Error("unchanged XML was parsed again rather than reused")
+	}
+
+	changed := newFakeDomain(t, "vm", fakeUUID(1), "52:54:00:ab:cd:ef")
+	fake.xml = changed.xml
+	third := fake.wakeableWith(t, cache)
+	if third.Config() == second.Config() {
+		t.Fatal("changed XML reused the stale configuration")
+	}
+	if !DomainHasMAC(third.Config(), "52:54:00:ab:cd:ef") {
+		t.Errorf("MACs = %v, want the changed MAC", third.MACs)
+	}
+
+	// Each cache is separate, so domains with the same UUID on different hosts don't share configurations
+	other := fake.wakeableWith(t, NewConfigCache())
+	if other.Config() == third.Config() {
+		t.Error("configuration shared between caches")
+	}
+
+	cache.expire(time.Now().Add(configCacheExpiry + time.Minute))
+	if len(cache.configs) != 0 {
+		t.Errorf("%d configurations left after expiry, want none", len(cache.configs))
+	}
+}
+
+// Describe the fake domain through the cache
+func (d *fakeDomain) wakeableWith(t testing.TB, cache *ConfigCache) WakeableDomain {
+	t.Helper()
+	domain, err := cache.DescribeDomain(d)
+	if err != nil {
+		t.Fatalf("failed to describe domain: %v", err)
+	}
+	return domain
+}
+
+// Look up the domain with a MAC among 500, describing every domain as listing them does, with and without
+// reusing their parsed configurations
+func BenchmarkWakeLookup(b *testing.B) {
+	var fakes []*fakeDomain
+	for i := 0; i < 500; i++ {
+		fake := newFakeDomain(b, fmt.Sprintf("vm%03d", i), fakeUUID(i), fmt.Sprintf("52:54:00:00:%02x:%02x", i/256, i%256))
+		fake.xml = realisticXML(b, fake)
+		fakes = append(fakes, fake)
+	}
+	mac := "52:54:00:00:01:f3"
+
+	for _, bm := range []struct {
+		name  string
+		cache *ConfigCache
+	}{
+		{"uncached", nil},
+		{"cached", NewConfigCache()},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				found := 0
+				for _, fake := range fakes {
+					domain, err := bm.cache.DescribeDomain(fake)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if DomainHasMAC(domain.Config(), mac) {
+						found++
+					}
+				}
+				bm.cache.expire(time.Now())
+				if found != 1 {
+					b.Fatalf("found %d domains with %s, want 1", found, mac)
+				}
+			}
+		})
+	}
+}
+
+// Return the fake domain's XML with the devices a typical VM has, so parsing it costs about as much as a real one
+func realisticXML(b testing.TB, fake *fakeDomain) string {
+	b.Helper()
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(fake.xml); err != nil {
+		b.Fatal(err)
+	}
+	domcfg.Memory = &libvirtxml.DomainMemory{Value: 4, Unit: "GiB"}
+	domcfg.VCPU = &libvirtxml.DomainVCPU{Value: 4}
+	domcfg.OS = &libvirtxml.DomainOS{Type: &libvirtxml.DomainOSType{Arch: "x86_64", Machine: "q35", Type: "hvm"}}
+	for i := 0; i < 4; i++ {
+		domcfg.Devices.Disks = append(domcfg.Devices.Disks, libvirtxml.DomainDisk{
+			Device: "disk",
+			Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+			Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: fmt.Sprintf("/var/lib/libvirt/images/%s-%d.qcow2", fake.name, i)}},
+			Target: &libvirtxml.DomainDiskTarget{Dev: fmt.Sprintf("vd%c", 'a'+i), Bus: "virtio"},
+		})
+	}
+	for i := 0; i < 6; i++ {
+		domcfg.Devices.Controllers = append(domcfg.Devices.Controllers, libvirtxml.DomainController{Type: "pci", Model: "pcie-root-port"})
+	}
+	domcfg.Devices.Serials = []libvirtxml.DomainSerial{{}}
+	domcfg.Devices.Graphics = []libvirtxml.DomainGraphic{{VNC: &libvirtxml.DomainGraphicVNC{Port: -1, AutoPort: "yes"}}}
+
+	xml, err := domcfg.Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return xml
+}
+
+func TestDomainHasTarget(t *testing.T) {
+	const xml = `<domain type='kvm'>
+  <name>vm</name>
+  <devices>
+    <interface type='bridge'>
+      <mac address='52:54:00:00:74:01'/>
+      <source bridge='br0'/>
+      <target dev='vnet3'/>
+    </interface>
+    <interface type='network'>
+      <mac address='52:54:00:00:74:02'/>
+      <source network='default'/>
+    </interface>
+  </devices>
+</domain>`
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(xml); err != nil {
+		t.Fatalf("failed to parse domain XML: %v", err)
+	}
+
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"vnet3", true},
+		{"vnet4", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := DomainHasTarget(domcfg, tt.target); got != tt.want {
+			t.Errorf("DomainHasTarget(%q) = %t, want %t", tt.target, got, tt.want)
+		}
+	}
+	if DomainHasTarget(&libvirtxml.Domain{}, "vnet3") {
+		t.Error("DomainHasTarget() = true for a domain without devices")
+	}
+}
+
+func TestDomainMACsWithoutMAC(t *testing.T) {
+	const xml = `<domain type='kvm'>
+  <name>passthrough</name>
+  <devices>
+    <interface type='hostdev' managed='yes'>
+      <source>
+        <address type='pci' domain='0x0000' bus='0x03' slot='0x00' function='0x1'/>
+      </source>
+    </interface>
+    <interface type='bridge'>
+      <mac address=''/>
+      <source bridge='br0'/>
+    </interface>
+    <interface type='bridge'>
+      <mac address='52:54:00:00:75:01'/>
+      <source bridge='br0'/>
+    </interface>
+  </devices>
+</domain>`
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(xml); err != nil {
+		t.Fatalf("failed to parse domain XML: %v", err)
+	}
+
+	macs := DomainMACs(domcfg)
+	if len(macs) != 1 || macs[0] != "52:54:00:00:75:01" {
+		t.Errorf("DomainMACs() = %v, want [52:54:00:00:75:01]", macs)
+	}
+	tests := []struct {
+		mac  string
+		want bool
+	}{
+		{"52:54:00:00:75:01", true},
+		{"", false},
+		{"52:54:00:00:75:02", false},
+	}
+	for _, tt := range tests {
+		if got := DomainHasMAC(domcfg, tt.mac); got != tt.want {
+			t.Errorf("DomainHasMAC(%q) = %t, want %t", tt.mac, got, tt.want)
+		}
+	}
+}
+
+func TestWakeableListFlags(t *testing.T) {
+	// Every flag is from the state group, so a domain in any of the states is listed
+	states := libvirt.CONNECT_LIST_DOMAINS_RUNNING | libvirt.CONNECT_LIST_DOMAINS_PAUSED |
+		libvirt.CONNECT_LIST_DOMAINS_SHUTOFF | libvirt.CONNECT_LIST_DOMAINS_OTHER
+
+	tests := []struct {
+		name    string
+		running bool
+		listed  []libvirt.ConnectListAllDomainsFlags
+		skipped []libvirt.ConnectListAllDomainsFlags
+	}{
+		{"wakeable", false,
+			[]libvirt.ConnectListAllDomainsFlags{libvirt.CONNECT_LIST_DOMAINS_SHUTOFF, libvirt.CONNECT_LIST_DOMAINS_PAUSED, libvirt.CONNECT_LIST_DOMAINS_OTHER},
+			[]libvirt.ConnectListAllDomainsFlags{libvirt.CONNECT_LIST_DOMAINS_RUNNING}},
+		{"with running", true,
+			[]libvirt.ConnectListAllDomainsFlags{libvirt.CONNECT_LIST_DOMAINS_SHUTOFF, libvirt.CONNECT_LIST_DOMAINS_PAUSED, libvirt.CONNECT_LIST_DOMAINS_OTHER, libvirt.CONNECT_LIST_DOMAINS_RUNNING},
+			nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := wakeableListFlags(tt.running)
+			if flags&^states != 0 {
+				t.Errorf("wakeableListFlags(%t) = %#x, which has flags outside the state group", tt.running, flags)
+			}
+			for _, flag := range tt.listed {
+				if flags&flag == 0 {
+					t.Errorf("wakeableListFlags(%t) = %#x, lacking %#x", tt.running, flags, flag)
+				}
+			}
+			for _, flag := range tt.skipped {
+				if flags&flag != 0 {
+					t.Errorf("wakeableListFlags(%t) = %#x, including %#x", tt.running, flags, flag)
+				}
+			}
+		})
+	}
+}
+
+func TestDomainMACsOfType(t *testing.T) {
+	const xml = `<domain type='kvm'>
+  <name>mixed</name>
+  <devices>
+    <interface type='bridge'>
+      <mac address='52:54:00:00:97:01'/>
+      <source bridge='br0'/>
+    </interface>
+    <interface type='network'>
+      <mac address='52:54:00:00:97:02'/>
+      <source network='default'/>
+    </interface>
+    <interface type='direct'>
+      <mac address='52:54:00:00:97:03'/>
+      <source dev='eth0' mode='bridge'/>
+    </interface>
+  </devices>
+</domain>`
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(xml); err != nil {
+		t.Fatalf("failed to parse domain XML: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		types map[string]bool
+		want  []string
+	}{
+		{"any type", nil, []string{"52:54:00:00:97:01", "52:54:00:00:97:02", "52:54:00:00:97:03"}},
+		{"bridge", map[string]bool{"bridge": true}, []string{"52:54:00:00:97:01"}},
+		{"direct", map[string]bool{"direct": true}, []string{"52:54:00:00:97:03"}},
+		{"bridge and network", map[string]bool{"bridge": true, "network": true}, []string{"52:54:00:00:97:01", "52:54:00:00:97:02"}},
+		{"type without interfaces", map[string]bool{"user": true}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DomainMACsOfType(domcfg, tt.types); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("DomainMACsOfType() = %v, want %v", got, tt.want)
+			}
+			for _, mac := range []string{"52:54:00:00:97:01", "52:54:00:00:97:02", "52:54:00:00:97:03"} {
+				want := false
+				for _, wanted := range tt.want {
+					want = want || wanted == mac
+				}
+				if got := DomainHasMACOfType(domcfg, mac, tt.types); got != want {
+					t.Errorf("DomainHasMACOfType(%s) = %t, want %t", mac, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInterfaceType(t *testing.T) {
+	tests := []struct {
+		name   string
+		source *libvirtxml.DomainInterfaceSource
+		want   string
+	}{
+		{"bridge", &libvirtxml.DomainInterfaceSource{Bridge: &libvirtxml.DomainInterfaceSourceBridge{Bridge: "br0"}}, "bridge"},
+		{"network", &libvirtxml.DomainInterfaceSource{Network: &libvirtxml.DomainInterfaceSourceNetwork{Network: "default"}}, "network"},
+		{"direct", &libvirtxml.DomainInterfaceSource{Direct: &libvirtxml.DomainInterfaceSourceDirect{Dev: "eth0"}}, "direct"},
+		{"no source", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := InterfaceType(libvirtxml.DomainInterface{Source: tt.source}); got != tt.want {
+				t.Errorf("InterfaceType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package virtwold_test
+
+import (
+	"fmt"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"libvirt.org/go/libvirt"
+	"log"
+	"net"
+)
+
+func ExampleParseMagicPacket() {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	payload, _ := virtwold.BuildMagicPacket(mac, nil)
+
+	wol, err := virtwold.ParseMagicPacket(payload)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(wol.MAC, wol.Variant)
+	// Output: 52:54:00:12:34:56 plain
+}
+
+func ExampleBuildMagicPacket() {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	packet, err := virtwold.BuildMagicPacket(mac, []byte("s3cr3t"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(len(packet), "bytes")
+	// Output: 108 bytes
+}
+
+func ExampleNormalizeMAC() {
+	fmt.Println(virtwold.NormalizeMAC("52-54-00-AB-CD-EF"))
+	// Output: 52:54:00:ab:cd:ef
+}
+
+func ExampleWakeMethod() {
+	fmt.Println(virtwold.WakeMethod(libvirt.DOMAIN_SHUTOFF), virtwold.WakeMethod(libvirt.DOMAIN_PAUSED))
+	// Output: Create Resume
+}
+
+// Wake the VM for a magic packet, as the virtwold daemon does when it captures one
+func ExampleWaker() {
+	connection, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+
+	woken, err := virtwold.NewWaker(connection).Wake(&virtwold.MagicPacket{MAC: "52:54:00:12:34:56"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Woke", woken)
+}
+
+// List the domains that could be woken, along with their MACs
+func ExampleListWakeableDomains() {
+	connection, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connection.Close()
+
+	domains, err := virtwold.ListWakeableDomains(connection, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer virtwold.FreeWakeable(domains)
+
+	for _, domain := range domains {
+		fmt.Println(domain.Name, domain.State, domain.MACs)
+	}
+}
@@ -0,0 +1,102 @@
+package virtwold
+
+import (
+	"fmt"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+	"testing"
+)
+
+// A domain standing in for a libvirt one, recording the calls made on it
+type fakeDomain struct {
+	name       string              // Name of the domain
+	xml        string              // Domain XML returned by GetXMLDesc
+	uuid       string              // UUID of the domain
+	state      libvirt.DomainState // State returned by GetState
+	autostart  bool                // Whether the domain starts when the host boots
+	persistent bool                // Whether the domain is defined, rather than transient
+	calls      []string            // Names of the wake calls made, in order
+}
+
+// Create a shut off, persistent fake domain with an interface for each of the MACs
+func newFakeDomain(t testing.TB, name string, uuid string, macs ...string) *fakeDomain {
+	t.Helper()
+	domcfg := &libvirtxml.Domain{Type: "kvm", Name: name, UUID: uuid, Devices: &libvirtxml.DomainDeviceList{}}
+	for _, mac := range macs {
+		domcfg.Devices.Interfaces = append(domcfg.Devices.Interfaces, libvirtxml.DomainInterface{
+			MAC:    &libvirtxml.DomainInterfaceMAC{Address: mac},
+			Source: &libvirtxml.DomainInterfaceSource{Bridge: &libvirtxml.DomainInterfaceSourceBridge{Bridge: "br0"}},
+		})
+	}
+	xml, err := domcfg.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal domain XML: %v", err)
+	}
+	return &fakeDomain{name: name, xml: xml, uuid: uuid, state: libvirt.DOMAIN_SHUTOFF, persistent: true}
+}
+
+// Describe the fake domain as a WakeableDomain
+func (d *fakeDomain) wakeable(t testing.TB) WakeableDomain {
+	t.Helper()
+	domain, err := DescribeDomain(d)
+	if err != nil {
+		t.Fatalf("failed to describe domain: %v", err)
+	}
+	return domain
+}
+
+func (d *fakeDomain) Create() error {
+	d.calls = append(d.calls, "Create")
+	d.state = libvirt.DOMAIN_RUNNING
+	return nil
+}
+
+func (d *fakeDomain) PMWakeup(flags uint32) error {
+	d.calls = append(d.calls, "PMWakeup")
+	d.state = libvirt.DOMAIN_RUNNING
+	return nil
+}
+
+func (d *fakeDomain) Resume() error {
+	d.calls = append(d.calls, "Resume")
+	d.state = libvirt.DOMAIN_RUNNING
+	return nil
+}
+
+func (d *fakeDomain) Reboot(flags libvirt.DomainRebootFlagValues) error {
+	d.calls = append(d.calls, "Reboot")
+	return nil
+}
+
+func (d *fakeDomain) GetState() (libvirt.DomainState, int, error) {
+	return d.state, 0, nil
+}
+
+func (d *fakeDomain) GetXMLDesc(flags libvirt.DomainXMLFlags) (string, error) {
+	return d.xml, nil
+}
+
+func (d *fakeDomain) GetUUIDString() (string, error) {
+	return d.uuid, nil
+}
+
+func (d *fakeDomain) GetAutostart() (bool, error) {
+	return d.autostart, nil
+}
+
+func (d *fakeDomain) IsPersistent() (bool, error) {
+	return d.persistent, nil
+}
+
+func (d *fakeDomain) Ref() error {
+	return nil
+}
+
+func (d *fakeDomain) Free() error {
+	return nil
+}
+
+// Return a UUID for the nth fake domain
+func fakeUUID(n int) string {
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", n)
+}
@@ -0,0 +1,246 @@
+// Package virtwold finds and wakes libvirt domains (VMs) for Wake-on-LAN magic packets
+//
+// It holds the parts of the virtwold daemon that are useful on their own: parsing and building magic packets,
+// listing the domains that could be woken, and waking them, so another Go program can embed them rather than
+// running the daemon
+package virtwold
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strings"
+)
+
+const (
+	EtherType    = layers.EthernetType(0x0842) // EtherType used by raw Ethernet WOL frames
+	SyncSize     = 6                           // Length of the 0xFF sync stream that starts a magic packet
+	MACCopies    = 16                          // Number of times the MAC is repeated in a magic packet
+	MinSize      = SyncSize + MACCopies*6      // 6 bytes of 0xFF sync stream followed by 16 copies of the MAC
+	PasswordSize = 6                           // Length of the optional SecureOn password following the MAC copies
+	NamePrefix   = "name:"                     // Marks the domain name extension following the magic packet
+	UUIDPrefix   = "uuid:"                     // Marks the domain UUID extension following the magic packet
+	UUIDSize     = 16                          // Length of the binary domain UUID in the UUID extension
+	MaxOffset    = 16                          // Most leading bytes some senders put before the sync stream
+)
+
+// The contents of a magic packet
+type MagicPacket struct {
+	MAC       string // MAC address of the system to wake
+	Password  []byte // SecureOn password, or nil if the packet doesn't carry one
+	Name      string // Name of the domain to wake, or empty if the packet doesn't carry one
+	UUID      string // UUID of the domain to wake, or empty if the packet doesn't carry one
+	Variant   string // Kind of magic packet: plain, secureon, named, or oversized
+	Interface string // Name of the interface the packet arrived on, or empty if unknown
+}
+
+// Return the MAC address (and SecureOn password, if any) seen in the WOL packet
+// UDP WOL packets carry the magic packet in the application layer, while raw Ethernet WOL frames
+// (EtherType 0x0842) carry it directly as the Ethernet payload, or as the 802.1Q payload if VLAN tagged
+// Failing those, the link layer payload is tried, so only a packet with no valid magic packet anywhere is an error
+func GrabMACAddr(packet gopacket.Packet) (*MagicPacket, error) {
+	var errs []error
+	for _, payload := range candidatePayloads(packet) {
+		wol, err := ParseMagicPacket(payload)
+		if err == nil {
+			return wol, nil
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no MAC found in packet")
+	}
+	// The first candidate is the most likely place for the magic packet, so its error is the most useful
+	return nil, errs[0]
+}
+
+// Return the parts of the packet that may hold a magic packet, most likely first
+func candidatePayloads(packet gopacket.Packet) [][]byte {
+	var payloads [][]byte
+	if app := packet.ApplicationLayer(); app != nil {
+		payloads = append(payloads, app.Payload())
+	}
+	if eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok && eth.EthernetType == EtherType {
+		payloads = append(payloads, eth.LayerPayload())
+	}
+	if dot1q, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok && dot1q.Type == EtherType {
+		payloads = append(payloads, dot1q.LayerPayload())
+	}
+	if link := packet.LinkLayer(); link != nil {
+		payloads = append(payloads, link.LayerPayload())
+	}
+	return payloads
+}
+
+// Validate a magic packet payload and return the MAC address (and SecureOn password, if any) it carries
+// The payload must start with the 6 byte 0xFF sync stream, followed by 16 identical copies of the MAC,
+// optionally followed by a 6 byte SecureOn password, then the domain UUID extension, and then the domain name extension
+// Some senders put a few extra bytes first, so the sync stream may start up to MaxOffset bytes in
+// Zero padding after the magic packet (or its SecureOn password) is ignored, as are extra bytes after a password
+func ParseMagicPacket(payload []byte) (*MagicPacket, error) {
+	if len(payload) < MinSize {
+		return nil, fmt.Errorf("packet too short for a WOL packet: %d bytes", len(payload))
+	}
+
+	start, err := findMagic(payload)
+	if err != nil {
+		return nil, err
+	}
+	payload = payload[start:]
+
+	wol := &MagicPacket{MAC: net.HardwareAddr(payload[SyncSize : SyncSize+6]).String()}
+	size := len(payload)
+	rest := payload[MinSize:]
+	// Some stacks pad datagrams with zeros, which are ignored unless there are just enough of them for a password
+	if len(rest) != PasswordSize && isPadding(rest) {
+		size -= len(rest)
+		rest = nil
+	}
+	// Anything after the MACs is a SecureOn password, so fewer than 6 bytes means the password is malformed
+	if len(rest) > 0 && len(rest) < PasswordSize && !hasExtension(rest) {
+		return nil, fmt.Errorf("malformed SecureOn password: %d bytes after the magic packet, expected %d", len(rest), PasswordSize)
+	}
+	if len(rest) >= PasswordSize && !hasExtension(rest) {
+		wol.Password = rest[:PasswordSize]
+		rest = rest[PasswordSize:]
+		if isPadding(rest) {
+			size -= len(rest)
+			rest = nil
+		}
+	}
+
+	if bytes.HasPrefix(rest, []byte(UUIDPrefix)) {
+		rest = rest[len(UUIDPrefix):]
+		if len(rest) < UUIDSize {
+			return nil, fmt.Errorf("truncated domain UUID in UUID extension: %d bytes, expected %d", len(rest), UUIDSize)
+		}
+		wol.UUID = formatUUID(rest[:UUIDSize])
+		rest = rest[UUIDSize:]
+	}
+
+	if bytes.HasPrefix(rest, []byte(NamePrefix)) {
+		name, err := parseName(rest[len(NamePrefix):])
+		if err != nil {
+			return nil, err
+		}
+		wol.Name = name
+	}
+	wol.Variant = classifyPacket(size, wol)
+
+	return wol, nil
+}
+
+// Return the offset of the first sync stream in the payload followed by 16 copies of a MAC
+// Since the sync stream is 0xFF bytes, leading 0xFF bytes (such as a broadcast MAC) can only be skipped
+// by checking the MAC copies at each offset; when none match, the error is the one for offset 0
+func findMagic(payload []byte) (int, error) {
+	var first error
+	for start := 0; start <= MaxOffset && start+MinSize <= len(payload); start++ {
+		err := checkMagic(payload[start:])
+		if err == nil {
+			return start, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return 0, first
+}
+
+// Check that the payload starts with the sync stream and 16 identical copies of a MAC
+func checkMagic(payload []byte) error {
+	for i := 0; i < SyncSize; i++ {
+		if payload[i] != 0xff {
+			return errors.New("missing 0xFF sync stream")
+		}
+	}
+
+	mac := payload[SyncSize : SyncSize+6]
+	for rep := 1; rep < MACCopies; rep++ {
+		offset := SyncSize + rep*6
+		if !bytes.Equal(payload[offset:offset+6], mac) {
+			return fmt.Errorf("inconsistent MAC repetitions at copy %d", rep+1)
+		}
+	}
+	return nil
+}
+
+// Whether the bytes following a magic packet are only zero padding
+func isPadding(rest []byte) bool {
+	return len(rest) > 0 && len(bytes.Trim(rest, "\x00")) == 0
+}
+
+// Whether the bytes following a magic packet start with an extension rather than a SecureOn password
+// Exactly 6 bytes are always a password, since an ASCII password may itself start with an extension prefix
+func hasExtension(rest []byte) bool {
+	return len(rest) != PasswordSize && (bytes.HasPrefix(rest, []byte(NamePrefix)) || bytes.HasPrefix(rest, []byte(UUIDPrefix)))
+}
+
+// Format a binary UUID in the usual hyphenated form, as libvirt reports domain UUIDs
+func formatUUID(uuid []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// Classify a magic packet of the given payload size, to help diagnose senders that don't wake anything
+// Returns plain for a bare 102 byte magic packet, secureon for one followed by just a SecureOn password,
+// uuid for one carrying the domain UUID extension, named for one carrying the domain name extension,
+// or oversized for one followed by anything else
+func classifyPacket(size int, wol *MagicPacket) string {
+	switch {
+	case wol.UUID != "":
+		return "uuid"
+	case wol.Name != "":
+		return "named"
+	case size == MinSize:
+		return "plain"
+	case size == MinSize+PasswordSize && wol.Password != nil:
+		return "secureon"
+	default:
+		return "oversized"
+	}
+}
+
+// Parse the domain name from the name extension of a magic packet
+// Senders may pad the packet with NULs, so those are dropped from the end
+func parseName(field []byte) (string, error) {
+	name := string(bytes.TrimRight(field, "\x00"))
+	if name == "" {
+		return "", errors.New("empty domain name in name extension")
+	}
+	for _, c := range name {
+		if c < 0x20 || c > 0x7e {
+			return "", fmt.Errorf("non-printable character in domain name %q", name)
+		}
+	}
+	return name, nil
+}
+
+// Build a magic packet waking the given MAC, with an optional 6 byte SecureOn password
+func BuildMagicPacket(mac net.HardwareAddr, password []byte) ([]byte, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC for a WOL packet: %s", mac)
+	}
+	if len(password) != 0 && len(password) != PasswordSize {
+		return nil, fmt.Errorf("invalid SecureOn password length: %d bytes", len(password))
+	}
+
+	packet := bytes.Repeat([]byte{0xff}, SyncSize)
+	packet = append(packet, bytes.Repeat(mac, MACCopies)...)
+	packet = append(packet, password...)
+
+	return packet, nil
+}
+
+// Normalize a MAC address to lowercase and colon-separated, so MACs written in different styles compare equal
+// Accepts any format understood by net.ParseMAC, such as 52-54-00-AB-CD-EF or 5254.00ab.cdef
+func NormalizeMAC(mac string) string {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return strings.ToLower(strings.ReplaceAll(mac, "-", ":"))
+	}
+	return hwaddr.String()
+}
@@ -0,0 +1,560 @@
+package virtwold
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Return a magic packet for the MAC, followed by extra
+func magicPayload(t testing.TB, mac string, extra ...byte) []byte {
+	t.Helper()
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{0xff}, 6)
+	payload = append(payload, bytes.Repeat(hwaddr, 16)...)
+	return append(payload, extra...)
+}
+
+// Serialize the layers into a packet decoded from Ethernet, as captured
+func serializePacket(t testing.TB, layerList ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, layerList...); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// Return a raw Ethernet WOL frame (EtherType 0x0842) carrying the payload
+func rawFrame(t testing.TB, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: EtherType,
+	}
+	return serializePacket(t, eth, gopacket.Payload(payload))
+}
+
+// Return a broadcast IPv4 UDP packet to port 9 carrying the payload
+func udpPacket(t testing.TB, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 168, 1, 2), DstIP: net.IPv4bcast}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	return serializePacket(t, eth, ip, udp, gopacket.Payload(payload))
+}
+
+func TestGrabMACAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet func(testing.TB, []byte) gopacket.Packet
+	}{
+		{"UDP", udpPacket},
+		{"raw Ethernet", rawFrame},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wol, err := GrabMACAddr(tt.packet(t, magicPayload(t, "52:54:00:12:34:56")))
+			if err != nil {
+				t.Fatalf("GrabMACAddr() error = %v", err)
+			}
+			if wol.MAC != "52:54:00:12:34:56" {
+				t.Errorf("MAC = %s, want 52:54:00:12:34:56", wol.MAC)
+			}
+		})
+	}
+}
+
+func TestGrabMACAddrRawEthernetHeaders(t *testing.T) {
+	packet := rawFrame(t, magicPayload(t, "52:54:00:12:34:56"))
+	if packet.Layer(layers.LayerTypeIPv4) != nil || packet.Layer(layers.LayerTypeUDP) != nil {
+		t.Fatal("raw frame has IP or UDP headers")
+	}
+	if eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); eth.EthernetType != EtherType {
+		t.Fatalf("EtherType = %#04x, want %#04x", uint16(eth.EthernetType), uint16(EtherType))
+	}
+	if _, err := GrabMACAddr(packet); err != nil {
+		t.Errorf("GrabMACAddr() error = %v", err)
+	}
+}
+
+func TestGrabMACAddrRawEthernetInvalid(t *testing.T) {
+	if _, err := GrabMACAddr(rawFrame(t, make([]byte, MinSize-1))); err == nil {
+		t.Error("GrabMACAddr() accepted a frame too short for a magic packet")
+	}
+}
+
+func TestParseMagicPacketRepetitions(t *testing.T) {
+	valid := magicPayload(t, "52:54:00:12:34:56")
+	corrupt := magicPayload(t, "52:54:00:12:34:56")
+	corrupt[SyncSize+8*6+5] ^= 0xff // Last byte of the 9th copy
+	nosync := magicPayload(t, "52:54:00:12:34:56")
+	nosync[2] = 0
+
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr string
+	}{
+		{"valid", valid, ""},
+		{"repetition 9 differs", corrupt, "inconsistent MAC repetitions at copy 9"},
+		{"missing sync stream", nosync, "missing 0xFF sync stream"},
+		{"truncated", valid[:60], "packet too short for a WOL packet: 60 bytes"},
+		{"truncated by one byte", valid[:MinSize-1], "packet too short"},
+		{"empty", nil, "packet too short"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wol, err := ParseMagicPacket(tt.payload)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseMagicPacket() error = %v", err)
+				}
+				if wol.MAC != "52:54:00:12:34:56" {
+					t.Errorf("MAC = %s, want 52:54:00:12:34:56", wol.MAC)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseMagicPacket() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseMagicPacketPassword(t *testing.T) {
+	tests := []struct {
+		name         string
+		payload      []byte
+		wantPassword []byte
+	}{
+		{"with password", magicPayload(t, "52:54:00:12:34:56", 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff), []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}},
+		{"ASCII password", magicPayload(t, "52:54:00:12:34:56", []byte("s3cr3t")...), []byte("s3cr3t")},
+		{"without password", magicPayload(t, "52:54:00:12:34:56"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wol, err := ParseMagicPacket(tt.payload)
+			if err != nil {
+				t.Fatalf("ParseMagicPacket() error = %v", err)
+			}
+			if !bytes.Equal(wol.Password, tt.wantPassword) || (wol.Password == nil) != (tt.wantPassword == nil) {
+				t.Errorf("Password = %x, want %x", wol.Password, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	tests := []struct {
+		name string
+		mac  string
+		want string
+	}{
+		{"normalized", "52:54:00:ab:cd:ef", "52:54:00:ab:cd:ef"},
+		{"uppercase", "52:54:00:AB:CD:EF", "52:54:00:ab:cd:ef"},
+		{"dashes", "52-54-00-AB-CD-EF", "52:54:00:ab:cd:ef"},
+		{"dotted", "5254.00ab.cdef", "52:54:00:ab:cd:ef"},
+		{"invalid", "NOT-A-MAC", "not:a:mac"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeMAC(tt.mac); got != tt.want {
+				t.Errorf("NormalizeMAC(%q) = %q, want %q", tt.mac, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildMagicPacketRoundTrip(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0xab, 0xcd, 0xef}
+	tests := []struct {
+		name     string
+		password []byte
+		wantLen  int
+	}{
+		{"plain", nil, 102},
+		{"SecureOn", []byte{1, 2, 3, 4, 5, 6}, 108},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := BuildMagicPacket(mac, tt.password)
+			if err != nil {
+				t.Fatalf("BuildMagicPacket() error = %v", err)
+			}
+			if len(payload) != tt.wantLen {
+				t.Errorf("len(BuildMagicPacket()) = %d, want %d", len(payload), tt.wantLen)
+			}
+
+			wol, err := GrabMACAddr(udpPacket(t, payload))
+			if err != nil {
+				t.Fatalf("GrabMACAddr() error = %v", err)
+			}
+			if wol.MAC != mac.String() || !bytes.Equal(wol.Password, tt.password) {
+				t.Errorf("GrabMACAddr() = %s with password %x, want %s with %x", wol.MAC, wol.Password, mac, tt.password)
+			}
+		})
+	}
+}
+
+func TestBuildMagicPacketInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		mac      net.HardwareAddr
+		password []byte
+	}{
+		{"EUI-64 MAC", net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8}, nil},
+		{"short password", net.HardwareAddr{1, 2, 3, 4, 5, 6}, []byte{1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := BuildMagicPacket(tt.mac, tt.password); err == nil {
+				t.Error("BuildMagicPacket() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// Return a broadcast IPv4 UDP packet to port 9 carrying the payload, tagged with the 802.1Q VLAN ID
+func vlanUDPPacket(t testing.TB, vlanID uint16, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	tag := &layers.Dot1Q{VLANIdentifier: vlanID, Type: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 168, 1, 2), DstIP: net.IPv4bcast}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	return serializePacket(t, eth, tag, ip, udp, gopacket.Payload(payload))
+}
+
+// Return a raw Ethernet WOL frame carrying the payload, tagged with the 802.1Q VLAN ID
+func vlanRawFrame(t testing.TB, vlanID uint16, payload []byte) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	tag := &layers.Dot1Q{VLANIdentifier: vlanID, Type: EtherType}
+	return serializePacket(t, eth, tag, gopacket.Payload(payload))
+}
+
+func TestGrabMACAddrVLAN(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet func(testing.TB, uint16, []byte) gopacket.Packet
+	}{
+		{"UDP", vlanUDPPacket},
+		{"raw Ethernet", vlanRawFrame},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wol, err := GrabMACAddr(tt.packet(t, 42, magicPayload(t, "52:54:00:00:29:01")))
+			if err != nil {
+				t.Fatalf("GrabMACAddr() error = %v", err)
+			}
+			if wol.MAC != "52:54:00:00:29:01" {
+				t.Errorf("MAC = %s, want 52:54:00:00:29:01", wol.MAC)
+			}
+		})
+	}
+}
+
+func TestParseMagicPacketName(t *testing.T) {
+	password := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	tests := []struct {
+		name         string
+		extra        []byte
+		wantName     string
+		wantPassword []byte
+		wantErr      bool
+	}{
+		{"without name", nil, "", nil, false},
+		{"with name", []byte("name:web01"), "web01", nil, false},
+		{"NUL padded", []byte("name:web01\x00\x00\x00"), "web01", nil, false},
+		{"after password", append(append([]byte(nil), password...), "name:web01"...), "web01", password, false},
+		{"ASCII password like a name", []byte("name:x"), "", []byte("name:x"), false},
+		{"ASCII password like a UUID", []byte("uuid:x"), "", []byte("uuid:x"), false},
+		{"empty name", []byte("name:\x00\x00"), "", nil, true},
+		{"non-printable name", []byte("name:web\x0101"), "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wol, err := ParseMagicPacket(magicPayload(t, "52:54:00:00:30:01", tt.extra...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMagicPacket() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if wol.Name != tt.wantName || !bytes.Equal(wol.Password, tt.wantPassword) {
+				t.Errorf("ParseMagicPacket() = name %q and password %x, want %q and %x", wol.Name, wol.Password, tt.wantName, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestParseMagicPacketVariant(t *testing.T) {
+	password := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	withPassword := func(extra ...byte) []byte {
+		return append(append([]byte(nil), password...), extra...)
+	}
+	tests := []struct {
+		name  string
+		extra []byte
+		size  int
+		want  string
+	}{
+		{"plain", nil, 102, "plain"},
+		{"SecureOn", password, 108, "secureon"},
+		{"trailing data", withPassword(bytes.Repeat([]byte{0x42}, 14)...), 122, "oversized"},
+		{"named", []byte("name:web01"), 112, "named"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := magicPayload(t, "52:54:00:00:36:01", tt.extra...)
+			if len(payload) != tt.size {
+				t.Fatalf("payload is %d bytes, want %d", len(payload), tt.size)
+			}
+			wol, err := ParseMagicPacket(payload)
+			if err != nil {
+				t.Fatalf("ParseMagicPacket() error = %v", err)
+			}
+			if wol.Variant != tt.want {
+				t.Errorf("Variant of a %d byte packet = %s, want %s", tt.size, wol.Variant, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrabMACAddrPayloadSources(t *testing.T) {
+	// An EtherType gopacket doesn't decode, so there's no application layer and the magic packet is only in the link layer payload
+	experimental := func(t testing.TB, payload []byte) gopacket.Packet {
+		t.Helper()
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			EthernetType: layers.EthernetType(0x88b5),
+		}
+		return serializePacket(t, eth, gopacket.Payload(payload))
+	}
+	junk := bytes.Repeat([]byte{0xaa}, MinSize)
+
+	tests := []struct {
+		name    string
+		packet  func(testing.TB, []byte) gopacket.Packet
+		payload []byte
+		wantErr bool
+	}{
+		{"UDP", udpPacket, magicPayload(t, "52:54:00:00:57:01"), false},
+		{"raw Ethernet", rawFrame, magicPayload(t, "52:54:00:00:57:01"), false},
+		{"other EtherType", experimental, magicPayload(t, "52:54:00:00:57:01"), false},
+		{"UDP without a magic packet", udpPacket, junk, true},
+		{"raw Ethernet without a magic packet", rawFrame, junk, true},
+		{"other EtherType without a magic packet", experimental, junk, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := tt.packet(t, tt.payload)
+			wol, err := GrabMACAddr(packet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("GrabMACAddr() = %s, want an error", wol.MAC)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GrabMACAddr() error = %v (application layer %v)", err, packet.ApplicationLayer() != nil)
+			}
+			if wol.MAC != "52:54:00:00:57:01" {
+				t.Errorf("MAC = %s, want 52:54:00:00:57:01", wol.MAC)
+			}
+		})
+	}
+}
+
+func TestParseMagicPacketPasswordLength(t *testing.T) {
+	tests := []struct {
+		name         string
+		payload      []byte
+		wantPassword []byte
+		wantErr      string
+	}{
+		{"105 bytes", magicPayload(t, "52:54:00:00:79:01", 0xaa, 0xbb, 0xcc), nil, "malformed SecureOn password: 3 bytes after the magic packet, expected 6"},
+		{"107 bytes", magicPayload(t, "52:54:00:00:79:01", 1, 2, 3, 4, 5), nil, "malformed SecureOn password: 5 bytes after the magic packet, expected 6"},
+		{"108 bytes", magicPayload(t, "52:54:00:00:79:01", 1, 2, 3, 4, 5, 6), []byte{1, 2, 3, 4, 5, 6}, ""},
+		{"105 bytes of padding", magicPayload(t, "52:54:00:00:79:01", 0, 0, 0), nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wol, err := ParseMagicPacket(tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("ParseMagicPacket() error = %v, want %q", err, tt.wantErr)
+				}
+				// Carried over UDP, the malformed packet is rejected rather than woken without its password
+				if _, err := GrabMACAddr(udpPacket(t, tt.payload)); err == nil {
+					t.Error("GrabMACAddr() accepted the malformed packet")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMagicPacket() error = %v", err)
+			}
+			if !bytes.Equal(wol.Password, tt.wantPassword) || (wol.Password == nil) != (tt.wantPassword == nil) {
+				t.Errorf("Password = %x, want %x", wol.Password, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestParseMagicPacketOffset(t *testing.T) {
+	broadcast := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	tests := []struct {
+		name    string
+		prefix  []byte
+		wantErr bool
+	}{
+		{"at offset 0", nil, false},
+		{"at offset 1", []byte{0}, false},
+		{"after a broadcast MAC", broadcast, false},
+		{"after a few bytes", []byte{0xde, 0xad, 0xbe, 0xef}, false},
+		{"at the largest offset", bytes.Repeat([]byte{0x01}, MaxOffset), false},
+		{"past the largest offset", bytes.Repeat([]byte{0x01}, MaxOffset+1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := append(append([]byte(nil), tt.prefix...), magicPayload(t, "52:54:00:00:83:01", 1, 2, 3, 4, 5, 6)...)
+			for _, packet := range []gopacket.Packet{udpPacket(t, payload), rawFrame(t, payload)} {
+				wol, err := GrabMACAddr(packet)
+				if tt.wantErr {
+					if err == nil {
+						t.Errorf("GrabMACAddr() = %s, want an error", wol.MAC)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("GrabMACAddr() error = %v", err)
+				}
+				if wol.MAC != "52:54:00:00:83:01" || !bytes.Equal(wol.Password, []byte{1, 2, 3, 4, 5, 6}) {
+					t.Errorf("GrabMACAddr() = %s with password %x, want 52:54:00:00:83:01 with 010203040506", wol.MAC, wol.Password)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMagicPacketUUID(t *testing.T) {
+	uuid := []byte{0x4d, 0xea, 0x22, 0xb3, 0x1d, 0x52, 0xd8, 0xf3, 0x26, 0x16, 0x78, 0x2d, 0x0b, 0x6c, 0x4a, 0x36}
+	extension := append([]byte(UUIDPrefix), uuid...)
+	password := []byte{1, 2, 3, 4, 5, 6}
+
+	tests := []struct {
+		name         string
+		payload      []byte
+		wantUUID     string
+		wantPassword []byte
+		wantName     string
+		wantErr      string
+	}{
+		{"without UUID", magicPayload(t, "52:54:00:00:87:01"), "", nil, "", ""},
+		{"with UUID", magicPayload(t, "52:54:00:00:87:01", extension...), "4dea22b3-1d52-d8f3-2616-782d0b6c4a36", nil, "", ""},
+		{"with password and UUID", magicPayload(t, "52:54:00:00:87:01", append(password, extension...)...), "4dea22b3-1d52-d8f3-2616-782d0b6c4a36", password, "", ""},
+		{"with UUID and name", magicPayload(t, "52:54:00:00:87:01", append(extension, []byte(NamePrefix+"vm")...)...), "4dea22b3-1d52-d8f3-2616-782d0b6c4a36", nil, "vm", ""},
+		{"truncated UUID", magicPayload(t, "52:54:00:00:87:01", extension[:len(extension)-4]...), "", nil, "", "truncated domain UUID in UUID extension: 12 bytes, expected 16"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wol, err := ParseMagicPacket(tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("ParseMagicPacket() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMagicPacket() error = %v", err)
+			}
+			if wol.MAC != "52:54:00:00:87:01" || wol.UUID != tt.wantUUID || wol.Name != tt.wantName || !bytes.Equal(wol.Password, tt.wantPassword) {
+				t.Errorf("ParseMagicPacket() = %s, UUID %q, name %q, password %x, want 52:54:00:00:87:01, %q, %q, %x",
+					wol.MAC, wol.UUID, wol.Name, wol.Password, tt.wantUUID, tt.wantName, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestParseMagicPacketTrailingPadding(t *testing.T) {
+	password := []byte{1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		name     string
+		password []byte
+		padding  int
+	}{
+		{"no padding", nil, 0},
+		{"4 bytes of padding", nil, 4},
+		{"18 bytes of padding", nil, 18},
+		{"password with no padding", password, 0},
+		{"password with 4 bytes of padding", password, 4},
+		{"password with 18 bytes of padding", password, 18},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := magicPayload(t, "52:54:00:00:94:01", tt.password...)
+			payload = append(payload, make([]byte, tt.padding)...)
+
+			wol, err := ParseMagicPacket(payload)
+			if err != nil {
+				t.Fatalf("ParseMagicPacket() error = %v", err)
+			}
+			if wol.MAC != "52:54:00:00:94:01" {
+				t.Errorf("MAC = %s, want 52:54:00:00:94:01", wol.MAC)
+			}
+			if !bytes.Equal(wol.Password, tt.password) || (wol.Password == nil) != (tt.password == nil) {
+				t.Errorf("Password = %x, want %x", wol.Password, tt.password)
+			}
+
+			// Padded the same way over UDP, the packet is still accepted
+			grabbed, err := GrabMACAddr(udpPacket(t, payload))
+			if err != nil {
+				t.Fatalf("GrabMACAddr() error = %v", err)
+			}
+			if grabbed.MAC != wol.MAC || !bytes.Equal(grabbed.Password, wol.Password) {
+				t.Errorf("GrabMACAddr() = %s/%x, want %s/%x", grabbed.MAC, grabbed.Password, wol.MAC, wol.Password)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package virtwold
+
+import (
+	"errors"
+	"fmt"
+	"libvirt.org/go/libvirt"
+)
+
+// Wakes the domains on a libvirt connection for magic packets
+// This is the core of the virtwold daemon, without its extras such as SecureOn passwords, cooldowns, and queueing
+type Waker struct {
+	Connection *libvirt.Connect // Connection to the libvirt daemon to find and wake the domains on
+	WakeAll    bool             // Wake every domain with the MAC, rather than just the first
+
+	configs *ConfigCache // Parsed domain configurations, reused across wakes, or nil to parse them every time
+}
+
+// Create a Waker finding and waking domains over the connection
+func NewWaker(connection *libvirt.Connect) *Waker {
+	return &Waker{Connection: connection, configs: NewConfigCache()}
+}
+
+// Wake the first domain that could be woken with an interface with the MAC from the magic packet (or every such
+// domain, with WakeAll), returning the names of those woken
+// If the packet carries the UUID of a domain that could be woken, only that domain is woken instead
+func (w *Waker) Wake(wol *MagicPacket) ([]string, error) {
+	domains, err := w.configs.ListWakeableDomains(w.Connection, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve domains: %w", err)
+	}
+	defer FreeWakeable(domains)
+
+	return w.wakeMatching(domains, wol)
+}
+
+// Wake the domains matching the magic packet out of those given, returning the names of those woken
+func (w *Waker) wakeMatching(domains []WakeableDomain, wol *MagicPacket) ([]string, error) {
+	mac := NormalizeMAC(wol.MAC)
+	matches := func(domain WakeableDomain) bool {
+		return DomainHasMAC(domain.config, mac)
+	}
+	for _, domain := range domains {
+		if wol.UUID != "" && domain.config.UUID == wol.UUID {
+			matches = func(domain WakeableDomain) bool {
+				return domain.config.UUID == wol.UUID
+			}
+		}
+	}
+
+	var matched []WakeableDomain
+	for _, domain := range domains {
+		if matches(domain) {
+			matched = append(matched, domain)
+		}
+	}
+	// As with a physical machine, a MAC should only belong to a single domain, so only the first is woken by default
+	if len(matched) > 1 && !w.WakeAll {
+		matched = matched[:1]
+	}
+
+	var woken []string
+	var errs []error
+	for _, domain := range matched {
+		if _, err := WakeDomain(domain); err != nil {
+			errs = append(errs, fmt.Errorf("failed to wake %s: %w", domain.Name, err))
+			continue
+		}
+		woken = append(woken, domain.Name)
+	}
+
+	return woken, errors.Join(errs...)
+}
+
+// Wake the domain with the libvirt call appropriate to its state, as chosen by WakeMethod
+// Returns the name of the call, or an error if the domain is in a state it can't be woken from, such as running
+func WakeDomain(domain WakeableDomain) (string, error) {
+	method := WakeMethod(domain.state)
+	if method == "" {
+		return "", fmt.Errorf("domain %s is %s, which can't be woken from", domain.Name, StateName(domain.state))
+	}
+	return method, CallWakeMethod(domain.domain, method)
+}
+
+// Return the name of the libvirt call that wakes a domain in the given state: Create if it's shut off, crashed,
+// or its state is unknown, PMWakeup if it's suspended, or Resume if it's paused
+// Returns empty for a state that can't be woken from, such as running
+func WakeMethod(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_SHUTDOWN, libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_CRASHED, libvirt.DOMAIN_NOSTATE:
+		return "Create"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "PMWakeup"
+	case libvirt.DOMAIN_PAUSED:
+		return "Resume"
+	default:
+		return ""
+	}
+}
+
+// Make the named libvirt call on the domain: Create, PMWakeup, Resume, or Reboot
+func CallWakeMethod(domain Domain, method string) error {
+	switch method {
+	case "Create":
+		return domain.Create()
+	case "PMWakeup":
+		return domain.PMWakeup(0)
+	case "Resume":
+		return domain.Resume()
+	case "Reboot":
+		return domain.Reboot(0)
+	default:
+		return fmt.Errorf("unknown wake method %q", method)
+	}
+}
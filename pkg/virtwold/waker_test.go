@@ -0,0 +1,88 @@
+package virtwold
+
+import (
+	"libvirt.org/go/libvirt"
+	"slices"
+	"testing"
+)
+
+func TestWakeMatching(t *testing.T) {
+	tests := []struct {
+		name    string
+		wakeAll bool
+		wol     *MagicPacket
+		want    []string
+	}{
+		{"first match only", false, &MagicPacket{MAC: "52:54:00:12:34:56"}, []string{"first"}},
+		{"every match", true, &MagicPacket{MAC: "52:54:00:12:34:56"}, []string{"first", "second"}},
+		{"MAC written differently", false, &MagicPacket{MAC: "52-54-00-AB-CD-EF"}, []string{"other"}},
+		{"no match", false, &MagicPacket{MAC: "52:54:00:00:00:00"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := []*fakeDomain{
+				newFakeDomain(t, "first", fakeUUID(1), "52:54:00:12:34:56"),
+				newFakeDomain(t, "second", fakeUUID(2), "52:54:00:12:34:56"),
+				newFakeDomain(t, "other", fakeUUID(3), "52:54:00:ab:cd:ef"),
+			}
+			var domains []WakeableDomain
+			for _, fake := range fakes {
+				domains = append(domains, fake.wakeable(t))
+			}
+
+			woken, err := (&Waker{WakeAll: tt.wakeAll}).wakeMatching(domains, tt.wol)
+			if err != nil {
+				t.Fatalf("wakeMatching() error = %v", err)
+			}
+			if !slices.Equal(woken, tt.want) {
+				t.Errorf("wakeMatching() woke %v, want %v", woken, tt.want)
+			}
+			for _, fake := range fakes {
+				created := slices.Contains(fake.calls, "Create")
+				if want := slices.Contains(tt.want, fake.name); created != want {
+					t.Errorf("Create() called on %s = %v, want %v", fake.name, created, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWakeDomain(t *testing.T) {
+	tests := []struct {
+		state   libvirt.DomainState
+		want    string
+		wantErr bool
+	}{
+		{libvirt.DOMAIN_SHUTOFF, "Create", false},
+		{libvirt.DOMAIN_SHUTDOWN, "Create", false},
+		{libvirt.DOMAIN_CRASHED, "Create", false},
+		{libvirt.DOMAIN_NOSTATE, "Create", false},
+		{libvirt.DOMAIN_PMSUSPENDED, "PMWakeup", false},
+		{libvirt.DOMAIN_PAUSED, "Resume", false},
+		{libvirt.DOMAIN_RUNNING, "", true},
+		{libvirt.DOMAIN_BLOCKED, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(StateName(tt.state), func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", fakeUUID(1), "52:54:00:12:34:56")
+			fake.state = tt.state
+
+			method, err := WakeDomain(fake.wakeable(t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WakeDomain() error = %v, want error %v", err, tt.wantErr)
+			}
+			if method != tt.want {
+				t.Errorf("WakeDomain() method = %q, want %q", method, tt.want)
+			}
+			var wantCalls []string
+			if tt.want != "" {
+				wantCalls = []string{tt.want}
+			}
+			if !slices.Equal(fake.calls, wantCalls) {
+				t.Errorf("calls = %v, want %v", fake.calls, wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Return the transport a libvirt URI connects with, such as tls or ssh, or empty for a local connection
+// A URI naming a host with no explicit transport, such as qemu://host/system, uses TLS
+func uriTransport(uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid libvirt URI %q: %w", uri, err)
+	}
+
+	if _, transport, ok := strings.Cut(parsed.Scheme, "+"); ok {
+		return transport, nil
+	}
+	if parsed.Host != "" {
+		return "tls", nil
+	}
+	return "", nil
+}
+
+// Add a parameter to the query of a libvirt URI, replacing any existing value
+func addURIParam(uri string, name string, value string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid libvirt URI %q: %w", uri, err)
+	}
+
+	query := parsed.Query()
+	query.Set(name, value)
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// Add a parameter to each of the libvirt URIs using the transport, warning if none of them do
+func withURIParam(uris []string, transport string, name string, value string) ([]string, error) {
+	var result []string
+	used := false
+	for _, uri := range uris {
+		actual, err := uriTransport(uri)
+		if err != nil {
+			return nil, err
+		}
+		if actual == transport {
+			uri, err = addURIParam(uri, name, value)
+			if err != nil {
+				return nil, err
+			}
+			used = true
+		}
+		result = append(result, uri)
+	}
+
+	if !used {
+		slog.Warn("No libvirt URI uses the transport, so the parameter is unused", "event", "param_unused", "transport", transport, "param", name)
+	}
+	return result, nil
+}
+
+// Gather the TLS client certificate, key, and CA certificate into a new directory with the file names libvirt expects,
+// since libvirt URIs can only point at a directory of them with the pkipath parameter
+// The caller should remove the directory once done with it
+func tlsPKIPath(cert string, key string, cacert string) (string, error) {
+	if cert == "" || key == "" || cacert == "" {
+		return "", errors.New("-tls-cert, -tls-key, and -tls-cacert must all be given together")
+	}
+
+	files := map[string]string{
+		"clientcert.pem": cert,
+		"clientkey.pem":  key,
+		"cacert.pem":     cacert,
+	}
+	for _, path := range files {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("unable to use TLS file: %w", err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "virtwold-pki-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create TLS directory: %w", err)
+	}
+	for name, path := range files {
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			err = os.Symlink(abs, filepath.Join(dir, name))
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to link TLS file %s: %w", path, err)
+		}
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestURITransport(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"qemu:///system", ""},
+		{"qemu+tcp:///system", "tcp"},
+		{"qemu+tls://host/system", "tls"},
+		{"qemu://host/system", "tls"},
+		{"qemu+ssh://user@host/system", "ssh"},
+		{"lxc:///", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			got, err := uriTransport(tt.uri)
+			if err != nil || got != tt.want {
+				t.Errorf("uriTransport(%q) = %q, %v, want %q", tt.uri, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSPKIPath(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for _, name := range []string{"client.crt", "client.key", "ca.crt"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = path
+	}
+
+	pkipath, err := tlsPKIPath(files["client.crt"], files["client.key"], files["ca.crt"])
+	if err != nil {
+		t.Fatalf("tlsPKIPath() error = %v", err)
+	}
+	defer os.RemoveAll(pkipath)
+
+	// libvirt looks for the files by these names in the pkipath directory
+	want := map[string]string{"clientcert.pem": "client.crt", "clientkey.pem": "client.key", "cacert.pem": "ca.crt"}
+	for name, contents := range want {
+		data, err := os.ReadFile(filepath.Join(pkipath, name))
+		if err != nil || string(data) != contents {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, contents)
+		}
+	}
+
+	uris, err := withURIParam([]string{"qemu+tls://host/system", "qemu:///system"}, "tls", "pkipath", pkipath)
+	if err != nil {
+		t.Fatalf("withURIParam() error = %v", err)
+	}
+	if want := []string{"qemu+tls://host/system?pkipath=" + strings.ReplaceAll(pkipath, "/", "%2F"), "qemu:///system"}; !slices.Equal(uris, want) {
+		t.Errorf("URIs = %v, want %v", uris, want)
+	}
+}
+
+func TestTLSPKIPathInvalid(t *testing.T) {
+	present := filepath.Join(t.TempDir(), "present.pem")
+	if err := os.WriteFile(present, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		name              string
+		cert, key, cacert string
+		wantErr           string
+	}{
+		{"cert only", present, "", "", "must all be given together"},
+		{"missing file", present, missing, present, "unable to use TLS file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tlsPKIPath(tt.cert, tt.key, tt.cacert); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("tlsPKIPath() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithURIParamSSHKey(t *testing.T) {
+	tests := []struct {
+		name string
+		uris []string
+		want []string
+	}{
+		{
+			name: "ssh URI",
+			uris: []string{"qemu+ssh://user@host/system"},
+			want: []string{"qemu+ssh://user@host/system?keyfile=%2Fhome%2Fuser%2F.ssh%2Fid_ed25519"},
+		},
+		{
+			name: "existing parameters kept",
+			uris: []string{"qemu+ssh://user@host/system?no_verify=1"},
+			want: []string{"qemu+ssh://user@host/system?keyfile=%2Fhome%2Fuser%2F.ssh%2Fid_ed25519&no_verify=1"},
+		},
+		{
+			name: "only ssh URIs",
+			uris: []string{"qemu:///system", "qemu+ssh://host/system"},
+			want: []string{"qemu:///system", "qemu+ssh://host/system?keyfile=%2Fhome%2Fuser%2F.ssh%2Fid_ed25519"},
+		},
+		{
+			// Left alone, with a warning that the key is unused
+			name: "no ssh URI",
+			uris: []string{"qemu+tcp://host/system"},
+			want: []string{"qemu+tcp://host/system"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, "text", "info")
+			uris, err := withURIParam(tt.uris, "ssh", "keyfile", "/home/user/.ssh/id_ed25519")
+			if err != nil {
+				t.Fatalf("withURIParam() error = %v", err)
+			}
+			if !slices.Equal(uris, tt.want) {
+				t.Errorf("withURIParam() = %v, want %v", uris, tt.want)
+			}
+			if warned := strings.Contains(logs.String(), "event=param_unused"); warned != slices.Equal(uris, tt.uris) {
+				t.Errorf("warned about an unused key = %t for %v", warned, tt.uris)
+			}
+		})
+	}
+}
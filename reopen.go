@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A live capture that reopens its device when reading from it fails, such as when the cable is pulled or
+// the bridge is recreated, so one failed interface doesn't stop the others from being listened on
+type reopeningHandle struct {
+	name     string                       // Name of the device captured on
+	open     func() (packetHandle, error) // Opens a new capture on the device
+	linkType layers.LinkType              // Link type of the first capture, which a reopened one shares
+	closed   chan struct{}                // Closed by Close, to stop reopening
+	once     sync.Once
+	mu       sync.Mutex
+	handle   packetHandle // Current capture, or nil while reopening or once closed
+}
+
+// Wrap the open capture on the named device, reopening it with open if it fails
+func newReopeningHandle(name string, handle packetHandle, open func() (packetHandle, error)) *reopeningHandle {
+	return &reopeningHandle{name: name, open: open, linkType: handle.LinkType(), closed: make(chan struct{}), handle: handle}
+}
+
+// Read the next packet, reopening the capture first if it has failed, or io.EOF once the capture has been closed
+func (h *reopeningHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		h.mu.Lock()
+		handle := h.handle
+		h.mu.Unlock()
+		if handle == nil || h.isClosed() {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+
+		data, ci, err := handle.ReadPacketData()
+		if err == nil || errors.Is(err, pcap.NextErrorTimeoutExpired) {
+			return data, ci, err
+		}
+		if h.isClosed() {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+
+		slog.Error("Capture failed, reopening the device", "event", "capture_failed", "device", h.name, "error", err)
+		if !h.reopen(handle) {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+	}
+}
+
+// Close the failed capture and open a new one, retrying with backoff until it opens or Close is called
+// Returns whether the capture was reopened
+func (h *reopeningHandle) reopen(failed packetHandle) bool {
+	h.mu.Lock()
+	h.handle = nil
+	h.mu.Unlock()
+	failed.Close()
+
+	delay := captureRetryInterval
+	for {
+		select {
+		case <-h.closed:
+			return false
+		case <-time.After(delay):
+		}
+
+		handle, err := h.open()
+		if err != nil {
+			delay = min(delay*2, captureRetryMax)
+			slog.Warn("Failed to reopen capture, retrying", "event", "capture_reopen_failed", "device", h.name, "error", err, "retry_in", delay)
+			continue
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.isClosed() {
+			handle.Close()
+			return false
+		}
+		h.handle = handle
+		slog.Info("Reopened capture", "event", "capture_reopened", "device", h.name)
+		return true
+	}
+}
+
+// Whether Close has been called
+func (h *reopeningHandle) isClosed() bool {
+	select {
+	case <-h.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// The link type of the device
+func (h *reopeningHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+// Statistics of the current capture, which start over when it's reopened
+func (h *reopeningHandle) Stats() (*pcap.Stats, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handle == nil {
+		return nil, fmt.Errorf("capture on %s is closed or being reopened", h.name)
+	}
+	return h.handle.Stats()
+}
+
+// Close the capture and stop reopening it
+func (h *reopeningHandle) Close() {
+	h.once.Do(func() { close(h.closed) })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handle != nil {
+		h.handle.Close()
+		h.handle = nil
+	}
+}
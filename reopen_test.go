@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/google/gopacket/pcap"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReopenFailedCapture(t *testing.T) {
+	failed := &fakeHandle{frames: [][]byte{udpPacket(t, magicPayload(t, "52:54:00:00:86:01")).Data()}, err: errors.New("device went down")}
+	// Once reopened, the capture only times out until it's closed, as an idle device would
+	reopened := &fakeHandle{frames: [][]byte{udpPacket(t, magicPayload(t, "52:54:00:00:86:02")).Data()}, err: pcap.NextErrorTimeoutExpired}
+	opens := 0
+	flaky := newReopeningHandle("br0", failed, func() (packetHandle, error) {
+		opens++
+		return reopened, nil
+	})
+	other := &fakeHandle{frames: [][]byte{
+		udpPacket(t, magicPayload(t, "52:54:00:00:86:03")).Data(),
+		udpPacket(t, magicPayload(t, "52:54:00:00:86:04")).Data(),
+	}}
+
+	var mu sync.Mutex
+	var macs []string
+	woken := make(chan struct{}, 4)
+	l := newTestListener(func(ctx context.Context, wol *virtwold.MagicPacket) (WakeResult, error) {
+		mu.Lock()
+		macs = append(macs, wol.MAC)
+		mu.Unlock()
+		woken <- struct{}{}
+		return WakeResult{Outcome: WakeNoMatch}, nil
+	})
+
+	done := make(chan error, 1)
+	packets := mergePackets(context.Background(), []captureHandle{{flaky, "br0"}, {other, "eth0"}})
+	go func() { done <- l.Run(context.Background(), packets) }()
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-woken:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of the 4 packets were handled", i)
+		}
+	}
+	if l.Healthy() != nil {
+		t.Error("listener stopped after one capture failed")
+	}
+
+	flaky.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errSourceClosed) {
+			t.Errorf("Run() = %v, want %v", err, errSourceClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return once every capture was closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(macs)
+	want := []string{"52:54:00:00:86:01", "52:54:00:00:86:02", "52:54:00:00:86:03", "52:54:00:00:86:04"}
+	if !slices.Equal(macs, want) {
+		t.Errorf("woken MACs = %v, want %v", macs, want)
+	}
+	if opens != 1 {
+		t.Errorf("reopened %d times, want 1", opens)
+	}
+	if !failed.closed.Load() || !reopened.closed.Load() {
+		t.Errorf("failed capture closed = %t, reopened capture closed = %t, want both closed", failed.closed.Load(), reopened.closed.Load())
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Write the frames to a pcap file in a temporary directory, returning its path
+func writePcapFile(t *testing.T, frames ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wol.pcap")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(1600, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}
+		if err := writer.WritePacket(ci, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestOpenReplay(t *testing.T) {
+	path := writePcapFile(t,
+		udpPacket(t, magicPayload(t, "52:54:00:00:21:01")).Data(),
+		rawFrame(t, magicPayload(t, "52:54:00:00:21:02")).Data(),
+	)
+	filter, err := buildBPFFilter([]int{9}, false, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := openReplay(path, filter)
+	if err != nil {
+		t.Skipf("libpcap can't replay pcap files here: %v", err)
+	}
+	defer handle.Close()
+
+	var macs []string
+	for packet := range gopacket.NewPacketSource(handle, handle.LinkType()).Packets() {
+		wol, err := virtwold.GrabMACAddr(packet)
+		if err != nil {
+			t.Fatalf("GrabMACAddr() error = %v", err)
+		}
+		macs = append(macs, wol.MAC)
+	}
+
+	want := []string{"52:54:00:00:21:01", "52:54:00:00:21:02"}
+	if !slices.Equal(macs, want) {
+		t.Errorf("replayed MACs = %v, want %v", macs, want)
+	}
+}
+
+func TestOpenReplayMissing(t *testing.T) {
+	if _, err := openReplay(filepath.Join(t.TempDir(), "missing.pcap"), ""); err == nil {
+		t.Error("openReplay() of a missing file succeeded, want an error")
+	}
+}
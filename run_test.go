@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Call run with the command line arguments, as if virtwold was started with them, returning its exit status
+func runWithArgs(t *testing.T, args ...string) int {
+	t.Helper()
+	originalArgs, originalFlags, originalLogger := os.Args, flag.CommandLine, slog.Default()
+	// Setting the default slog logger also sends the log package's output through it, which restoring it doesn't undo
+	originalOutput, originalLogFlags := log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		os.Args, flag.CommandLine = originalArgs, originalFlags
+		slog.SetDefault(originalLogger)
+		log.SetOutput(originalOutput)
+		log.SetFlags(originalLogFlags)
+	})
+	os.Args = append([]string{"virtwold"}, args...)
+	flag.CommandLine = flag.NewFlagSet("virtwold", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+
+	var err error
+	captureStdout(t, func() { err = run() })
+	if err == nil {
+		return 0
+	}
+	t.Logf("run() error = %v", err)
+	return exitCode(err)
+}
+
+// Capture on a fake device, fake0, that never delivers a packet, with a fake libvirt host at test:///default
+func withFakeDaemon(t *testing.T) {
+	t.Helper()
+	requireBPF(t)
+	withDevices(t, pcap.Interface{Name: "fake0"})
+	withFakeHosts(t, map[string]*fakeConnection{"test:///default": {}})
+	original := openDevice
+	openDevice = func(name string, backend string, snaplen int32, promiscuous bool, filter string) (packetHandle, error) {
+		return &fakeHandle{err: pcap.NextErrorTimeoutExpired}, nil
+	}
+	t.Cleanup(func() { openDevice = original })
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		daemon   bool // Whether the capture and libvirt are faked, for a daemon that gets as far as listening
+		wantCode int
+	}{
+		{"version subcommand", []string{"version"}, false, 0},
+		{"version flag", []string{"-version"}, false, 0},
+		{"self-test", []string{"-selftest"}, false, 0},
+		{"invalid log format", []string{"-log-format", "xml"}, false, exitFailed},
+		{"invalid port list", []string{"-ports", "9,x"}, false, exitFailed},
+		{"snaplen too small", []string{"-snaplen", "64"}, false, exitFailed},
+		{"invalid VLAN ID", []string{"-vlan-id", "5000"}, false, exitFailed},
+		{"missing interface", []string{"-interface", "missing0", "-libvirturi", "test:///default"}, true, exitFailed},
+		{"unreachable libvirt", []string{"-interface", "fake0", "-libvirturi", "test:///missing"}, true, exitFailed},
+		{"invalid interface type", []string{"-interface", "fake0", "-libvirturi", "test:///default", "-iface-type", "tap"}, true, exitFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.daemon {
+				withFakeDaemon(t)
+			}
+			if code := runWithArgs(t, tt.args...); code != tt.wantCode {
+				t.Errorf("exit status = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	withFakeDaemon(t)
+
+	// While notified of SIGTERM here too, it doesn't kill the test before run starts watching for it
+	terms := make(chan os.Signal, 1)
+	signal.Notify(terms, syscall.SIGTERM)
+	defer signal.Stop(terms)
+
+	code := make(chan int)
+	go func() { code <- runWithArgs(t, "-interface", "fake0", "-libvirturi", "test:///default") }()
+
+	// run only stops once it's listening, so keep asking until it does
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case got := <-code:
+			if got != 0 {
+				t.Errorf("exit status = %d, want 0", got)
+			}
+			return
+		case <-ticker.C:
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("run didn't stop on SIGTERM")
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"setup failed", errors.New("Invalid port list"), exitFailed},
+		{"stopped listening", fmt.Errorf("%w: %w", errStoppedListening, errSourceClosed), exitStopped},
+		{"wrapped stopped listening", fmt.Errorf("shutting down: %w", errStoppedListening), exitStopped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How often to check which VMs are running, when only VMs that have been off for a while are woken
+const runningPollInterval = time.Second
+
+// When each VM was last seen running, to avoid waking one that has only just shut down on a stale packet
+type runningTracker struct {
+	mu       sync.Mutex           // Protects lastSeen, which is shared by polling and packet handling
+	lastSeen map[string]time.Time // When each VM was last seen running, by UUID
+}
+
+// Create a runningTracker that has yet to see any VM running
+func newRunningTracker() *runningTracker {
+	return &runningTracker{lastSeen: make(map[string]time.Time)}
+}
+
+// Note that the VMs with the UUIDs were running at now
+func (t *runningTracker) seen(uuids []string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, uuid := range uuids {
+		t.lastSeen[uuid] = now
+	}
+}
+
+// Return how long the VM with the UUID has been off as of now, as far as has been seen,
+// or false if it hasn't been seen running since the daemon started
+func (t *runningTracker) offFor(uuid string, now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.lastSeen[uuid]
+	if !ok {
+		return 0, false
+	}
+	return now.Sub(last), true
+}
+
+// Note which VMs are running on every host at the interval, until the context is cancelled
+// Hosts that aren't connected are skipped until packet handling reconnects to them
+func (w *Waker) watchRunning(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			for _, host := range w.hosts {
+				uuids, err := host.activeUUIDs()
+				if err != nil {
+					slog.Debug("Failed to list running domains", "event", "running_poll_failed", "uri", host.uri, "error", err)
+					continue
+				}
+				w.running.seen(uuids, now)
+			}
+		}
+	}
+}
+
+// Return whether the VM with the UUID was seen running within the last offLongerThan, and how long it's been off
+func (w *Waker) recentlyRunning(uuid string) (time.Duration, bool) {
+	if w.offLongerThan <= 0 || w.running == nil {
+		return 0, false
+	}
+	off, ok := w.running.offFor(uuid, time.Now())
+	return off, ok && off < w.offLongerThan
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"libvirt.org/go/libvirt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOffLongerThan(t *testing.T) {
+	tests := []struct {
+		name          string
+		offLongerThan time.Duration
+		lastRunning   time.Duration // How long ago the domain was seen running, or 0 if never
+		wantOutcome   WakeOutcome
+		wantCalls     []string
+	}{
+		{"recently stopped", time.Minute, 5 * time.Second, WakeSkipped, nil},
+		{"stopped long enough ago", time.Minute, 2 * time.Minute, WakeStarted, []string{"Create"}},
+		{"never seen running", time.Minute, 0, WakeStarted, []string{"Create"}},
+		{"threshold disabled", 0, 5 * time.Second, WakeStarted, []string{"Create"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:91:01")
+			w, _ := newFakeHostWaker(t, fake)
+			w.offLongerThan = tt.offLongerThan
+			w.running = newRunningTracker()
+			if tt.lastRunning != 0 {
+				w.running.seen([]string{fake.uuid}, time.Now().Add(-tt.lastRunning))
+			}
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:91:01"})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWatchRunning(t *testing.T) {
+	running := newFakeDomain(t, "running", "52:54:00:00:91:02")
+	running.state = libvirt.DOMAIN_RUNNING
+	stopped := newFakeDomain(t, "stopped", "52:54:00:00:91:03")
+	w, _ := newFakeHostWaker(t, running, stopped)
+	w.running = newRunningTracker()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.watchRunning(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, seen := w.running.offFor(running.uuid, time.Now()); seen {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("running domain was never seen running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, seen := w.running.offFor(stopped.uuid, time.Now()); seen {
+		t.Error("stopped domain was seen running")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"net"
+)
+
+// Check that magic packets round-trip, by building them, wrapping them in packets as they'd be captured, and
+// parsing them again as captured packets are, without touching the network or libvirt
+func selfTest() error {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	password := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	cases := []struct {
+		name     string
+		password []byte
+		udp      bool
+	}{
+		{"UDP", nil, true},
+		{"UDP with SecureOn password", password, true},
+		{"raw Ethernet", nil, false},
+		{"raw Ethernet with SecureOn password", password, false},
+	}
+	for _, c := range cases {
+		payload, err := virtwold.BuildMagicPacket(mac, c.password)
+		if err != nil {
+			return fmt.Errorf("%s: failed to build magic packet: %w", c.name, err)
+		}
+		packet, err := syntheticPacket(payload, c.udp)
+		if err != nil {
+			return fmt.Errorf("%s: failed to build packet: %w", c.name, err)
+		}
+		if err := checkRoundTrip(packet, mac, c.password); err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+
+	return nil
+}
+
+// Wrap a magic packet in an Ethernet frame, either as a UDP broadcast to port 9 or as a raw Ethernet WOL frame,
+// and decode it as a captured packet would be
+func syntheticPacket(payload []byte, udp bool) (gopacket.Packet, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x52, 0x54, 0x00, 0xaa, 0xbb, 0xcc},
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: virtwold.EtherType,
+	}
+	stack := []gopacket.SerializableLayer{eth}
+	if udp {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4bcast}
+		udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+		if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+			return nil, err
+		}
+		stack = append(stack, ip, udp)
+	}
+	stack = append(stack, gopacket.Payload(payload))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
+		return nil, err
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default), nil
+}
+
+// Check that the MAC and SecureOn password parsed from the packet are the ones it was built with
+func checkRoundTrip(packet gopacket.Packet, mac net.HardwareAddr, password []byte) error {
+	wol, err := virtwold.GrabMACAddr(packet)
+	if err != nil {
+		return fmt.Errorf("failed to parse magic packet: %w", err)
+	}
+	if wol.MAC != mac.String() {
+		return fmt.Errorf("parsed MAC %s, expected %s", wol.MAC, mac)
+	}
+	if !bytes.Equal(wol.Password, password) {
+		return fmt.Errorf("parsed SecureOn password %x, expected %x", wol.Password, password)
+	}
+	return nil
+}
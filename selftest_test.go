@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	if err := selfTest(); err != nil {
+		t.Errorf("selfTest() = %v", err)
+	}
+}
+
+func TestCheckRoundTripCorrupted(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x88, 0x01}
+	password := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	tests := []struct {
+		name         string
+		corrupt      func(payload []byte)
+		wantMAC      net.HardwareAddr
+		wantPassword []byte
+		wantErr      string
+	}{
+		{"intact", func([]byte) {}, mac, password, ""},
+		{"sync stream", func(payload []byte) { payload[0] = 0 }, mac, password, "failed to parse magic packet"},
+		{"MAC copy", func(payload []byte) { payload[virtwold.SyncSize+6*7] ^= 0xff }, mac, password, "failed to parse magic packet"},
+		{"different MAC", func([]byte) {}, net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x88, 0x02}, password, "parsed MAC 52:54:00:00:88:01, expected 52:54:00:00:88:02"},
+		{"password", func(payload []byte) { payload[virtwold.MinSize] = 0 }, mac, password, "parsed SecureOn password 00bbccddeeff, expected aabbccddeeff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, udp := range []bool{true, false} {
+				payload, err := virtwold.BuildMagicPacket(mac, password)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.corrupt(payload)
+				packet, err := syntheticPacket(payload, udp)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = checkRoundTrip(packet, tt.wantMAC, tt.wantPassword)
+				if tt.wantErr == "" {
+					if err != nil {
+						t.Errorf("checkRoundTrip() with UDP %t = %v", udp, err)
+					}
+					continue
+				}
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("checkRoundTrip() with UDP %t = %v, want %q", udp, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Outcome of a subcommand, printed as a summary for people or as JSON for scripts
+type commandResult struct {
+	Sent    bool   `json:"sent"`             // Whether the magic packet was sent
+	MAC     string `json:"mac,omitempty"`    // MAC the magic packet was for
+	Target  string `json:"target,omitempty"` // Address the magic packet was sent to
+	Bytes   int    `json:"bytes,omitempty"`  // Size of the magic packet sent
+	Error   string `json:"error,omitempty"`  // Why the subcommand failed, if it did
+	summary string // What to print on success when not printing JSON
+}
+
+// Print the outcome of a subcommand, as JSON if asked, and pass on its error for the exit status
+// Errors are printed as JSON too, so scripts have a single place to look, but are otherwise left to the caller
+func printResult(result commandResult, err error, asJSON bool) error {
+	if asJSON {
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if jsonErr := json.NewEncoder(os.Stdout).Encode(result); jsonErr != nil && err == nil {
+			return jsonErr
+		}
+		return err
+	}
+	if err == nil {
+		fmt.Println(result.summary)
+	}
+	return err
+}
+
+// Send a magic packet, for testing an installation
+// Usage: virtwold send -mac aa:bb:cc:dd:ee:ff [-broadcast 192.168.1.255] [-port 9] [-password aa:bb:cc:dd:ee:ff] [-json]
+func runSend(args []string) error {
+	var macstr string    // MAC of the system to wake
+	var broadcast string // Address to send the packet to
+	var port int         // UDP port to send the packet to
+	var password string  // SecureOn password to include in the packet
+	var asJSON bool      // Print the result as JSON
+
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	fs.StringVar(&macstr, "mac", "", "MAC address of the system to wake")
+	fs.StringVar(&broadcast, "broadcast", "255.255.255.255", "Broadcast address to send the WOL packet to")
+	fs.IntVar(&port, "port", 9, "UDP port to send the WOL packet to")
+	fs.StringVar(&password, "password", "", "SecureOn password to include in the WOL packet, such as aa:bb:cc:dd:ee:ff")
+	fs.BoolVar(&asJSON, "json", false, "Print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	result, err := sendMagicPacket(macstr, broadcast, port, password)
+	return printResult(result, err, asJSON)
+}
+
+// Send a magic packet for the given MAC to the given address and UDP port
+func sendMagicPacket(macstr, broadcast string, port int, password string) (commandResult, error) {
+	var result commandResult
+	if macstr == "" {
+		return result, errors.New("no MAC to wake specified")
+	}
+	mac, err := net.ParseMAC(macstr)
+	if err != nil {
+		return result, fmt.Errorf("invalid MAC: %q", macstr)
+	}
+	result.MAC = mac.String()
+
+	var pw []byte
+	if password != "" {
+		if pw, err = parsePassword(password); err != nil {
+			return result, err
+		}
+	}
+
+	packet, err := virtwold.BuildMagicPacket(mac, pw)
+	if err != nil {
+		return result, err
+	}
+
+	if net.ParseIP(broadcast) == nil {
+		return result, fmt.Errorf("invalid broadcast address: %q", broadcast)
+	}
+	if port < 1 || port > 65535 {
+		return result, fmt.Errorf("invalid UDP port: %d", port)
+	}
+
+	result.Target = net.JoinHostPort(broadcast, strconv.Itoa(port))
+	dialer := net.Dialer{Control: allowBroadcast}
+	conn, err := dialer.Dial("udp", result.Target)
+	if err != nil {
+		return result, fmt.Errorf("failed to open socket to %s: %w", result.Target, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(packet); err != nil {
+		return result, fmt.Errorf("failed to send WOL packet to %s: %w", result.Target, err)
+	}
+
+	result.Sent = true
+	result.Bytes = len(packet)
+	result.summary = fmt.Sprintf("Sent WOL packet for %s to %s", mac, result.Target)
+	return result, nil
+}
+
+// Set SO_BROADCAST on the socket, so packets can be sent to broadcast addresses
+func allowBroadcast(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
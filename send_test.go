@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Run f with its output to os.Stdout captured, returning what it printed
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = original }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+// Listen for UDP packets on a loopback port, returning the connection and the port
+func listenLoopback(t *testing.T) (*net.UDPConn, int) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen on loopback: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestSendJSON(t *testing.T) {
+	_, port := listenLoopback(t)
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    commandResult
+		wantErr bool
+	}{
+		{
+			name: "sent",
+			args: []string{"-mac", "52:54:00:00:84:01", "-broadcast", "127.0.0.1", "-port", strconv.Itoa(port), "-json"},
+			want: commandResult{Sent: true, MAC: "52:54:00:00:84:01", Target: target, Bytes: 102},
+		},
+		{
+			name: "sent with a password",
+			args: []string{"-mac", "52:54:00:00:84:01", "-broadcast", "127.0.0.1", "-port", strconv.Itoa(port), "-password", "s3cr3t", "-json"},
+			want: commandResult{Sent: true, MAC: "52:54:00:00:84:01", Target: target, Bytes: 108},
+		},
+		{
+			name:    "invalid MAC",
+			args:    []string{"-mac", "vm", "-json"},
+			want:    commandResult{Error: `invalid MAC: "vm"`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid password",
+			args:    []string{"-mac", "52:54:00:00:84:01", "-password", "abc", "-json"},
+			want:    commandResult{MAC: "52:54:00:00:84:01", Error: `invalid SecureOn password, expected 6 hex bytes or 6 ASCII characters: "abc"`},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			output := captureStdout(t, func() { err = runSend(tt.args) })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runSend() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			var got commandResult
+			if err := json.Unmarshal([]byte(output), &got); err != nil {
+				t.Fatalf("output %q isn't JSON: %v", output, err)
+			}
+			if got != tt.want {
+				t.Errorf("output = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMagicPacketAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		broadcast  string
+		port       int
+		wantTarget string
+		wantErr    string
+	}{
+		// Only loopback addresses are sent to, so the test doesn't wake anything on the network
+		{"loopback broadcast", "127.255.255.255", 9, "127.255.255.255:9", ""},
+		{"loopback", "127.0.0.1", 7, "127.0.0.1:7", ""},
+		{"IPv6 loopback", "::1", 9, "[::1]:9", ""},
+		{"hostname", "broadcast.example", 9, "", `invalid broadcast address: "broadcast.example"`},
+		{"empty address", "", 9, "", `invalid broadcast address: ""`},
+		{"port 0", "192.168.1.255", 0, "", "invalid UDP port: 0"},
+		{"port too large", "192.168.1.255", 65536, "", "invalid UDP port: 65536"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := sendMagicPacket("52:54:00:00:85:01", tt.broadcast, tt.port, "")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("sendMagicPacket() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			// Sending may still fail, such as without IPv6, but only after the address is accepted
+			if result.Target != tt.wantTarget {
+				t.Errorf("target = %q (error %v), want %q", result.Target, err, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestSendRoundTrip(t *testing.T) {
+	conn, port := listenLoopback(t)
+
+	result, err := sendMagicPacket("52-54-00-00-85-02", "127.0.0.1", port, "aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatalf("sendMagicPacket() error = %v", err)
+	}
+	if !result.Sent || result.Bytes != 108 {
+		t.Errorf("result = %+v, want 108 bytes sent", result)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+	wol, err := virtwold.ParseMagicPacket(buf[:n])
+	if err != nil {
+		t.Fatalf("received an invalid magic packet: %v", err)
+	}
+	if wol.MAC != "52:54:00:00:85:02" || !bytes.Equal(wol.Password, []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}) {
+		t.Errorf("received %s with password %x, want 52:54:00:00:85:02 with aabbccddeeff", wol.MAC, wol.Password)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// The wakeable domains on one libvirt host, as returned by /domains
+type hostDomains struct {
+	URI     string                    `json:"uri"`             // URI to the libvirt daemon
+	Domains []virtwold.WakeableDomain `json:"domains"`         // Domains that could be woken
+	Error   string                    `json:"error,omitempty"` // Why the domains couldn't be listed, if they couldn't
+}
+
+// Serve Prometheus metrics at /metrics, the domains that could be woken at /domains, the most recent wake events
+// at /events, and whether the daemon is healthy at /healthz, until the context is cancelled
+func serveHTTP(ctx context.Context, addr string, waker *Waker, listener *Listener) {
+	server := &http.Server{Addr: addr, Handler: newHTTPHandler(waker, listener)}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		slog.Info("Serving metrics", "event", "metrics_started", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "event", "metrics_failed", "error", err)
+		}
+	}()
+}
+
+// Return the handler for the endpoints serveHTTP serves
+func newHTTPHandler(waker *Waker, listener *Listener) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		err := errors.Join(listener.Healthy(), waker.Healthy())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.HandleFunc("/domains", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(waker.ListDomains()); err != nil {
+			slog.Warn("Failed to write domain list", "event", "http_failed", "error", err)
+		}
+	})
+
+	mux.HandleFunc("/events", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(waker.Events()); err != nil {
+			slog.Warn("Failed to write wake events", "event", "http_failed", "error", err)
+		}
+	})
+	return mux
+}
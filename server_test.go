@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"io"
+	"libvirt.org/go/libvirt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Fetch the path from the server, returning the status code and body
+func httpGet(t *testing.T, server *httptest.Server, path string) (int, string) {
+	t.Helper()
+	response, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", path, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return response.StatusCode, string(body)
+}
+
+// Return the value of the sample in the Prometheus metrics, or 0 if there's no such sample yet
+func metricValue(t *testing.T, sample string) float64 {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if value, found := strings.CutPrefix(line, sample+" "); found {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("metric %s = %q: %v", sample, value, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountWakes(t *testing.T) {
+	fake := newFakeDomain(t, "metrics-vm", "52:54:00:00:12:01")
+	w, _ := newFakeHostWaker(t, fake)
+	server := httptest.NewServer(newHTTPHandler(w, newTestListener(nil)))
+	defer server.Close()
+
+	// The counter lives as long as the process, so may already count wakes from an earlier run of the test
+	const sample = `virtwold_wakes_total{domain="metrics-vm"}`
+	if status, _ := httpGet(t, server, "/metrics"); status != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want %d", status, http.StatusOK)
+	}
+	line := fmt.Sprintf("%s %g", sample, metricValue(t, sample)+1)
+
+	if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:12:01"}); err != nil {
+		t.Fatalf("WakeVirtualMachine() error = %v", err)
+	}
+
+	if _, body := httpGet(t, server, "/metrics"); !strings.Contains(body, line) {
+		t.Errorf("/metrics lacks %q after waking", line)
+	}
+}
+
+func TestDomainsEndpoint(t *testing.T) {
+	vm := newFakeDomain(t, "vm", "52:54:00:00:27:01", "52:54:00:00:27:02")
+	paused := newFakeDomain(t, "paused", "52:54:00:00:27:03")
+	paused.state = libvirt.DOMAIN_PAUSED
+	running := newFakeDomain(t, "running", "52:54:00:00:27:04")
+	running.state = libvirt.DOMAIN_RUNNING
+	withFakeHosts(t, map[string]*fakeConnection{
+		"test:///good":   {domains: []*fakeDomain{vm, paused, running}},
+		"test:///broken": {listErr: errors.New("internal error")},
+	})
+	w, err := NewWaker([]string{"test:///good", "test:///broken"}, 0, false, passwordConfig{})
+	if err != nil {
+		t.Fatalf("NewWaker() error = %v", err)
+	}
+	server := httptest.NewServer(newHTTPHandler(w, newTestListener(nil)))
+	defer server.Close()
+
+	status, body := httpGet(t, server, "/domains")
+	if status != http.StatusOK {
+		t.Fatalf("GET /domains status = %d, want %d", status, http.StatusOK)
+	}
+	var hosts []hostDomains
+	if err := json.Unmarshal([]byte(body), &hosts); err != nil {
+		t.Fatalf("GET /domains returned invalid JSON %q: %v", body, err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("GET /domains returned %d hosts, want 2", len(hosts))
+	}
+
+	// Running domains can't be woken, so aren't listed
+	want := []virtwold.WakeableDomain{
+		{Name: "vm", State: "shutoff", MACs: []string{"52:54:00:00:27:01", "52:54:00:00:27:02"}, Persistent: true},
+		{Name: "paused", State: "paused", MACs: []string{"52:54:00:00:27:03"}, Persistent: true},
+	}
+	if hosts[0].URI != "test:///good" || !reflect.DeepEqual(hosts[0].Domains, want) || hosts[0].Error != "" {
+		t.Errorf("first host = %+v, want %+v", hosts[0], want)
+	}
+	if hosts[1].URI != "test:///broken" || len(hosts[1].Domains) != 0 || !strings.Contains(hosts[1].Error, "internal error") {
+		t.Errorf("second host = %+v, want no domains and the listing error", hosts[1])
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name       string
+		capturing  bool
+		connected  bool
+		wantStatus int
+	}{
+		{"healthy", true, true, http.StatusOK},
+		{"not capturing", false, true, http.StatusServiceUnavailable},
+		{"disconnected", true, false, http.StatusServiceUnavailable},
+		{"neither", false, false, http.StatusServiceUnavailable},
+	}
+
+	w, _ := newFakeHostWaker(t)
+	l := newTestListener(w.WakeVirtualMachine)
+	server := httptest.NewServer(newHTTPHandler(w, l))
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l.heartbeat.Store(0)
+			if tt.capturing {
+				l.beat()
+			}
+			w.hosts[0].up.Store(tt.connected)
+
+			if status, body := httpGet(t, server, "/healthz"); status != tt.wantStatus {
+				t.Errorf("GET /healthz status = %d (%q), want %d", status, body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	w, _ := newFakeHostWaker(t)
+	for i := 0; i < eventHistory+5; i++ {
+		mac := fmt.Sprintf("52:54:00:00:66:%02x", i)
+		if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: mac}); err != nil {
+			t.Fatalf("WakeVirtualMachine() error = %v", err)
+		}
+	}
+	server := httptest.NewServer(newHTTPHandler(w, newTestListener(nil)))
+	defer server.Close()
+
+	status, body := httpGet(t, server, "/events")
+	if status != http.StatusOK {
+		t.Fatalf("GET /events status = %d, want %d", status, http.StatusOK)
+	}
+	var events []wakeEvent
+	if err := json.Unmarshal([]byte(body), &events); err != nil {
+		t.Fatalf("failed to decode /events: %v", err)
+	}
+
+	if len(events) != eventHistory {
+		t.Fatalf("/events has %d events, want %d", len(events), eventHistory)
+	}
+	// Newest first, with the oldest five dropped
+	for i, event := range events {
+		want := fmt.Sprintf("52:54:00:00:66:%02x", eventHistory+4-i)
+		if event.MAC != want || event.Outcome != WakeNoMatch {
+			t.Errorf("event %d = %s %s, want %s %s", i, event.MAC, event.Outcome, want, WakeNoMatch)
+		}
+		if i > 0 && event.Time.After(events[i-1].Time) {
+			t.Errorf("event %d at %v is newer than the one before it at %v", i, event.Time, events[i-1].Time)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"github.com/google/gopacket/pcap"
+	"log/slog"
+	"time"
+)
+
+// A source of capture statistics, such as a pcap.Handle
+type statsProvider interface {
+	Stats() (*pcap.Stats, error)
+}
+
+// Report the statistics of each capture handle at the interval, until the context is cancelled
+func reportStats(ctx context.Context, handles []captureHandle, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			for _, handle := range handles {
+				logStats(handle.name, handle)
+			}
+		}
+	}
+}
+
+// Log and update the metrics for the statistics of the capture on the named device
+// Dropped packets mean the daemon (or the kernel) couldn't keep up, and may have missed WOL packets
+func logStats(name string, provider statsProvider) {
+	stats, err := provider.Stats()
+	if err != nil {
+		slog.Warn("Failed to get capture statistics", "event", "stats_failed", "device", name, "error", err)
+		return
+	}
+
+	captureReceived.WithLabelValues(name).Set(float64(stats.PacketsReceived))
+	captureDropped.WithLabelValues(name).Set(float64(stats.PacketsDropped))
+	captureIfDropped.WithLabelValues(name).Set(float64(stats.PacketsIfDropped))
+
+	level := slog.LevelInfo
+	if stats.PacketsDropped > 0 || stats.PacketsIfDropped > 0 {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "Capture statistics", "event", "capture_stats", "device", name,
+		"received", stats.PacketsReceived, "dropped", stats.PacketsDropped, "if_dropped", stats.PacketsIfDropped)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A capture standing in for one on a device, returning its statistics, or an error if it has none
+type fakeStats struct {
+	stats *pcap.Stats
+}
+
+func (s fakeStats) Stats() (*pcap.Stats, error) {
+	if s.stats == nil {
+		return nil, errors.New("no statistics")
+	}
+	return s.stats, nil
+}
+
+func TestLogStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		stats     *pcap.Stats
+		wantLog   string
+		wantLines []string
+	}{
+		{"no drops", &pcap.Stats{PacketsReceived: 10}, `level=INFO msg="Capture statistics"`, []string{
+			`virtwold_capture_packets_received{interface="no drops"} 10`,
+			`virtwold_capture_packets_dropped{interface="no drops"} 0`,
+		}},
+		{"dropped", &pcap.Stats{PacketsReceived: 20, PacketsDropped: 3}, `level=WARN msg="Capture statistics"`, []string{
+			`virtwold_capture_packets_received{interface="dropped"} 20`,
+			`virtwold_capture_packets_dropped{interface="dropped"} 3`,
+		}},
+		{"interface dropped", &pcap.Stats{PacketsReceived: 30, PacketsIfDropped: 4}, `level=WARN msg="Capture statistics"`, []string{
+			`virtwold_capture_packets_if_dropped{interface="interface dropped"} 4`,
+		}},
+		{"unavailable", nil, `level=WARN msg="Failed to get capture statistics"`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, "text", "info")
+			logStats(tt.name, fakeStats{tt.stats})
+
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logs = %q, want %q", logs.String(), tt.wantLog)
+			}
+			recorder := httptest.NewRecorder()
+			promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			for _, line := range tt.wantLines {
+				if !strings.Contains(recorder.Body.String(), line) {
+					t.Errorf("/metrics lacks %q", line)
+				}
+			}
+		})
+	}
+}
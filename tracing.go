@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"time"
+)
+
+// How long to wait for the last spans to be exported on shutdown
+const tracingFlushTimeout = 5 * time.Second
+
+// Traces packet handling and wakes, a no-op unless -otel-endpoint is set
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer("virtwold")
+
+// Export traces over OTLP/HTTP to the collector at endpoint, such as http://localhost:4318
+// Returns a function flushing and stopping the export, to call on shutdown
+func setUpTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter for %s: %w", endpoint, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("virtwold"))),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("virtwold")
+
+	return provider.Shutdown, nil
+}
+
+// Start a span as a child of any span in the context, with the attributes
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End the span, marking it failed if err isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
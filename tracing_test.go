@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"testing"
+)
+
+// Record spans in memory for the rest of the test, returning the recorder
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	original := tracer
+	t.Cleanup(func() { tracer = original })
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("virtwold")
+	return recorder
+}
+
+func TestWakeSpans(t *testing.T) {
+	recorder := withSpanRecorder(t)
+	fake := newFakeDomain(t, "vm", "52:54:00:00:96:01")
+	w, _ := newFakeHostWaker(t, fake)
+	l := NewListener(allowlist{}, w.WakeVirtualMachine)
+
+	l.handlePacket(context.Background(), udpPacket(t, magicPayload(t, "52:54:00:00:96:01")))
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	// Each span and the span it should be a child of, or empty for the root
+	tests := []struct {
+		name   string
+		parent string
+	}{
+		{"packet", ""},
+		{"packet.parse", "packet"},
+		{"wake", "packet"},
+		{"libvirt.connect", "wake"},
+		{"domain.lookup", "wake"},
+		{"domain.wake", "wake"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span, ok := spans[tt.name]
+			if !ok {
+				t.Fatalf("no %s span was recorded", tt.name)
+			}
+			if tt.parent == "" {
+				if span.Parent().IsValid() {
+					t.Errorf("%s has a parent, want none", tt.name)
+				}
+				return
+			}
+			parent, ok := spans[tt.parent]
+			if !ok {
+				t.Fatalf("no %s span was recorded", tt.parent)
+			}
+			if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("%s isn't a child of %s", tt.name, tt.parent)
+			}
+		})
+	}
+
+	// The MAC and domain are recorded on the spans they're known for
+	attributes := make(map[string]string)
+	for _, attr := range spans["domain.wake"].Attributes() {
+		attributes[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attributes["mac"] != "52:54:00:00:96:01" || attributes["domain"] != "vm" {
+		t.Errorf("domain.wake attributes = %v, want the MAC and domain", attributes)
+	}
+}
+
+func TestNoopTracer(t *testing.T) {
+	original := tracer
+	t.Cleanup(func() { tracer = original })
+	tracer = noop.NewTracerProvider().Tracer("virtwold")
+
+	_, span := startSpan(context.Background(), "wake")
+	defer span.End()
+	if span.IsRecording() {
+		t.Error("span from the no-op tracer is recording")
+	}
+}
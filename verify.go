@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"libvirt.org/go/libvirt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	verifyInterval = 2 * time.Second // How often to look for the address of a woken VM and ping it
+	pingTimeout    = time.Second     // How long to wait for a reply to each ping
+)
+
+// Pings an address, reporting whether it replied within the timeout
+// A variable so it can be replaced, such as with one that doesn't need the privileges to open a raw socket
+var probeAddress = pingAddress
+
+// The calls made on a woken domain to find its address, which *libvirt.Domain implements
+type addressLister interface {
+	ListAllInterfaceAddresses(src libvirt.DomainInterfaceAddressesSource) ([]libvirt.DomainInterface, error)
+	Free() error
+}
+
+// Wait for the woken domain to get an address from a DHCP lease for the (normalized) MAC, then ping it until
+// it replies or timeout has passed, logging whether it came up on the network
+// Frees the domain when done, so the caller must give it its own reference
+func verifyNetwork(domain addressLister, name string, mac string, timeout time.Duration) {
+	defer domain.Free()
+
+	deadline := time.Now().Add(timeout)
+	var ip net.IP
+	for {
+		if ip == nil {
+			addr, err := leaseAddress(domain, mac)
+			if err != nil {
+				slog.Debug("Unable to look up domain address", "event", "verify_error", "domain", name, "mac", mac, "error", err)
+			}
+			ip = addr
+		}
+		if ip != nil {
+			replied, err := probeAddress(ip, pingTimeout)
+			if err != nil {
+				slog.Warn("Unable to probe domain on the network", "event", "verify_error", "domain", name, "mac", mac, "ip", ip, "error", err)
+				return
+			}
+			if replied {
+				slog.Info("Woken domain replied on the network", "event", "network_verified", "domain", name, "mac", mac, "ip", ip)
+				return
+			}
+		}
+
+		if time.Now().After(deadline) {
+			slog.Warn("Woken domain didn't reply on the network", "event", "network_unverified", "domain", name, "mac", mac, "ip", ip, "timeout", timeout)
+			return
+		}
+		time.Sleep(verifyInterval)
+	}
+}
+
+// Return the IPv4 address leased to the domain's interface with the (normalized) MAC, or nil if there's no lease yet
+func leaseAddress(domain addressLister, mac string) (net.IP, error) {
+	ifaces, err := domain.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range ifaces {
+		if virtwold.NormalizeMAC(iface.Hwaddr) != mac {
+			continue
+		}
+		for _, addr := range iface.Addrs {
+			if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 {
+				return net.ParseIP(addr.Addr), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Send an ICMP echo request to the IPv4 address, reporting whether a reply came back within the timeout
+// Needs the privileges to open a raw socket, which capturing packets already requires
+func pingAddress(ip net.IP, timeout time.Duration) (bool, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	request := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       id,
+		Seq:      1,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, request, gopacket.Payload("virtwold")); err != nil {
+		return false, err
+	}
+	if _, err := conn.WriteTo(buf.Bytes(), &net.IPAddr{IP: ip}); err != nil {
+		return false, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	reply := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(reply)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return false, nil
+			}
+			return false, err
+		}
+		if addr, ok := from.(*net.IPAddr); !ok || !addr.IP.Equal(ip) {
+			continue
+		}
+
+		packet := gopacket.NewPacket(reply[:n], layers.LayerTypeICMPv4, gopacket.Default)
+		if echo, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok && echo.TypeCode.Type() == layers.ICMPv4TypeEchoReply && echo.Id == id {
+			return true, nil
+		}
+	}
+}
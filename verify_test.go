@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"libvirt.org/go/libvirt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A woken domain's interfaces, as reported by the lease source
+type fakeAddressLister struct {
+	ifaces []libvirt.DomainInterface // Interfaces returned by ListAllInterfaceAddresses
+	freed  bool                      // Whether the domain has been freed
+}
+
+func (d *fakeAddressLister) ListAllInterfaceAddresses(src libvirt.DomainInterfaceAddressesSource) ([]libvirt.DomainInterface, error) {
+	return d.ifaces, nil
+}
+
+func (d *fakeAddressLister) Free() error {
+	d.freed = true
+	return nil
+}
+
+func TestVerifyNetwork(t *testing.T) {
+	leased := []libvirt.DomainInterface{{
+		Name:   "vnet0",
+		Hwaddr: "52:54:00:00:61:01",
+		Addrs: []libvirt.DomainIPAddress{
+			{Type: libvirt.IP_ADDR_TYPE_IPV6, Addr: "fd00::61"},
+			{Type: libvirt.IP_ADDR_TYPE_IPV4, Addr: "192.168.122.61", Prefix: 24},
+		},
+	}}
+	other := []libvirt.DomainInterface{{
+		Name:   "vnet1",
+		Hwaddr: "52:54:00:00:61:02",
+		Addrs:  []libvirt.DomainIPAddress{{Type: libvirt.IP_ADDR_TYPE_IPV4, Addr: "192.168.122.62", Prefix: 24}},
+	}}
+
+	tests := []struct {
+		name      string
+		ifaces    []libvirt.DomainInterface
+		replied   bool
+		probeErr  error
+		wantProbe string
+		wantEvent string
+	}{
+		{"replied", leased, true, nil, "192.168.122.61", "network_verified"},
+		{"no reply", leased, false, nil, "192.168.122.61", "network_unverified"},
+		{"probe failed", leased, false, errors.New("operation not permitted"), "192.168.122.61", "verify_error"},
+		{"no lease", nil, false, nil, "", "network_unverified"},
+		{"lease for another MAC", other, true, nil, "", "network_unverified"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var probed []string
+			original := probeAddress
+			probeAddress = func(ip net.IP, timeout time.Duration) (bool, error) {
+				probed = append(probed, ip.String())
+				return tt.replied, tt.probeErr
+			}
+			t.Cleanup(func() { probeAddress = original })
+			logs := captureLogs(t, "text", "info")
+			domain := &fakeAddressLister{ifaces: tt.ifaces}
+
+			verifyNetwork(domain, "vm", "52:54:00:00:61:01", 0)
+
+			if tt.wantProbe == "" && len(probed) != 0 {
+				t.Errorf("probed %v, want no probes", probed)
+			}
+			if tt.wantProbe != "" && (len(probed) != 1 || probed[0] != tt.wantProbe) {
+				t.Errorf("probed %v, want %s", probed, tt.wantProbe)
+			}
+			if !strings.Contains(logs.String(), "event="+tt.wantEvent) {
+				t.Errorf("logs = %q, want a %s event", logs.String(), tt.wantEvent)
+			}
+			if !domain.freed {
+				t.Error("domain wasn't freed")
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"libvirt.org/go/libvirt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build details, set when building with e.g.
+// -ldflags "-X main.version=v2.1.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+// Any left unset are taken from the build information Go embeds, where available
+var (
+	version   = "" // Release version
+	commit    = "" // Commit built from
+	buildDate = "" // When the binary was built
+)
+
+// Print the version of the daemon, and of the libraries it was built with and is linked against, for support requests
+func printVersion(w io.Writer) {
+	version, commit, buildDate := version, commit, buildDate
+	deps := make(map[string]string)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && buildDate == "":
+				buildDate = setting.Value
+			}
+		}
+		for _, dep := range info.Deps {
+			deps[dep.Path] = dep.Version
+		}
+	}
+
+	fmt.Fprintf(w, "virtwold %s\n", orUnknown(version))
+	fmt.Fprintf(w, "commit: %s\n", orUnknown(commit))
+	fmt.Fprintf(w, "built: %s\n", orUnknown(buildDate))
+	fmt.Fprintf(w, "go: %s\n", runtime.Version())
+	fmt.Fprintf(w, "gopacket: %s\n", orUnknown(deps["github.com/google/gopacket"]))
+	fmt.Fprintf(w, "libvirt-go: %s\n", orUnknown(deps["libvirt.org/go/libvirt"]))
+
+	// libvirt encodes its version as major * 1,000,000 + minor * 1,000 + release
+	if lib, err := libvirt.GetVersion(); err != nil {
+		fmt.Fprintf(w, "libvirt: unknown (%v)\n", err)
+	} else {
+		fmt.Fprintf(w, "libvirt: %d.%d.%d\n", lib/1000000, lib/1000%1000, lib%1000)
+	}
+}
+
+// Return the value, or unknown if it's empty
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
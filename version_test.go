@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPrintVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		commit    string
+		buildDate string
+		wantFirst []string // Leading lines, which are set from the build variables
+	}{
+		{
+			name:      "set with ldflags",
+			version:   "v2.1.0",
+			commit:    "0123456789abcdef0123456789abcdef01234567",
+			buildDate: "2026-01-02T03:04:05Z",
+			wantFirst: []string{"virtwold v2.1.0", "commit: 0123456789abcdef0123456789abcdef01234567", "built: 2026-01-02T03:04:05Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalVersion, originalCommit, originalBuildDate := version, commit, buildDate
+			t.Cleanup(func() { version, commit, buildDate = originalVersion, originalCommit, originalBuildDate })
+			version, commit, buildDate = tt.version, tt.commit, tt.buildDate
+
+			var buf bytes.Buffer
+			printVersion(&buf)
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if len(lines) != 7 {
+				t.Fatalf("printVersion() printed %d lines, want 7:\n%s", len(lines), buf.String())
+			}
+			for i, want := range tt.wantFirst {
+				if lines[i] != want {
+					t.Errorf("line %d = %q, want %q", i+1, lines[i], want)
+				}
+			}
+
+			// The library versions depend on the build and host, so only their format is checked
+			formats := []*regexp.Regexp{
+				regexp.MustCompile(`^go: go\S+$`),
+				regexp.MustCompile(`^gopacket: \S+$`),
+				regexp.MustCompile(`^libvirt-go: \S+$`),
+				regexp.MustCompile(`^libvirt: (\d+\.\d+\.\d+|unknown \(.*\))$`),
+			}
+			for i, format := range formats {
+				if line := lines[len(tt.wantFirst)+i]; !format.MatchString(line) {
+					t.Errorf("line %q doesn't match %s", line, format)
+				}
+			}
+		})
+	}
+}
+
+func TestOrUnknown(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", "unknown"},
+		{"v2.1.0", "v2.1.0"},
+	}
+
+	for _, tt := range tests {
+		if got := orUnknown(tt.value); got != tt.want {
+			t.Errorf("orUnknown(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -1,161 +1,1020 @@
 //
 // Virtual Wake-on-LAN
 //
-// Listens for a WOL magic packet (UDP), then connects to the local libvirt socket and finds a matching VM
+// Listens for a WOL magic packet (UDP), then uses a persistent connection to the libvirt daemon to find a matching VM
 // If a matching VM is found, it is started (if not already running)
 //
 // Assumes the VM has a static MAC configured
 // Assumes libvirtd connection is at /var/run/libvirt/libvirt-sock
 //
 // Filters on len=102 and len=144 (WOL packet) and len=234 (WOL packet with password)
+// IPv6 has no broadcast, so UDP WOL packets over IPv6 are accepted to any destination, with lengths allowing
+// for the 20 byte longer IPv6 header
+// That includes multicast destinations such as the all-nodes address ff02::1, which some senders use in place of broadcast
+// Also accepts raw Ethernet WOL frames (EtherType 0x0842) which carry the magic packet with no IP/UDP headers
+//
+// Optionally, the name of the domain to wake can follow the magic packet (and SecureOn password, if any),
+// as the ASCII text "name:" then the domain name, e.g. "name:gaming" starting at offset 102 (or 108 with a password)
 
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"libvirt.org/go/libvirt"
-	"libvirt.org/go/libvirtxml"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	vlanTagSize          = 4           // Length of an 802.1Q VLAN tag
+	maxVLANID            = 4094        // Highest usable 802.1Q VLAN ID
+	ipv6ExtraSize        = 20          // How much longer an IPv6 header is than an IPv4 header
+	udpOverheadSize      = 14 + 20 + 8 // Ethernet, IPv4 and UDP headers in front of a UDP WOL payload
+	maxPaddingSize       = 64          // Most zero padding after a magic packet that the built-in filter captures
+	pcapIfLoopback       = 0x1         // PCAP_IF_LOOPBACK flag on devices returned by pcap.FindAllDevs
+	defaultSnaplen       = 1600        // Bytes of each packet to capture unless set otherwise
+	captureTimeout       = time.Second // Read timeout on capture handles, so they can be closed on shutdown
+	deviceWaitInterval   = time.Second // How often to check whether the devices to listen on have appeared
+	captureRetryInterval = time.Second // Delay before reopening a failed capture, doubled after each failure
+	captureRetryMax      = time.Minute // Longest delay between attempts to reopen a failed capture
+	rebootCooldown       = time.Minute // Cooldown used with -reboot-running when none is given
 )
 
 func main() {
-	var iface string                                                         // Interface we'll listen on
-	var libvirturi string                                                    // URI to the libvirt daemon
-	var buffer = int32(1600)                                                 // Buffer for packets received
-	var filter = "udp and broadcast and (len = 102 or len = 144 or len=234)" // PCAP filter to catch UDP WOL packets
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// Exit statuses, besides 0 for a clean shutdown (or a subcommand or check succeeding) and 2 for invalid flags
+const (
+	exitFailed  = 1 // Setting up failed, such as for invalid settings or being unable to capture or reach libvirt, or a subcommand or check failed
+	exitStopped = 3 // Listening stopped unexpectedly, such as when every capture closed
+)
+
+// Returned by run when listening stops without being asked to
+var errStoppedListening = errors.New("stopped listening")
+
+// Return the exit status for the error returned by run
+func exitCode(err error) int {
+	if errors.Is(err, errStoppedListening) {
+		return exitStopped
+	}
+	return exitFailed
+}
+
+// Run the daemon (or a subcommand) until it's asked to stop, returning nil,
+// or fails, returning an error to exit with
+func run() error {
+	// The version subcommand prints the version instead of listening for packets
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		printVersion(os.Stdout)
+		return nil
+	}
+
+	// The discover subcommand prints the magic packets it captures instead of waking anything
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		if err := runDiscover(os.Args[2:]); err != nil {
+			return fmt.Errorf("Unable to discover WOL packets: %w", err)
+		}
+		return nil
+	}
+
+	// The send subcommand sends a magic packet instead of listening for one
+	if len(os.Args) > 1 && os.Args[1] == "send" {
+		if err := runSend(os.Args[2:]); err != nil {
+			return fmt.Errorf("Unable to send WOL packet: %w", err)
+		}
+		return nil
+	}
+
+	var iface string                   // Comma-separated list of interfaces we'll listen on
+	var libvirturi string              // Comma-separated list of URIs to libvirt daemons
+	var portlist string                // Comma-separated list of UDP ports to listen for WOL packets on
+	var password string                // SecureOn password required to wake any VM
+	var macpasswords string            // Per-MAC SecureOn passwords, overriding the global password
+	var metricsaddr string             // Address to serve Prometheus metrics on, or empty to disable
+	var logformat string               // Format of log output, text or json
+	var loglevel string                // Minimum level of log output
+	var configpath string              // Path to a YAML configuration file
+	var dryrun bool                    // Log the VMs that would be woken, without waking them
+	var allow string                   // Comma-separated list of MACs allowed to be woken
+	var pcapfile string                // pcap file to replay instead of capturing live
+	var webhookurl string              // URL to POST an event to after waking a VM
+	var cooldown time.Duration         // How long to ignore repeated packets for a MAC
+	var connecttimeout time.Duration   // How long to wait for a libvirt connection to open
+	var vlan bool                      // Also capture WOL packets with an 802.1Q VLAN tag
+	var vlanid int                     // Only capture WOL packets tagged with this VLAN ID
+	var ratelimit float64              // Most WOL packets per second to act on
+	var namematch bool                 // Wake by the domain name carried in the packet if no MAC matches
+	var wakeattempts int               // Number of times to try waking a VM on transient libvirt errors
+	var wakebackoff time.Duration      // Delay before retrying a wake, doubled after each failure
+	var queuedepth int                 // Most wakes to hold while libvirt is unreachable
+	var listinterfaces bool            // Print the devices that can be listened on, then exit
+	var force bool                     // Start VMs even if their lifecycle policy says not to
+	var autostartonly bool             // Only wake VMs with autostart enabled
+	var snaplen int                    // Most bytes of each packet to capture
+	var bpf string                     // PCAP filter replacing the built-in one, or empty to build it from the ports
+	var promiscuous bool               // Put the interfaces in promiscuous mode
+	var allowtransient bool            // Also wake transient VMs
+	var wakedelay time.Duration        // How long after a packet to wake its VM
+	var mappingfile string             // Path to a file mapping MACs to VM names
+	var indexrefresh time.Duration     // How often to rebuild the index of VM MACs
+	var tlscert string                 // Client certificate for qemu+tls:// connections
+	var tlskey string                  // Client key for qemu+tls:// connections
+	var tlscacert string               // CA certificate for qemu+tls:// connections
+	var sshkey string                  // Private key for qemu+ssh:// connections
+	var waitrunning time.Duration      // How long to wait for a woken VM to be running
+	var statsinterval time.Duration    // How often to report capture statistics
+	var wakeall bool                   // Wake every matching VM, rather than just the first
+	var waitforinterface time.Duration // How long to wait for the interfaces to appear
+	var usedhcpleases bool             // Also match VMs by the DHCP leases of libvirt networks
+	var verifynetwork time.Duration    // How long to wait for a woken VM to reply on the network
+	var readonly bool                  // Connect to libvirt read-only, refusing to wake anything
+	var capturebackend string          // How packets are captured, pcap or afpacket
+	var ignorelocal bool               // Ignore packets sent from this host's own interfaces
+	var includename string             // Only wake VMs with names matching this regular expression
+	var excludename string             // Never wake VMs with names matching this regular expression
+	var rebootrunning bool             // Reboot running VMs matching a packet
+	var controlsocket string           // Path to a Unix domain socket answering commands
+	var onunknown string               // Webhook URL or command to tell about MACs no VM has
+	var checkperms bool                // Check whether packets can be captured, then exit
+	var selftest bool                  // Check that magic packets are parsed correctly, then exit
+	var showversion bool               // Print the version, then exit
+	var otelendpoint string            // URL of an OTLP/HTTP collector to export traces to, or empty to disable
+	var ifacetype string               // Comma-separated list of VM interface types whose MACs are matched
+	var offlongerthan time.Duration    // Only start VMs that have been off for at least this long
 
-	flag.StringVar(&iface, "interface", "eth0", "Network interface name to listen on")
-	flag.StringVar(&libvirturi, "libvirturi", "qemu+tcp:///system", "URI to libvirt daemon, such as qemu:///system")
+	flag.StringVar(&iface, "interface", "eth0", "Network interface name to listen on, or a comma-separated list of names")
+	flag.StringVar(&libvirturi, "libvirturi", "qemu+tcp:///system", "URI to libvirt daemon, such as qemu:///system, or a comma-separated list of URIs to search in order")
+	flag.StringVar(&portlist, "ports", "7,9,0", "Comma-separated list of UDP ports to listen for WOL packets on")
+	flag.StringVar(&password, "password", "", "SecureOn password required in WOL packets, such as aa:bb:cc:dd:ee:ff")
+	flag.StringVar(&macpasswords, "mac-passwords", "", "Comma-separated list of per-MAC SecureOn passwords, such as 52:54:00:12:34:56=aa:bb:cc:dd:ee:ff")
+	flag.StringVar(&metricsaddr, "metrics-addr", "", "Address to serve Prometheus metrics and the wakeable domains on, such as :9099 (disabled if empty)")
+	flag.StringVar(&logformat, "log-format", "text", "Format of log output, text or json")
+	flag.StringVar(&loglevel, "log-level", "info", "Minimum level of log output: debug, info, warn, or error")
+	flag.StringVar(&configpath, "config", "", "Path to a YAML configuration file, whose settings are overridden by flags")
+	flag.BoolVar(&dryrun, "dry-run", false, "Log the VMs that would be woken, without actually waking them")
+	flag.StringVar(&allow, "allow", "", "Comma-separated list of MACs allowed to be woken (all MACs if empty)")
+	flag.StringVar(&pcapfile, "pcap-file", "", "Replay the packets in a pcap file instead of listening on an interface, then exit")
+	flag.StringVar(&webhookurl, "webhook-url", "", "URL to POST a JSON event to after waking a VM")
+	flag.DurationVar(&cooldown, "cooldown", 0, "How long to ignore repeated WOL packets for a MAC after handling one, such as 5s (disabled if 0)")
+	flag.DurationVar(&connecttimeout, "connect-timeout", 10*time.Second, "How long to wait for a connection to a libvirt daemon to open (forever if 0)")
+	flag.BoolVar(&vlan, "vlan", false, "Also listen for WOL packets carrying an 802.1Q VLAN tag")
+	flag.Float64Var(&ratelimit, "rate-limit", 0, "Most WOL packets per second to act on, dropping the rest, such as 5 (unlimited if 0)")
+	flag.IntVar(&vlanid, "vlan-id", 0, "Only listen for WOL packets carrying an 802.1Q VLAN tag with this ID, such as 20 (any tag or none if 0)")
+	flag.BoolVar(&namematch, "name-match", false, "If no domain has the packet's MAC, wake the domain named in the packet's name extension")
+	flag.IntVar(&wakeattempts, "wake-attempts", 3, "Number of times to try waking a VM when libvirt reports a transient error")
+	flag.DurationVar(&wakebackoff, "wake-backoff", 2*time.Second, "Delay before retrying a failed wake, doubled after each further failure")
+	flag.IntVar(&queuedepth, "queue-depth", 0, "Most wakes to hold while libvirt is unreachable, retrying them until it reconnects (disabled if 0)")
+	flag.BoolVar(&listinterfaces, "list-interfaces", false, "Print the network interfaces that can be listened on, then exit")
+	flag.BoolVar(&force, "force", false, "Start VMs even if their on_poweroff or on_crash policy is preserve")
+	flag.BoolVar(&autostartonly, "autostart-only", false, "Only wake VMs that have autostart enabled")
+	flag.IntVar(&snaplen, "snaplen", defaultSnaplen, "Most bytes of each packet to capture, which must be enough for a whole magic packet")
+	flag.StringVar(&bpf, "bpf", "", "PCAP filter expression to capture with, replacing the built-in filter and ignoring -ports and -vlan")
+	flag.BoolVar(&promiscuous, "promiscuous", false, "Put the interfaces in promiscuous mode, to see WOL frames sent to other MACs")
+	flag.BoolVar(&allowtransient, "allow-transient", false, "Also wake transient (undefined) VMs, rather than only persistent ones")
+	flag.DurationVar(&wakedelay, "wake-delay", 0, "How long after a WOL packet to wake its VM, such as 30s (immediately if 0)")
+	flag.StringVar(&mappingfile, "mapping-file", "", "Path to a file of MAC and VM name pairs, to look VMs up by name rather than searching every VM")
+	flag.DurationVar(&indexrefresh, "index-refresh", 60*time.Second, "How often to rebuild the index of VM MACs used to look VMs up by name (disabled if 0)")
+	flag.StringVar(&tlscert, "tls-cert", "", "Path to the client certificate for TLS connections to libvirt")
+	flag.StringVar(&tlskey, "tls-key", "", "Path to the client key for TLS connections to libvirt")
+	flag.StringVar(&tlscacert, "tls-cacert", "", "Path to the CA certificate for TLS connections to libvirt")
+	flag.StringVar(&sshkey, "ssh-key", "", "Path to the private key for SSH connections to libvirt, such as qemu+ssh://user@host/system")
+	flag.DurationVar(&waitrunning, "wait-running", 0, "How long to wait for a woken VM to be running before reporting success, such as 30s (don't wait if 0)")
+	flag.BoolVar(&usedhcpleases, "use-dhcp-leases", false, "If no VM is configured with the packet's MAC, wake the VM whose hostname holds a DHCP lease for it on a libvirt network")
+	flag.DurationVar(&statsinterval, "stats-interval", 0, "How often to log capture statistics, including dropped packets, such as 5m (disabled if 0)")
+	flag.BoolVar(&wakeall, "wake-all", false, "Wake every VM matching a WOL packet, on every libvirt host, rather than just the first")
+	flag.BoolVar(&checkperms, "check-perms", false, "Check whether packets can be captured on the interfaces, report the result, and exit")
+	flag.DurationVar(&offlongerthan, "off-longer-than", 0, "Only start a VM if it has been off for at least this long, such as 30s, so a stale packet doesn't restart one that just shut down (any VM if 0)")
+	flag.StringVar(&ifacetype, "iface-type", "", "Comma-separated list of VM interface types (<interface type='...'>) whose MACs are matched, such as bridge,network (any type if empty)")
+	flag.StringVar(&otelendpoint, "otel-endpoint", "", "URL of an OpenTelemetry collector to export traces of packet handling and wakes to over OTLP/HTTP, such as http://localhost:4318 (disabled if empty)")
+	flag.BoolVar(&showversion, "version", false, "Print the version of virtwold and the libraries it uses, then exit")
+	flag.BoolVar(&selftest, "selftest", false, "Check that magic packets are built and parsed correctly, without the network or libvirt, report the result, and exit")
+	flag.StringVar(&onunknown, "on-unknown", "", "Webhook URL to POST to, or command to run with the MAC as its argument, when a WOL packet matches no VM (disabled if empty)")
+	flag.StringVar(&controlsocket, "control-socket", "", "Path to a Unix domain socket answering the commands status, domains, and wake <mac> with JSON, such as /run/virtwold.sock (disabled if empty)")
+	flag.BoolVar(&rebootrunning, "reboot-running", false, "Reboot a VM matching a WOL packet if it's already running, like pressing its reset button")
+	flag.StringVar(&includename, "include-name", "", "Only wake VMs with names matching this regular expression, such as ^lab- (any name if empty)")
+	flag.StringVar(&excludename, "exclude-name", "", "Never wake VMs with names matching this regular expression, such as -template$ (none if empty)")
+	flag.BoolVar(&ignorelocal, "ignore-local", false, "Ignore WOL packets sent from this host's own interfaces, such as by virtwold send")
+	flag.StringVar(&capturebackend, "capture-backend", "pcap", "How to capture packets, pcap or afpacket (Linux only, lower overhead on busy networks)")
+	flag.BoolVar(&readonly, "readonly", false, "Connect to libvirt read-only, for diagnosing which VMs would be matched without being able to wake any")
+	flag.DurationVar(&verifynetwork, "verify-network", 0, "How long to wait for a woken VM to reply to pings at its DHCP leased address, such as 60s (don't check if 0)")
+	flag.DurationVar(&waitforinterface, "wait-for-interface", 0, "How long to wait for the interfaces to appear at startup, such as 60s (fail at once if 0)")
 	flag.Parse()
 
-	if !deviceExists(iface) {
-		log.Fatalf("Unable to open device: %s", iface)
+	if showversion {
+		printVersion(os.Stdout)
+		return nil
+	}
+
+	if listinterfaces {
+		printDevices(os.Stdout, findDevices())
+		return nil
 	}
 
-	handler, err := pcap.OpenLive(iface, buffer, false, pcap.BlockForever)
+	if selftest {
+		if err := selfTest(); err != nil {
+			return fmt.Errorf("Self-test failed: %w", err)
+		}
+		fmt.Println("Self-test passed")
+		return nil
+	}
+
+	sources, config, err := resolveConfig(flag.CommandLine, configpath)
 	if err != nil {
-		log.Fatalf("failed to open device: %v", err)
+		return fmt.Errorf("Unable to load configuration: %w", err)
 	}
-	defer handler.Close()
 
-	if err := handler.SetBPFFilter(filter); err != nil {
-		log.Fatalf("Something in the BPF went wrong!: %v", err)
+	logger, err := newLogger(logformat, loglevel, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("Invalid logging configuration: %w", err)
+	}
+	slog.SetDefault(logger)
+
+	passwords, err := parsePasswordConfig(password, macpasswords)
+	if err != nil {
+		return fmt.Errorf("Invalid password configuration from %s (%s): %w", sources["password"], precedence, err)
 	}
 
-	// Handle every packet received, looping forever
-	source := gopacket.NewPacketSource(handler, handler.LinkType())
-	for packet := range source.Packets() {
-		// Called for each packet received
-		fmt.Printf("Received WOL packet, ")
-		mac, err := GrabMACAddr(packet)
+	allowed, err := parseAllowlist(allow)
+	if err != nil {
+		return fmt.Errorf("Invalid allowlist from %s (%s): %w", sources["allow"], precedence, err)
+	}
+
+	if cooldown, err = effectiveCooldown(cooldown, rebootrunning, sources["cooldown"]); err != nil {
+		return err
+	}
+
+	var mappings map[string]string
+	if mappingfile != "" {
+		mappings, err = LoadMappingFile(mappingfile)
 		if err != nil {
-			log.Fatalf("Error with packet: %v", err)
+			return fmt.Errorf("Invalid mapping file: %w", err)
 		}
-		WakeVirtualMachine(mac, libvirturi)
 	}
-}
 
-// Return the first MAC address seen in the WOL packet
-func GrabMACAddr(packet gopacket.Packet) (string, error) {
-	app := packet.ApplicationLayer()
-	if app != nil {
-		payload := app.Payload()
-		mac := fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", payload[12], payload[13], payload[14], payload[15], payload[16], payload[17])
-		fmt.Printf("found MAC: %s\n", mac)
-		return mac, nil
+	ports, err := parsePorts(portlist)
+	if err != nil {
+		return fmt.Errorf("Invalid port list from %s (%s): %w", sources["ports"], precedence, err)
 	}
-	return "", errors.New("no MAC found in packet")
-}
 
-func WakeVirtualMachine(mac string, libvirturi string) bool {
-	// Connect to the local libvirt socket
-	connection, err := libvirt.NewConnect(libvirturi)
-	if err != nil {
-		log.Fatalf("failed to connect: %v", err)
+	if err := checkSnaplen(snaplen); err != nil {
+		return err
 	}
-	defer connection.Close()
 
-	// Get a list of all inactive VMs (aka Domains) configured so we can loop through them
-	domains, err := connection.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_INACTIVE)
+	if ratelimit < 0 {
+		return fmt.Errorf("Invalid rate limit %v, must not be negative", ratelimit)
+	}
+
+	// PCAP filter to catch UDP and raw Ethernet WOL packets, unless overridden for unusual networks
+	if vlanid < 0 || vlanid > maxVLANID {
+		return fmt.Errorf("Invalid VLAN ID %d, must be between 0 and %d", vlanid, maxVLANID)
+	}
+	filter, err := buildBPFFilter(ports, vlan, vlanid, namematch)
 	if err != nil {
-		log.Fatalf("failed to retrieve domains: %v", err)
+		return fmt.Errorf("Unable to build BPF filter: %w", err)
+	}
+	if filter, err = chooseFilter(filter, bpf, snaplen); err != nil {
+		return err
 	}
 
-	for _, domain := range domains {
-		// Now we get the XML Description for each domain
-		xmldesc, err := domain.GetXMLDesc(0)
+	if capturebackend != "pcap" && capturebackend != "afpacket" {
+		return fmt.Errorf("Invalid capture backend %q, must be pcap or afpacket", capturebackend)
+	}
+	if capturebackend == "afpacket" && promiscuous {
+		slog.Warn("The afpacket capture backend doesn't support promiscuous mode, ignoring -promiscuous", "event", "promiscuous_ignored")
+	}
+
+	// Without a configuration file there are no per-interface profiles or targets
+	if config == nil {
+		config = &Config{}
+	}
+	profiles := config.profileMap()
+
+	// Opening the capture is what needs privileges, so trying it is the surest check
+	if checkperms {
+		handles, err := openInterfaces(iface, capturebackend, int32(snaplen), promiscuous, filter, profiles, 0)
 		if err != nil {
-			log.Fatalf("failed retrieving XML: %v", err)
+			return fmt.Errorf("Unable to capture packets: %w", err)
+		}
+		for _, handle := range handles {
+			fmt.Printf("Able to capture packets on %s\n", handle.name)
+			handle.Close()
 		}
+		return nil
+	}
 
-		// Get the details for each domain
-		domcfg := &libvirtxml.Domain{}
-		err = domcfg.Unmarshal(xmldesc)
+	// Open the capture handles, either replaying a pcap file or listening live on the interfaces
+	var handles []captureHandle
+	if pcapfile != "" {
+		handler, err := openReplay(pcapfile, filter)
 		if err != nil {
-			log.Fatalf("failed retrieving domain configuration: %v", err)
+			return err
 		}
+		handles = append(handles, handler)
+	} else {
+		slog.Info("Capturing packets", "event", "capture_started", "interface", iface, "backend", capturebackend, "snaplen", snaplen, "promiscuous", promiscuous)
+		handles, err = openInterfaces(iface, capturebackend, int32(snaplen), promiscuous, filter, profiles, waitforinterface)
+		if err != nil {
+			return fmt.Errorf("%w (interface from %s)", err, sources["interface"])
+		}
+	}
+	for _, handler := range handles {
+		defer handler.Close()
+	}
+
+	// Stop cleanly on SIGINT or SIGTERM, such as from systemd stopping the service
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if otelendpoint != "" {
+		shutdown, err := setUpTracing(ctx, otelendpoint)
+		if err != nil {
+			return fmt.Errorf("Unable to set up tracing: %w", err)
+		}
+		// Flush the last spans on the way out, without holding up shutdown for long
+		defer func() {
+			flushCtx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+			defer cancel()
+			if err := shutdown(flushCtx); err != nil {
+				slog.Warn("Failed to flush traces", "event", "tracing_flush_failed", "error", err)
+			}
+		}()
+		slog.Info("Exporting traces", "event", "tracing_enabled", "endpoint", otelendpoint)
+	}
 
-		// Loop through each interface found
-		for _, iface := range domcfg.Devices.Interfaces {
-			domainmac := iface.MAC.Address
+	uris := splitList(libvirturi)
+	if tlscert != "" || tlskey != "" || tlscacert != "" {
+		pkipath, err := tlsPKIPath(tlscert, tlskey, tlscacert)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(pkipath)
 
-			if domainmac == mac {
-				// We'll use the name later, so may as well get it here
-				name := domcfg.Name
+		uris, err = withURIParam(uris, "tls", "pkipath", pkipath)
+		if err != nil {
+			return err
+		}
+	}
 
-				// Get the state of the VM and take action
-				state, _, err := domain.GetState()
+	if sshkey != "" {
+		if _, err := os.Stat(sshkey); err != nil {
+			return fmt.Errorf("Unable to use SSH key: %w", err)
+		}
+		uris, err = withURIParam(uris, "ssh", "keyfile", sshkey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Connect to libvirt once, and reuse the connections for every packet
+	waker, err := NewWaker(uris, connecttimeout, readonly, passwords)
+	if err != nil {
+		return fmt.Errorf("failed to connect to libvirt URI from %s: %w", sources["libvirturi"], err)
+	}
+	defer waker.Close()
+	waker.dryRun = dryrun
+	waker.webhookURL = webhookurl
+	waker.cooldown = cooldown
+	waker.nameMatch = namematch
+	waker.attempts = wakeattempts
+	waker.backoff = wakebackoff
+	waker.queueDepth = queuedepth
+	waker.force = force
+	waker.autostart = autostartonly
+	waker.transient = allowtransient
+	waker.wakeDelay = wakedelay
+	waker.mappings = mappings
+	waker.SetConfigRules(config)
+	waker.waitRunning = waitrunning
+	waker.wakeAll = wakeall
+	waker.useLeases = usedhcpleases
+	waker.verifyNetwork = verifynetwork
+	waker.rebootRunning = rebootrunning
+	ifacetypes, err := parseInterfaceTypes(ifacetype)
+	if err != nil {
+		return fmt.Errorf("Invalid -iface-type: %w", err)
+	}
+	waker.SetInterfaceTypes(ifacetypes)
+	waker.onUnknown = onunknown
+	if includename != "" {
+		if waker.includeName, err = regexp.Compile(includename); err != nil {
+			return fmt.Errorf("Invalid -include-name %q: %w", includename, err)
+		}
+	}
+	if excludename != "" {
+		if waker.excludeName, err = regexp.Compile(excludename); err != nil {
+			return fmt.Errorf("Invalid -exclude-name %q: %w", excludename, err)
+		}
+	}
+	if offlongerthan > 0 {
+		waker.offLongerThan = offlongerthan
+		waker.running = newRunningTracker()
+		go waker.watchRunning(ctx, runningPollInterval)
+	}
+	if indexrefresh > 0 {
+		waker.useIndex = true
+		go waker.refreshIndexes(ctx, indexrefresh)
+	}
+	if queuedepth > 0 {
+		go waker.drainQueue(ctx)
+	}
+
+	if statsinterval > 0 && pcapfile == "" {
+		go reportStats(ctx, handles, statsinterval)
+	}
+
+	listener := NewListener(allowed, waker.WakeVirtualMachine)
+	listener.vlanID = vlanid
+	if ratelimit > 0 {
+		listener.limiter = newRateLimiter(ratelimit)
+	}
+	if ignorelocal {
+		if listener.local, err = localMACs(); err != nil {
+			return fmt.Errorf("Unable to list the local interfaces: %w", err)
+		}
+	}
+	if metricsaddr != "" {
+		serveHTTP(ctx, metricsaddr, waker, listener)
+	}
+	if controlsocket != "" {
+		if err := serveControl(ctx, controlsocket, waker, listener); err != nil {
+			return err
+		}
+	}
+	if configpath != "" {
+		reloadOnHangup(ctx, flag.CommandLine, configpath, sources, config, waker, listener)
+	}
+	notifyReady(ctx, listener.Alive)
+
+	// Handle every packet received on any interface until asked to stop
+	// Returning runs the deferred closes of the pcap handles and libvirt connection
+	if err := listener.Run(ctx, mergePackets(ctx, handles)); errors.Is(err, errSourceClosed) && pcapfile != "" {
+		slog.Info("Finished replaying packets", "event", "replay_finished", "file", pcapfile)
+	} else if err != nil {
+		slog.Error("Stopped listening", "event", "listen_failed", "error", err)
+		return fmt.Errorf("%w: %w", errStoppedListening, err)
+	}
+	return nil
+}
+
+// Reload the configuration file on each SIGHUP until the context is cancelled, keeping the capture handles
+// and libvirt connections open
+// If the reloaded configuration is invalid, the current settings are kept
+func reloadOnHangup(ctx context.Context, fs *flag.FlagSet, configpath string, sources map[string]string, config *Config, waker *Waker, listener *Listener) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-hangups:
+				passwords, allowed, reloaded, err := reloadConfig(fs, configpath, sources)
 				if err != nil {
-					log.Fatalf("failed to check domain state: %v", err)
+					slog.Error("Failed to reload configuration, keeping the current settings", "event", "reload_failed", "file", configpath, "error", err)
+					continue
+				}
+				// Profiles are only applied when the capture handles are opened
+				if !reflect.DeepEqual(reloaded.Profiles, config.Profiles) {
+					slog.Warn("Setting changed in configuration file, restart needed to apply it", "event", "restart_needed", "setting", "profiles")
 				}
+				waker.SetPasswords(passwords)
+				waker.SetConfigRules(reloaded)
+				listener.SetAllowlist(allowed)
+				config = reloaded
+				slog.Info("Reloaded configuration", "event", "reloaded", "file", configpath)
+			}
+		}
+	}()
+}
 
-				// Print an informative message about the state of things
-				switch state {
-				case libvirt.DOMAIN_SHUTDOWN, libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_CRASHED:
-					fmt.Printf("Waking system: %s at MAC %s\n", name, mac)
+// Open a capture handle on each of the comma-separated interfaces
+// The special "any" interface listens on every non-loopback device, skipping devices that can't be
+// captured on rather than failing
+// Interfaces that don't exist yet, such as a bridge libvirt hasn't created, are waited for up to wait
+// If a capture later fails, it's reopened without disturbing the others
+// Interfaces with a profile are captured with its snaplen and filter in place of the global ones
+func openInterfaces(iface string, backend string, snaplen int32, promiscuous bool, filter string, profiles map[string]Profile, wait time.Duration) ([]captureHandle, error) {
+	anyDevice := iface == "any"
 
-				case libvirt.DOMAIN_PMSUSPENDED:
-					fmt.Printf("Unsuspending system: %s at MAC %s\n", name, mac)
+	ifaces := splitList(iface)
+	if anyDevice {
+		ifaces = captureDevices()
+	} else if len(ifaces) == 0 {
+		ifaces = []string{iface}
+	}
 
-				case libvirt.DOMAIN_PAUSED:
-					fmt.Printf("Resuming system: %s at MAC %s\n", name, mac)
+	if wait > 0 && !anyDevice && iface != "" {
+		waitForDevices(ifaces, wait)
+	}
 
-				default:
-				}
+	for _, name := range ifaces {
+		if err := checkDevice(name); err != nil {
+			return nil, fmt.Errorf("Unable to open device: %w", err)
+		}
+	}
 
-				// Try and start the VM
-				err = domain.Create()
-				if err != nil {
-					fmt.Printf("System is already running or in a state that cannot be woken from. State: %d\n", state)
+	var handles []captureHandle
+	for _, name := range ifaces {
+		name, snaplen, filter := name, snaplen, filter
+		if profile, ok := profiles[name]; ok {
+			if profile.Snaplen != 0 {
+				snaplen = int32(profile.Snaplen)
+			}
+			if profile.Filter != "" {
+				filter = profile.Filter
+			}
+			slog.Info("Using capture profile", "event", "capture_profile", "device", name, "snaplen", snaplen, "filter", filter)
+		}
+
+		handler, err := openDevice(name, backend, snaplen, promiscuous, filter)
+		if err != nil {
+			if anyDevice {
+				slog.Warn("Skipping device", "event", "device_skipped", "device", name, "error", err)
+				continue
+			}
+			for _, handle := range handles {
+				handle.Close()
+			}
+			return nil, err
+		}
+		reopen := func() (packetHandle, error) {
+			return openDevice(name, backend, snaplen, promiscuous, filter)
+		}
+		handles = append(handles, captureHandle{packetHandle: newReopeningHandle(name, handler, reopen), name: name})
+	}
+
+	if len(handles) == 0 {
+		return nil, errors.New("Unable to open any device to listen on")
+	}
+
+	return handles, nil
+}
+
+// Open a pcap file to replay the WOL packets captured in it, filtering as for a live capture
+func openReplay(path string, filter string) (captureHandle, error) {
+	handler, err := pcap.OpenOffline(path)
+	if err != nil {
+		return captureHandle{}, fmt.Errorf("failed to open pcap file %s: %w", path, err)
+	}
+
+	if err := handler.SetBPFFilter(filter); err != nil {
+		handler.Close()
+		return captureHandle{}, fmt.Errorf("Something in the BPF went wrong on %s!: %w", path, err)
+	}
+
+	return captureHandle{packetHandle: handler, name: path}, nil
+}
+
+// An open capture, through libpcap or AF_PACKET
+type packetHandle interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	Stats() (*pcap.Stats, error)
+	Close()
+}
+
+// A capture handle, along with the name of the device (or file) it captures from
+type captureHandle struct {
+	packetHandle
+	name string // Name of the device or pcap file
+}
+
+// Opens a live capture handle, replaceable so the capture settings can be checked without a real device
+var openLive = pcap.OpenLive
+
+// Opens a capture on a device, replaceable so the settings each device is opened with can be checked without one
+var openDevice = openCapture
+
+// Open a capture handle on the named device with the backend, filtering for WOL packets
+func openCapture(name string, backend string, snaplen int32, promiscuous bool, filter string) (packetHandle, error) {
+	if backend == "afpacket" {
+		handler, err := openAFPacket(name, snaplen, filter)
+		if err != nil {
+			return nil, permissionHint(err)
+		}
+		return handler, nil
+	}
+
+	handler, err := openLive(name, snaplen, promiscuous, captureTimeout)
+	if err != nil {
+		return nil, permissionHint(fmt.Errorf("failed to open device %s: %w", name, err))
+	}
+
+	if err := handler.SetBPFFilter(filter); err != nil {
+		handler.Close()
+		return nil, fmt.Errorf("Something in the BPF went wrong on %s!: %w", name, err)
+	}
+
+	return handler, nil
+}
+
+// Add a hint on how to get the privileges needed to capture to an error opening a capture, if it was for lack of them
+func permissionHint(err error) error {
+	msg := strings.ToLower(err.Error())
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || strings.Contains(msg, "permission") || strings.Contains(msg, "operation not permitted") {
+		return fmt.Errorf("%w (capturing needs root or the CAP_NET_RAW capability, e.g. setcap cap_net_raw,cap_net_admin+ep /usr/bin/virtwold)", err)
+	}
+	return err
+}
+
+// Fan the packets captured on every handle into a single channel
+// The channel is closed once every handle has stopped delivering packets, or the context is cancelled
+func mergePackets(ctx context.Context, handles []captureHandle) packetChan {
+	packets := make(packetChan)
+
+	var wg sync.WaitGroup
+	for _, handle := range handles {
+		wg.Add(1)
+		go func(handle captureHandle) {
+			defer wg.Done()
+			// The packets from every handle end up on one channel, so note which interface each arrived on
+			// The index is looked up for each packet, since it changes if the device is recreated
+			source := gopacket.NewPacketSource(handle, handle.LinkType())
+			for packet := range source.Packets() {
+				if iface, err := net.InterfaceByName(handle.name); err == nil {
+					packet.Metadata().InterfaceIndex = iface.Index
+				}
+				select {
+				case packets <- packet:
+				case <-ctx.Done():
+					return
 				}
 			}
+		}(handle)
+	}
+
+	go func() {
+		wg.Wait()
+		close(packets)
+	}()
+
+	return packets
+}
+
+// Return the custom filter if one is given, or otherwise the built-in one, checking that it compiles
+func chooseFilter(builtin string, custom string, snaplen int) (string, error) {
+	if custom != "" {
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, custom); err != nil {
+			return "", fmt.Errorf("Invalid BPF filter %q: %w", custom, err)
 		}
+		slog.Info("Using custom BPF filter", "event", "custom_bpf", "filter", custom)
+		return custom, nil
+	}
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, builtin); err != nil {
+		return "", fmt.Errorf("Generated BPF filter %q does not compile: %w", builtin, err)
 	}
+	return builtin, nil
+}
+
+// Check the snaplen is long enough to capture a whole magic packet, and fits in what pcap accepts
+func checkSnaplen(snaplen int) error {
+	if snaplen < virtwold.MinSize {
+		return fmt.Errorf("snaplen %d is too small to capture a %d byte magic packet", snaplen, virtwold.MinSize)
+	}
+	if snaplen > math.MaxInt32 {
+		return fmt.Errorf("snaplen %d is too large", snaplen)
+	}
+	return nil
+}
 
-	return true
+// Split a comma-separated list, dropping empty entries and surrounding whitespace
+func splitList(list string) []string {
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
 }
 
-// Check if the network device exists
-func deviceExists(interfacename string) bool {
+// Return the cooldown to use, given the one from source and whether running VMs are rebooted
+// Senders repeat a packet for a while, and each repeat would reboot the VM again, so rebooting needs a cooldown:
+// one is used if none was given, and explicitly disabling it is an error
+func effectiveCooldown(cooldown time.Duration, reboot bool, source string) (time.Duration, error) {
+	if !reboot || cooldown > 0 {
+		return cooldown, nil
+	}
+	if source != "default" {
+		return 0, fmt.Errorf("-reboot-running needs a non-zero -cooldown (%s from %s), or repeated packets would reboot VMs over and over", cooldown, source)
+	}
+	slog.Info("Using a cooldown so repeated packets don't reboot VMs again", "event", "reboot_cooldown", "cooldown", rebootCooldown)
+	return rebootCooldown, nil
+}
+
+// Parse a comma-separated list of VM interface types, such as "bridge,network"
+// Returns an empty set, matching any type, for an empty list
+func parseInterfaceTypes(list string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, name := range splitList(list) {
+		if !slices.Contains(virtwold.InterfaceTypes, name) {
+			return nil, fmt.Errorf("unknown interface type %q, must be one of %s", name, strings.Join(virtwold.InterfaceTypes, ", "))
+		}
+		types[name] = true
+	}
+	return types, nil
+}
+
+// Parse a comma-separated list of UDP ports, such as "7,9,0"
+func parsePorts(portlist string) ([]int, error) {
+	var ports []int
+	for _, field := range splitList(portlist) {
+		port, err := strconv.Atoi(field)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port: %q", field)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// Build the PCAP filter matching UDP WOL packets sent to any of the given ports, plus raw Ethernet WOL frames
+// If vlan is set, the same packets carrying an 802.1Q VLAN tag are matched too
+// If vlanID is set, only the packets carrying an 802.1Q VLAN tag with that ID are matched
+// If named is set, longer UDP packets are matched too, since they may carry a domain name extension
+// Duplicate ports are only included once
+func buildBPFFilter(ports []int, vlan bool, vlanID int, named bool) (string, error) {
+	if len(ports) == 0 {
+		return "", errors.New("no ports specified")
+	}
+
+	seen := make(map[int]bool)
+	var portexprs []string
+	for _, port := range ports {
+		if seen[port] {
+			continue
+		}
+		seen[port] = true
+		portexprs = append(portexprs, fmt.Sprintf("dst port %d", port))
+	}
+
+	portexpr := strings.Join(portexprs, " or ")
+	if vlanID != 0 {
+		return fmt.Sprintf("vlan %d and (%s)", vlanID, wolFilter(portexpr, vlanTagSize, named)), nil
+	}
+	filter := wolFilter(portexpr, 0, named)
+	if vlan {
+		// The vlan keyword makes the rest of the expression look past the tag, which also makes the packet longer
+		filter = fmt.Sprintf("%s or (vlan and (%s))", filter, wolFilter(portexpr, vlanTagSize, named))
+	}
+
+	return filter, nil
+}
+
+// Build the PCAP filter matching IPv4 and IPv6 UDP WOL packets to the ports in portexpr, plus raw Ethernet WOL frames
+// The lengths of the UDP WOL packets are increased by extra, to allow for additional headers such as a VLAN tag
+// If named is set, any UDP packet at least as long as a WOL packet is matched, rather than only the usual lengths
+// IPv6 packets aren't restricted by destination, so those sent to a multicast group like ff02::1 are captured too
+func wolFilter(portexpr string, extra int, named bool) string {
+	return fmt.Sprintf("(udp and (%s) and ((ip and broadcast and (%s)) or (ip6 and (%s)))) or ether proto 0x0842",
+		portexpr, lengthFilter(extra, named), lengthFilter(extra+ipv6ExtraSize, named))
+}
+
+// Build the PCAP filter matching the lengths of UDP WOL packets, increased by extra
+// Every length from the shortest to the longest is matched, so packets with a few bytes before the sync stream
+// or zero padding after the magic packet are captured too
+func lengthFilter(extra int, named bool) string {
+	shortest, longest := wolFrameSizes()
+	if named {
+		return fmt.Sprintf("len >= %d", shortest+extra)
+	}
+	return fmt.Sprintf("len >= %d and len <= %d", shortest+extra, longest+extra)
+}
+
+// Return the shortest and longest frame lengths of UDP WOL packets over IPv4
+// The shortest carries a bare magic packet, and the longest one starting MaxOffset bytes into the payload,
+// followed by a SecureOn password, the UUID extension, and maxPaddingSize bytes of zero padding
+// The name extension has no fixed length, so packets carrying one may be longer
+func wolFrameSizes() (int, int) {
+	shortest := udpOverheadSize + virtwold.MinSize
+	longest := shortest + virtwold.MaxOffset + virtwold.PasswordSize + len(virtwold.UUIDPrefix) + virtwold.UUIDSize + maxPaddingSize
+	return shortest, longest
+}
+
+// MACs allowed to be woken, or empty to allow every MAC
+type allowlist map[string]bool
+
+// Parse a comma-separated list of MACs allowed to be woken
+func parseAllowlist(list string) (allowlist, error) {
+	allowed := make(allowlist)
+	for _, mac := range splitList(list) {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC: %q", mac)
+		}
+		allowed[hwaddr.String()] = true
+	}
+	return allowed, nil
+}
+
+// Check whether the MAC is allowed to be woken
+func (a allowlist) isAllowed(mac string) bool {
+	return len(a) == 0 || a[virtwold.NormalizeMAC(mac)]
+}
+
+// SecureOn passwords required to wake VMs
+type passwordConfig struct {
+	global []byte            // Password required for any MAC without its own password
+	perMAC map[string][]byte // Passwords for specific MACs, keyed by MAC address
+}
+
+// Parse the global SecureOn password and the comma-separated list of mac=password pairs
+func parsePasswordConfig(password string, macpasswords string) (passwordConfig, error) {
+	config := passwordConfig{perMAC: make(map[string][]byte)}
+
+	if password != "" {
+		pw, err := parsePassword(password)
+		if err != nil {
+			return config, err
+		}
+		config.global = pw
+	}
+
+	for _, entry := range splitList(macpasswords) {
+		mac, pwstr, found := strings.Cut(entry, "=")
+		if !found {
+			return config, fmt.Errorf("invalid MAC password entry, expected mac=password: %q", entry)
+		}
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return config, fmt.Errorf("invalid MAC in password entry: %q", mac)
+		}
+		pw, err := parsePassword(pwstr)
+		if err != nil {
+			return config, err
+		}
+		config.perMAC[hwaddr.String()] = pw
+	}
+
+	return config, nil
+}
+
+// Parse a SecureOn password written as 6 hex bytes, such as aa:bb:cc:dd:ee:ff or aabbccddeeff,
+// or as 6 ASCII characters, such as s3cr3t, which is how some WOL tools present it
+func parsePassword(password string) ([]byte, error) {
+	if pw, err := net.ParseMAC(password); err == nil && len(pw) == virtwold.PasswordSize {
+		return pw, nil
+	}
+	if pw, err := hex.DecodeString(password); err == nil && len(pw) == virtwold.PasswordSize {
+		return pw, nil
+	}
+	if len(password) == virtwold.PasswordSize {
+		return []byte(password), nil
+	}
+	return nil, fmt.Errorf("invalid SecureOn password, expected 6 hex bytes or 6 ASCII characters: %q", password)
+}
+
+// Check the SecureOn password of a magic packet against the one configured for its MAC
+// If no password is configured for the MAC, any packet is accepted
+func (p passwordConfig) check(wol *virtwold.MagicPacket) error {
+	expected, ok := p.perMAC[wol.MAC]
+	if !ok {
+		expected = p.global
+	}
+	if expected == nil {
+		return nil
+	}
+	if wol.Password == nil {
+		return fmt.Errorf("missing SecureOn password for MAC %s", wol.MAC)
+	}
+	if !bytes.Equal(wol.Password, expected) {
+		return fmt.Errorf("wrong SecureOn password for MAC %s", wol.MAC)
+	}
+	return nil
+}
+
+// Lists the network devices, replaceable so device checks can run without real devices
+var findAllDevs = pcap.FindAllDevs
+
+// Check if the network device exists, returning an error naming the valid devices if it doesn't
+// The special "any" device always exists
+func checkDevice(interfacename string) error {
 	if interfacename == "" {
 		fmt.Printf("No interface to listen on specified\n\n")
 		flag.PrintDefaults()
-		return false
+		return errors.New("no interface specified")
+	}
+	if interfacename == "any" {
+		return nil
+	}
+
+	devices := findDevices()
+	for _, device := range devices {
+		if device.Name == interfacename {
+			return nil
+		}
 	}
-	devices, err := pcap.FindAllDevs()
+	return fmt.Errorf("%s not found (valid devices: %s)", interfacename, strings.Join(deviceNames(devices), ", "))
+}
+
+// Wait until every named device exists, or until timeout has passed
+func waitForDevices(names []string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var missing []string
+		for _, name := range names {
+			if checkDevice(name) != nil {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) == 0 || time.Now().After(deadline) {
+			return
+		}
 
+		slog.Info("Waiting for devices to appear", "event", "device_wait", "devices", missing)
+		time.Sleep(deviceWaitInterval)
+	}
+}
+
+// Return the (normalized) MACs of the host's own network interfaces, as of startup
+func localMACs() (map[string]bool, error) {
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
+	macs := make(map[string]bool)
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) != 0 {
+			macs[virtwold.NormalizeMAC(iface.HardwareAddr.String())] = true
+		}
+	}
+	return macs, nil
+}
+
+// Return the names of all non-loopback network devices, used when listening on "any"
+func captureDevices() []string {
+	var names []string
+	for _, device := range findDevices() {
+		if device.Flags&pcapIfLoopback != 0 || device.Name == "any" {
+			continue
+		}
+		names = append(names, device.Name)
+	}
+	return names
+}
+
+// Return the names of the network devices
+func deviceNames(devices []pcap.Interface) []string {
+	var names []string
 	for _, device := range devices {
-		if device.Name == interfacename {
-			return true
+		names = append(names, device.Name)
+	}
+	return names
+}
+
+// Return all the network devices pcap can listen on
+func findDevices() []pcap.Interface {
+	devices, err := findAllDevs()
+	if err != nil {
+		log.Panic(err)
+	}
+	return devices
+}
+
+// Print a numbered list of the devices, with their descriptions and addresses, in the style of tcpdump -D
+func printDevices(w io.Writer, devices []pcap.Interface) {
+	for i, device := range devices {
+		fmt.Fprintf(w, "%d.%s", i+1, device.Name)
+		if device.Description != "" {
+			fmt.Fprintf(w, " (%s)", device.Description)
+		}
+		if device.Flags&pcapIfLoopback != 0 {
+			fmt.Fprint(w, " [Loopback]")
+		}
+		fmt.Fprintln(w)
+
+		for _, address := range device.Addresses {
+			fmt.Fprintf(w, "\t%s\n", address.IP)
 		}
 	}
-	return false
 }
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildBPFFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		ports    []int
+		wantPort string
+		wantErr  bool
+	}{
+		{"default ports", []int{7, 9, 0}, "(dst port 7 or dst port 9 or dst port 0)", false},
+		{"single port", []int{9}, "(dst port 9)", false},
+		{"duplicate ports", []int{9, 7, 9, 7}, "(dst port 9 or dst port 7)", false},
+		{"empty list", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildBPFFilter(tt.ports, false, 0, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildBPFFilter() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !strings.Contains(filter, "udp and "+tt.wantPort+" and ") {
+				t.Errorf("buildBPFFilter() = %q, want ports %q", filter, tt.wantPort)
+			}
+			if !strings.HasSuffix(filter, " or ether proto 0x0842") {
+				t.Errorf("buildBPFFilter() = %q, doesn't match raw Ethernet WOL frames", filter)
+			}
+		})
+	}
+}
+
+func TestBuildBPFFilterExact(t *testing.T) {
+	filter, err := buildBPFFilter([]int{9}, false, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(udp and (dst port 9) and ((ip and broadcast and (len >= 144 and len <= 251))" +
+		" or (ip6 and (len >= 164 and len <= 271)))) or ether proto 0x0842"
+	if filter != want {
+		t.Errorf("buildBPFFilter() = %q, want %q", filter, want)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []int
+		wantErr bool
+	}{
+		{"7,9,0", []int{7, 9, 0}, false},
+		{"9", []int{9}, false},
+		{" 7 , 9 ", []int{7, 9}, false},
+		{"", nil, false},
+		{"9,x", nil, true},
+		{"65536", nil, true},
+		{"-1", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			ports, err := parsePorts(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePorts(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			}
+			if !slices.Equal(ports, tt.want) {
+				t.Errorf("parsePorts(%q) = %v, want %v", tt.list, ports, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordCheck(t *testing.T) {
+	passwords, err := parsePasswordConfig("aa:bb:cc:dd:ee:ff", "52:54:00:ab:cd:ef=73:33:63:72:33:74")
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	tests := []struct {
+		name    string
+		config  passwordConfig
+		wol     *virtwold.MagicPacket
+		wantErr string
+	}{
+		{"correct password", passwords, &virtwold.MagicPacket{MAC: "52:54:00:12:34:56", Password: global}, ""},
+		{"wrong password", passwords, &virtwold.MagicPacket{MAC: "52:54:00:12:34:56", Password: []byte("s3cr3t")}, "wrong SecureOn password"},
+		{"missing password", passwords, &virtwold.MagicPacket{MAC: "52:54:00:12:34:56"}, "missing SecureOn password"},
+		{"per-MAC password", passwords, &virtwold.MagicPacket{MAC: "52:54:00:ab:cd:ef", Password: []byte("s3cr3t")}, ""},
+		{"global password for MAC with its own", passwords, &virtwold.MagicPacket{MAC: "52:54:00:ab:cd:ef", Password: global}, "wrong SecureOn password"},
+		{"no password configured", passwordConfig{}, &virtwold.MagicPacket{MAC: "52:54:00:12:34:56"}, ""},
+		{"unneeded password", passwordConfig{}, &virtwold.MagicPacket{MAC: "52:54:00:12:34:56", Password: global}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.check(tt.wol)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("check() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow string
+		mac   string
+		want  bool
+	}{
+		{"empty allows all", "", "52:54:00:12:34:56", true},
+		{"listed", "52:54:00:12:34:56,52:54:00:ab:cd:ef", "52:54:00:ab:cd:ef", true},
+		{"listed in another style", "52-54-00-AB-CD-EF", "52:54:00:ab:cd:ef", true},
+		{"packet in another style", "52:54:00:ab:cd:ef", "52:54:00:AB:CD:EF", true},
+		{"not listed", "52:54:00:12:34:56", "52:54:00:ab:cd:ef", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := parseAllowlist(tt.allow)
+			if err != nil {
+				t.Fatalf("parseAllowlist(%q) error = %v", tt.allow, err)
+			}
+			if got := allowed.isAllowed(tt.mac); got != tt.want {
+				t.Errorf("isAllowed(%q) = %t, want %t", tt.mac, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAllowlistInvalid(t *testing.T) {
+	if _, err := parseAllowlist("52:54:00:12:34:56,nonsense"); err == nil {
+		t.Error("parseAllowlist() with an invalid MAC succeeded, want an error")
+	}
+}
+
+func TestBuildBPFFilterVLAN(t *testing.T) {
+	plain, err := buildBPFFilter([]int{9}, false, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := buildBPFFilter([]int{9}, true, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Untagged packets still match, with tagged ones allowed 4 more bytes for the tag
+	if !strings.HasPrefix(filter, plain+" or (vlan and (") {
+		t.Errorf("buildBPFFilter() with vlan = %q, want the untagged filter %q or a vlan filter", filter, plain)
+	}
+	if !strings.Contains(filter, "len >= 148 and len <= 255") {
+		t.Errorf("buildBPFFilter() with vlan = %q, doesn't allow for the tag in the lengths", filter)
+	}
+}
+
+func TestCheckSnaplen(t *testing.T) {
+	tests := []struct {
+		snaplen int
+		wantErr string
+	}{
+		{1600, ""},
+		{102, ""},
+		{101, "snaplen 101 is too small to capture a 102 byte magic packet"},
+		{0, "snaplen 0 is too small to capture a 102 byte magic packet"},
+		{1 << 31, "snaplen 2147483648 is too large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.snaplen), func(t *testing.T) {
+			err := checkSnaplen(tt.snaplen)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkSnaplen(%d) = %v, want nil", tt.snaplen, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("checkSnaplen(%d) = %v, want %q", tt.snaplen, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Skip the test if libpcap can't compile filters, as with a stub library
+func requireBPF(t *testing.T) {
+	t.Helper()
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 1600, "udp"); err != nil {
+		t.Skipf("libpcap can't compile BPF filters here: %v", err)
+	}
+}
+
+func TestChooseFilter(t *testing.T) {
+	requireBPF(t)
+	builtin, err := buildBPFFilter([]int{9}, false, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		custom  string
+		want    string
+		wantErr string
+	}{
+		{name: "built-in", want: builtin},
+		{name: "custom", custom: "udp port 4000", want: "udp port 4000"},
+		{name: "bad custom", custom: "udp and port nine", wantErr: `Invalid BPF filter "udp and port nine": `},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := chooseFilter(builtin, tt.custom, 1600)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("chooseFilter() error = %v, want %q followed by libpcap's error", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || filter != tt.want {
+				t.Errorf("chooseFilter() = %q, %v, want %q", filter, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseFilterInvalid(t *testing.T) {
+	// Whether or not libpcap can compile anything, a bad expression is reported along with the expression
+	_, err := chooseFilter("udp", "udp and port nine", 1600)
+	if err == nil || !strings.Contains(err.Error(), `Invalid BPF filter "udp and port nine"`) {
+		t.Errorf("chooseFilter() error = %v, want one naming the bad expression", err)
+	}
+}
+
+func TestParsePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     []byte
+		wantErr  bool
+	}{
+		{"colon hex", "aa:bb:cc:dd:ee:ff", []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, false},
+		{"dash hex", "AA-BB-CC-DD-EE-FF", []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, false},
+		{"hex", "aabbccddeeff", []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, false},
+		{"ASCII", "s3cr3t", []byte("s3cr3t"), false},
+		{"ASCII with punctuation", "a,b=c:", []byte("a,b=c:"), false},
+		{"too short", "abc", nil, true},
+		{"too long", "s3cr3tpassword", nil, true},
+		{"hex too long", "aa:bb:cc:dd:ee:ff:00:11", nil, true},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePassword(tt.password)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsePassword(%q) = %x, want an error", tt.password, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePassword(%q) error = %v", tt.password, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parsePassword(%q) = %x, want %x", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBPFFilterIPv6Multicast(t *testing.T) {
+	requireBPF(t)
+	filter, err := buildBPFFilter([]int{9}, false, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 1600, filter)
+	if err != nil {
+		t.Fatalf("NewBPF(%q) error = %v", filter, err)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{"all-nodes multicast", udp6Packet(t, net.ParseIP("ff02::1"), magicPayload(t, "52:54:00:00:68:01")).Data(), true},
+		{"site-local multicast", udp6Packet(t, net.ParseIP("ff05::1"), magicPayload(t, "52:54:00:00:68:01")).Data(), true},
+		{"unicast", udp6Packet(t, net.ParseIP("2001:db8::10"), magicPayload(t, "52:54:00:00:68:01")).Data(), true},
+		{"too short", udp6Packet(t, net.ParseIP("ff02::1"), []byte("not a magic packet")).Data(), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ci := gopacket.CaptureInfo{CaptureLength: len(tt.frame), Length: len(tt.frame)}
+			if got := bpf.Matches(ci, tt.frame); got != tt.want {
+				t.Errorf("filter %q matches = %t, want %t", filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWOLFrameSizes(t *testing.T) {
+	// 42 bytes of headers, then up to 16 leading bytes, the 102 byte magic packet, a 6 byte password,
+	// the 21 byte UUID extension, and 64 bytes of padding
+	if shortest, longest := wolFrameSizes(); shortest != 144 || longest != 251 {
+		t.Errorf("wolFrameSizes() = %d, %d, want 144, 251", shortest, longest)
+	}
+}
+
+func TestBPFFilterSizes(t *testing.T) {
+	requireBPF(t)
+	_, longest := wolFrameSizes()
+	tests := []struct {
+		name      string
+		size      int // Length of the UDP payload, a magic packet padded with zeros or cut short
+		want      bool
+		wantNamed bool // Whether the filter for -name-match matches, which allows any longer packet
+	}{
+		{"bare magic packet", virtwold.MinSize, true, true},
+		{"with password", virtwold.MinSize + virtwold.PasswordSize, true, true},
+		{"with password and UUID extension", virtwold.MinSize + virtwold.PasswordSize + len(virtwold.UUIDPrefix) + virtwold.UUIDSize, true, true},
+		{"longest", longest - udpOverheadSize, true, true},
+		{"one byte too long", longest - udpOverheadSize + 1, false, true},
+		{"300 bytes", 300, false, true},
+		{"one byte too short", virtwold.MinSize - 1, false, false},
+	}
+
+	for _, named := range []bool{false, true} {
+		filter, err := buildBPFFilter([]int{9}, false, 0, named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, defaultSnaplen, filter)
+		if err != nil {
+			t.Fatalf("NewBPF(%q) error = %v", filter, err)
+		}
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/named=%t", tt.name, named), func(t *testing.T) {
+				payload := magicPayload(t, "52:54:00:00:99:01")
+				payload = append(payload, make([]byte, max(tt.size-len(payload), 0))...)[:tt.size]
+				frame := udpPacket(t, payload).Data()
+				if len(frame) != udpOverheadSize+tt.size {
+					t.Fatalf("frame is %d bytes, want %d", len(frame), udpOverheadSize+tt.size)
+				}
+
+				want := tt.want
+				if named {
+					want = tt.wantNamed
+				}
+				ci := gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)}
+				if got := bpf.Matches(ci, frame); got != want {
+					t.Errorf("filter %q matches %d byte frame = %t, want %t", filter, len(frame), got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestEffectiveCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		cooldown time.Duration
+		reboot   bool
+		source   string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"no reboot", 0, false, "default", 0, false},
+		{"no reboot with cooldown", time.Minute, false, "flag -cooldown", time.Minute, false},
+		{"reboot with cooldown", time.Minute, true, "flag -cooldown", time.Minute, false},
+		{"reboot with default cooldown", 0, true, "default", rebootCooldown, false},
+		{"reboot with cooldown disabled by flag", 0, true, "flag -cooldown", 0, true},
+		{"reboot with cooldown disabled in config", 0, true, "configuration file /etc/virtwold.yaml", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := effectiveCooldown(tt.cooldown, tt.reboot, tt.source)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("effectiveCooldown() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("effectiveCooldown() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInterfaceTypes(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{"", map[string]bool{}, false},
+		{"bridge", map[string]bool{"bridge": true}, false},
+		{"bridge, network", map[string]bool{"bridge": true, "network": true}, false},
+		{"bridge,tap", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			got, err := parseInterfaceTypes(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseInterfaceTypes() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("parseInterfaceTypes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildBPFFilterVLANID(t *testing.T) {
+	filter, err := buildBPFFilter([]int{9}, false, 20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(filter, "vlan 20 and (") {
+		t.Errorf("buildBPFFilter() with VLAN ID 20 = %q, want it narrowed to vlan 20", filter)
+	}
+	if !strings.Contains(filter, "len >= 148") {
+		t.Errorf("buildBPFFilter() with VLAN ID 20 = %q, doesn't allow for the tag in the lengths", filter)
+	}
+	// Either flag narrows the filter to the VLAN, as the ID implies tagged packets
+	if tagged, err := buildBPFFilter([]int{9}, true, 20, false); err != nil || tagged != filter {
+		t.Errorf("buildBPFFilter() with vlan and VLAN ID 20 = %q, want %q", tagged, filter)
+	}
+
+	requireBPF(t)
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 1600, filter)
+	if err != nil {
+		t.Fatalf("NewBPF(%q) error = %v", filter, err)
+	}
+	for _, tt := range []struct {
+		vlanID uint16
+		want   bool
+	}{{20, true}, {30, false}} {
+		frame := vlanUDPPacket(t, tt.vlanID, magicPayload(t, "52:54:00:00:72:01")).Data()
+		ci := gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)}
+		if got := bpf.Matches(ci, frame); got != tt.want {
+			t.Errorf("filter %q matches a frame on VLAN %d = %t, want %t", filter, tt.vlanID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,784 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"go.opentelemetry.io/otel/attribute"
+	"libvirt.org/go/libvirt"
+	"log/slog"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueRetryInterval  = 5 * time.Second        // How often to retry the queued wakes while libvirt is unreachable
+	waitRunningInterval = 500 * time.Millisecond // How often to check whether a woken VM is running yet
+)
+
+// Runs a function after a delay, replaceable so scheduled wakes can be fired without waiting
+var afterFunc = time.AfterFunc
+
+// Wakes VMs over persistent connections to one or more libvirt daemons
+type Waker struct {
+	hosts         []*libvirtHost                 // libvirt daemons to search for the VM, in order
+	passwords     atomic.Pointer[passwordConfig] // SecureOn passwords required to wake VMs, replaced on reload
+	dryRun        bool                           // Log the VMs that would be woken, without waking them
+	webhookURL    string                         // URL to POST an event to after waking a VM, or empty for none
+	cooldown      time.Duration                  // How long to ignore repeated packets for a MAC after a wake attempt, or 0 to never ignore them
+	nameMatch     bool                           // Wake the domain named in the packet if no domain has its MAC
+	attempts      int                            // Number of times to try waking a domain when libvirt reports a transient error
+	backoff       time.Duration                  // Delay before retrying a wake, doubled after each failure
+	queueDepth    int                            // Most wakes to hold while libvirt is unreachable, or 0 to drop them
+	force         bool                           // Start VMs even if their lifecycle policy says not to
+	autostart     bool                           // Only wake VMs with autostart enabled
+	transient     bool                           // Also wake transient VMs, which aren't defined
+	wakeDelay     time.Duration                  // How long after a packet to wake its VM, or 0 to wake it immediately
+	mappings      map[string]string              // Names of the VMs with each (normalized) MAC, to look up without listing every VM
+	useIndex      bool                           // Look VMs up through each host's index of MACs, rather than listing every VM
+	wakeAll       bool                           // Wake every matching VM on every host, rather than just the first
+	waitRunning   time.Duration                  // How long to wait for a woken VM to be running, or 0 to not wait
+	useLeases     bool                           // Also match VMs by the MACs in the DHCP leases of libvirt networks
+	verifyNetwork time.Duration                  // How long to wait for a woken VM to reply on the network, or 0 to not check
+	readOnly      bool                           // Whether the libvirt connections are read-only, so no VM can be woken
+	includeName   *regexp.Regexp                 // Only wake VMs with names matching this, or nil to wake any
+	excludeName   *regexp.Regexp                 // Never wake VMs with names matching this, or nil to exclude none
+	events        *eventRing                     // The most recent wake events, for /events
+	rebootRunning bool                           // Reboot running VMs matching a packet, like pressing the reset button
+	onUnknown     string                         // Webhook URL or command to tell about MACs no VM has, or empty for none
+	offLongerThan time.Duration                  // Only start VMs that have been off for at least this long, or 0 to start any
+	running       *runningTracker                // When each VM was last seen running, for offLongerThan
+	rules         atomic.Pointer[configRules]    // Rules from the configuration file, replaced on reload
+
+	mu        sync.Mutex             // Protects lastWake, queue, scheduled, and closed
+	lastWake  map[string]time.Time   // When each (normalized) MAC was last handled, for the cooldown
+	queue     []queuedWake           // Wakes waiting for libvirt to become reachable again, oldest first
+	scheduled map[string]*time.Timer // Wakes waiting for the wake delay, by (normalized) MAC
+	closed    bool                   // Whether the Waker has been closed, so scheduled wakes shouldn't happen
+}
+
+// What handling a WOL packet did to the VMs matching it
+type WakeOutcome string
+
+const (
+	WakeNoMatch        WakeOutcome = "no_match"        // No VM matched the packet
+	WakeStarted        WakeOutcome = "started"         // A matching VM was woken (or would have been, in dry-run mode)
+	WakeAlreadyRunning WakeOutcome = "already_running" // The matching VMs are already running, or in a state that can't be woken from
+	WakeSkipped        WakeOutcome = "skipped"         // The packet was ignored, such as within the cooldown or by lifecycle policy
+	WakeQueued         WakeOutcome = "queued"          // libvirt is unreachable, so the wake was queued for later
+	WakeScheduled      WakeOutcome = "scheduled"       // The wake will happen after the wake delay
+	WakeFailed         WakeOutcome = "failed"          // Waking the matching VMs failed
+	WakeRebooted       WakeOutcome = "rebooted"        // A matching VM was already running, so was rebooted
+)
+
+// The result of handling a WOL packet
+type WakeResult struct {
+	Outcome WakeOutcome `json:"outcome"`           // What happened to the matching VMs
+	URI     string      `json:"uri,omitempty"`     // URI of the (first) host the matching VMs are on, if any matched
+	Domains []string    `json:"domains,omitempty"` // Names of the matching VMs
+}
+
+// Log the result of handling a WOL packet for the (normalized) MAC
+func logWakeResult(mac string, result WakeResult) {
+	switch result.Outcome {
+	case WakeNoMatch:
+		// Only reported once every NIC of every domain on every host has been checked
+		slog.Info("No wakeable domain found with MAC address", "event", "no_match", "mac", mac)
+	case WakeAlreadyRunning:
+		slog.Info("Domain matching MAC is already running, so was not woken", "event", "already_running", "mac", mac, "uri", result.URI, "domains", result.Domains)
+	case WakeStarted:
+		slog.Debug("Woke domain matching MAC", "event", "wake_result", "mac", mac, "uri", result.URI, "domains", result.Domains)
+	}
+}
+
+// Rules from the configuration file on which VMs to wake and how, replaced as a whole on reload
+type configRules struct {
+	targets []TargetRule         // Rules matching VMs by the target device of their interface, when none has the MAC
+	hooks   map[string]wakeHooks // Commands to run around waking the VM for each (normalized) MAC
+	groups  map[string]Group     // Sets of domains to wake in place of the VM with each (normalized) MAC
+}
+
+// A wake held until libvirt becomes reachable again
+type queuedWake struct {
+	wol    *virtwold.MagicPacket // The packet that asked for the wake
+	mac    string                // Normalized MAC from the packet
+	queued time.Time             // When the wake was first queued
+}
+
+// Connect to the libvirt daemons at the given URIs, returning a Waker that reuses the connections
+// Each connection attempt gives up after connectTimeout, or waits forever if it's 0
+// Hosts that can't be reached yet are retried on the next wake, so only failing to reach every host is an error
+// With readOnly, the connections are opened read-only and every wake is refused
+func NewWaker(uris []string, connectTimeout time.Duration, readOnly bool, passwords passwordConfig) (*Waker, error) {
+	w := &Waker{readOnly: readOnly, events: newEventRing(eventHistory), lastWake: make(map[string]time.Time), scheduled: make(map[string]*time.Timer)}
+	w.SetPasswords(passwords)
+	w.rules.Store(&configRules{})
+
+	var errs []error
+	for _, uri := range uris {
+		host := &libvirtHost{uri: uri, connectTimeout: connectTimeout, readOnly: readOnly, configs: virtwold.NewConfigCache()}
+		if err := host.connect(); err != nil {
+			slog.Warn("Unable to connect to libvirt, will retry on the next wake", "event", "libvirt_connect_failed", "uri", uri, "error", err)
+			errs = append(errs, err)
+		}
+		w.hosts = append(w.hosts, host)
+	}
+
+	if len(errs) == len(uris) {
+		return nil, errors.Join(errs...)
+	}
+	return w, nil
+}
+
+// Replace the SecureOn passwords required to wake VMs, such as after reloading the configuration
+func (w *Waker) SetPasswords(passwords passwordConfig) {
+	w.passwords.Store(&passwords)
+}
+
+// Replace the target rules, hooks, and groups with those from the configuration, such as after reloading it
+func (w *Waker) SetConfigRules(config *Config) {
+	w.rules.Store(&configRules{targets: config.Targets, hooks: config.hookMap(), groups: config.groupMap()})
+}
+
+// Close the libvirt connections
+// Any wakes still waiting for the wake delay are cancelled
+func (w *Waker) Close() {
+	w.mu.Lock()
+	w.closed = true
+	for mac, timer := range w.scheduled {
+		timer.Stop()
+		slog.Info("Cancelled scheduled wake", "event", "wake_cancelled", "mac", mac)
+	}
+	w.mu.Unlock()
+
+	for _, host := range w.hosts {
+		host.Close()
+	}
+}
+
+// Check that at least one libvirt host is connected, so VMs can be woken
+// One unreachable host out of several doesn't make the daemon unhealthy, since VMs on the others can still be woken
+func (w *Waker) Healthy() error {
+	for _, host := range w.hosts {
+		if host.up.Load() {
+			return nil
+		}
+	}
+	return errors.New("no libvirt connection is up")
+}
+
+// Only match the MACs of VM interfaces of the given types (<interface type='...'>), or of any type if empty
+func (w *Waker) SetInterfaceTypes(types map[string]bool) {
+	for _, host := range w.hosts {
+		host.ifaceTypes = types
+	}
+}
+
+// List the domains that could be woken on every host
+func (w *Waker) ListDomains() []hostDomains {
+	var hosts []hostDomains
+	for _, host := range w.hosts {
+		listing := hostDomains{URI: host.uri, Domains: []virtwold.WakeableDomain{}}
+
+		domains, err := host.listDomains(false)
+		if err != nil {
+			listing.Error = err.Error()
+		} else {
+			listing.Domains = domains
+			virtwold.FreeWakeable(domains)
+		}
+
+		hosts = append(hosts, listing)
+	}
+	return hosts
+}
+
+// Check whether the MAC was handled within the cooldown, and if not record that it's being handled now
+func (w *Waker) inCooldown(mac string) bool {
+	if w.cooldown <= 0 {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := w.lastWake[mac]; ok && now.Sub(last) < w.cooldown {
+		return true
+	}
+	w.lastWake[mac] = now
+	return false
+}
+
+// Find the VM with a matching MAC and wake it, using the libvirt call appropriate to its current state
+// If a SecureOn password is configured for the MAC, the packet must carry the same password
+// Every host is searched, and if more than one has a matching VM only the first is woken
+// If name matching is enabled and no VM has the MAC, the VM named in the packet is woken instead
+// Retrying a failed wake stops once the context is cancelled
+func (w *Waker) WakeVirtualMachine(ctx context.Context, wol *virtwold.MagicPacket) (WakeResult, error) {
+	result, err := w.handlePacket(ctx, wol)
+	w.recordEvent(virtwold.NormalizeMAC(wol.MAC), result, err)
+	return result, err
+}
+
+// Return the most recent wake events, newest first
+func (w *Waker) Events() []wakeEvent {
+	return w.events.list()
+}
+
+// Record the result of handling a packet for the (normalized) MAC in the recent wake events
+func (w *Waker) recordEvent(mac string, result WakeResult, err error) {
+	event := wakeEvent{Time: time.Now(), MAC: mac, Domains: result.Domains, Outcome: result.Outcome}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	w.events.add(event)
+}
+
+// Check a WOL packet against the passwords and cooldown, then wake its VM now or after the wake delay
+func (w *Waker) handlePacket(ctx context.Context, wol *virtwold.MagicPacket) (WakeResult, error) {
+	if err := w.passwords.Load().check(wol); err != nil {
+		return WakeResult{Outcome: WakeFailed}, err
+	}
+	mac := virtwold.NormalizeMAC(wol.MAC)
+
+	// Routers often send the same packet several times in quick succession, so only act on the first
+	if w.inCooldown(mac) {
+		slog.Debug("Ignoring packet for MAC within cooldown", "event", "cooldown", "mac", mac, "cooldown", w.cooldown)
+		return WakeResult{Outcome: WakeSkipped}, nil
+	}
+
+	if w.wakeDelay > 0 {
+		w.schedule(ctx, wol, mac)
+		return WakeResult{Outcome: WakeScheduled}, nil
+	}
+
+	return w.wake(ctx, wol, mac)
+}
+
+// Wake the VM for a packet after the wake delay, unless a wake for the same MAC is already scheduled
+// Retrying the delayed wake stops once the context is cancelled
+func (w *Waker) schedule(ctx context.Context, wol *virtwold.MagicPacket, mac string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.scheduled[mac]; ok {
+		slog.Debug("Wake already scheduled for MAC", "event", "wake_already_scheduled", "mac", mac)
+		return
+	}
+
+	slog.Info("Scheduled wake", "event", "wake_scheduled", "mac", mac, "delay", w.wakeDelay)
+	w.scheduled[mac] = afterFunc(w.wakeDelay, func() {
+		w.mu.Lock()
+		closed := w.closed
+		delete(w.scheduled, mac)
+		w.mu.Unlock()
+		if closed {
+			return
+		}
+
+		slog.Info("Starting scheduled wake", "event", "scheduled_wake", "mac", mac)
+		w.wakeAndLog(ctx, wol, mac)
+	})
+}
+
+// Wake the VM for a packet outside of packet handling, such as after a delay, logging the result
+func (w *Waker) wakeAndLog(ctx context.Context, wol *virtwold.MagicPacket, mac string) {
+	result, err := w.wake(ctx, wol, mac)
+	w.recordEvent(mac, result, err)
+	if err != nil {
+		wakeErrors.Inc()
+		slog.Error("Error waking system", "event", "wake_failed", "mac", mac, "error", err)
+	}
+	logWakeResult(mac, result)
+}
+
+// Return the target device of the first rule for packets arriving on the interface for the (normalized) MAC,
+// or empty if no rule applies
+func (w *Waker) ruleTarget(iface string, mac string) string {
+	if iface == "" {
+		return ""
+	}
+	for _, rule := range w.rules.Load().targets {
+		if rule.Interface == iface && (rule.MAC == "" || rule.MAC == mac) {
+			return rule.Target
+		}
+	}
+	return ""
+}
+
+// Wake the VM for a packet that has already been checked, queueing the wake if libvirt is unreachable
+func (w *Waker) wake(ctx context.Context, wol *virtwold.MagicPacket, mac string) (WakeResult, error) {
+	ctx, span := startSpan(ctx, "wake", attribute.String("mac", mac))
+	result, err := w.findAndWake(ctx, wol, mac)
+	span.SetAttributes(attribute.String("outcome", string(result.Outcome)), attribute.StringSlice("domains", result.Domains))
+	endSpan(span, err)
+	return result, err
+}
+
+// Find the VMs for the WOL packet by each of the ways enabled, and wake them
+func (w *Waker) findAndWake(ctx context.Context, wol *virtwold.MagicPacket, mac string) (WakeResult, error) {
+	// Looking up a single VM by name is far quicker than listing every VM on a host with hundreds of them
+	find := func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+		if w.useIndex {
+			return host.findDomainsIndexed(mac)
+		}
+		return host.findDomains(mac)
+	}
+	if name, ok := w.mappings[mac]; ok {
+		find = func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+			return host.lookupDomain(name)
+		}
+	}
+	// A group's trigger MAC wakes every domain in the group, rather than any VM with the MAC
+	if group, ok := w.rules.Load().groups[mac]; ok {
+		slog.Debug("Waking group", "event", "group_wake", "mac", mac, "group", group.Name, "domains", group.Domains)
+		result, errs := w.wakeGroup(ctx, group, mac)
+		return result, errors.Join(errs...)
+	}
+	// A UUID carried in the packet identifies the VM more precisely than its MAC, so is tried first
+	if wol.UUID != "" {
+		slog.Debug("Matching on UUID", "event", "uuid_match", "mac", mac, "uuid", wol.UUID)
+		result, _, errs := w.wakeMatches(ctx, mac, func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+			return host.lookupDomainUUID(wol.UUID)
+		})
+		if result.Outcome != WakeNoMatch {
+			return result, errors.Join(errs...)
+		}
+		slog.Debug("No domain has the UUID, matching on MAC", "event", "uuid_not_found", "mac", mac, "uuid", wol.UUID)
+	}
+
+	result, unreachable, errs := w.wakeMatches(ctx, mac, find)
+
+	if name, ok := w.mappings[mac]; ok && result.Outcome == WakeNoMatch && !unreachable {
+		slog.Warn("Domain from mapping file not found, searching every domain instead", "event", "mapping_not_found", "mac", mac, "domain", name)
+		result, unreachable, errs = w.wakeMatches(ctx, mac, func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+			return host.findDomains(mac)
+		})
+	}
+
+	// A VM whose effective MAC differs from its configuration can still be found by its DHCP lease
+	if result.Outcome == WakeNoMatch && w.useLeases {
+		var leaseUnreachable bool
+		var leaseErrs []error
+		result, leaseUnreachable, leaseErrs = w.wakeMatches(ctx, mac, func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+			return host.findDomainsLeased(mac)
+		})
+		unreachable = unreachable || leaseUnreachable
+		errs = append(errs, leaseErrs...)
+	}
+
+	// A VM identified by the target device of its interface can be found through a rule for the interface the packet arrived on
+	if target := w.ruleTarget(wol.Interface, mac); result.Outcome == WakeNoMatch && target != "" {
+		slog.Debug("No domain has the MAC, matching on target device", "event", "target_match", "mac", mac, "interface", wol.Interface, "target", target)
+		var targetUnreachable bool
+		var targetErrs []error
+		result, targetUnreachable, targetErrs = w.wakeMatches(ctx, mac, func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+			return host.findDomainsTarget(target)
+		})
+		unreachable = unreachable || targetUnreachable
+		errs = append(errs, targetErrs...)
+	}
+
+	// A VM whose MAC is randomized on each boot can still be found by the name carried in the packet
+	if result.Outcome == WakeNoMatch && w.nameMatch && wol.Name != "" {
+		slog.Debug("No domain has the MAC, matching on name", "event", "name_match", "mac", mac, "domain", wol.Name)
+		var nameUnreachable bool
+		var nameErrs []error
+		result, nameUnreachable, nameErrs = w.wakeMatches(ctx, mac, func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+			return host.findDomainsNamed(wol.Name)
+		})
+		unreachable = unreachable || nameUnreachable
+		errs = append(errs, nameErrs...)
+	}
+
+	// The VM may be on a host that couldn't be searched, so hold the wake until it can be
+	if result.Outcome == WakeNoMatch && unreachable && w.queueDepth > 0 {
+		w.enqueue(wol, mac)
+		slog.Warn("libvirt is unreachable, queued wake until it reconnects", "event", "wake_queued", "mac", mac, "error", errors.Join(errs...))
+		return WakeResult{Outcome: WakeQueued}, nil
+	}
+
+	// Only once every host has been searched is it certain no VM has the MAC
+	if result.Outcome == WakeNoMatch && !unreachable && w.onUnknown != "" {
+		go notifyUnknown(w.onUnknown, mac)
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// Rebuild the index of MACs on each host at the interval, until the context is cancelled
+// Between rebuilds, the index is also refreshed whenever a lookup misses it
+func (w *Waker) refreshIndexes(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			for _, host := range w.hosts {
+				domains, err := host.listDomains(true)
+				if err != nil {
+					slog.Warn("Failed to refresh domain index", "event", "index_refresh_failed", "uri", host.uri, "error", err)
+					continue
+				}
+				virtwold.FreeWakeable(domains)
+				slog.Debug("Refreshed domain index", "event", "index_refreshed", "uri", host.uri, "domains", len(domains))
+			}
+		}
+	}
+}
+
+// Queue a wake, replacing any already queued for the same MAC and dropping the oldest if the queue is full
+func (w *Waker) enqueue(wol *virtwold.MagicPacket, mac string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queued := time.Now()
+	for i, item := range w.queue {
+		if item.mac == mac {
+			queued = item.queued
+			w.queue = append(w.queue[:i], w.queue[i+1:]...)
+			break
+		}
+	}
+
+	if len(w.queue) >= w.queueDepth {
+		slog.Warn("Wake queue is full, dropping the oldest wake", "event", "queue_full", "mac", w.queue[0].mac)
+		w.queue = w.queue[1:]
+	}
+	w.queue = append(w.queue, queuedWake{wol: wol, mac: mac, queued: queued})
+}
+
+// Retry the queued wakes until the context is cancelled
+// Wakes for hosts that are still unreachable go back on the queue, so a wake may fire well after its packet
+func (w *Waker) drainQueue(ctx context.Context) {
+	ticker := time.NewTicker(queueRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			w.retryQueued(ctx)
+		}
+	}
+}
+
+// Retry each of the queued wakes once, emptying the queue
+func (w *Waker) retryQueued(ctx context.Context) {
+	w.mu.Lock()
+	queue := w.queue
+	w.queue = nil
+	w.mu.Unlock()
+
+	for _, item := range queue {
+		slog.Info("Retrying queued wake", "event", "queue_retry", "mac", item.mac, "queued_for", time.Since(item.queued))
+		w.wakeAndLog(ctx, item.wol, item.mac)
+	}
+}
+
+// Wake the first domain found by find on the first host with any, or every domain found on every host if
+// waking all of them, returning what happened to them, and whether any host couldn't be searched
+func (w *Waker) wakeMatches(ctx context.Context, mac string, find func(*libvirtHost) ([]virtwold.WakeableDomain, error)) (WakeResult, bool, []error) {
+	var errs []error
+	result := WakeResult{Outcome: WakeNoMatch}
+	unreachable := false
+	for _, host := range w.hosts {
+		matches, err := host.findTraced(ctx, find)
+		if err != nil {
+			errs = append(errs, err)
+			unreachable = true
+			continue
+		}
+		matches = w.eligible(matches)
+		if len(matches) == 0 {
+			continue
+		}
+
+		if result.URI != "" && !w.wakeAll {
+			slog.Warn("Packet matches domains on more than one host, only the first was woken (use -wake-all to wake every one)", "event", "ambiguous_match", "mac", mac, "uri", host.uri, "woken_uri", result.URI)
+			virtwold.FreeWakeable(matches)
+			continue
+		}
+		if result.URI == "" {
+			result.URI = host.uri
+			result.Outcome = WakeSkipped
+		}
+
+		if len(matches) > 1 && !w.wakeAll {
+			slog.Warn("Packet matches several domains, only the first was woken (use -wake-all to wake every one)", "event", "ambiguous_match", "mac", mac, "uri", host.uri, "domains", len(matches))
+			virtwold.FreeWakeable(matches[1:])
+			matches = matches[:1]
+		}
+
+		// With several matching domains, report the most significant thing that happened to any of them
+		for _, match := range matches {
+			result.Domains = append(result.Domains, match.Name)
+			outcome, err := w.wakeDomain(ctx, match, mac)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if outcomeRank[outcome] > outcomeRank[result.Outcome] {
+				result.Outcome = outcome
+			}
+		}
+		virtwold.FreeWakeable(matches)
+	}
+
+	return result, unreachable, errs
+}
+
+// Wake each domain of the group in order, returning the most significant thing that happened to any of them
+func (w *Waker) wakeGroup(ctx context.Context, group Group, mac string) (WakeResult, []error) {
+	var errs []error
+	result := WakeResult{Outcome: WakeNoMatch}
+	for _, name := range group.Domains {
+		member, _, memberErrs := w.wakeMatches(ctx, mac, func(host *libvirtHost) ([]virtwold.WakeableDomain, error) {
+			return host.lookupDomain(name)
+		})
+		errs = append(errs, memberErrs...)
+		if member.Outcome == WakeNoMatch {
+			slog.Warn("Domain in group not found", "event", "group_member_not_found", "mac", mac, "group", group.Name, "domain", name)
+			continue
+		}
+
+		if result.URI == "" {
+			result.URI = member.URI
+		}
+		result.Domains = append(result.Domains, member.Domains...)
+		if outcomeRank[member.Outcome] > outcomeRank[result.Outcome] {
+			result.Outcome = member.Outcome
+		}
+	}
+
+	return result, errs
+}
+
+// How significant each outcome of waking a single domain is, for reporting the outcome of waking several
+var outcomeRank = map[WakeOutcome]int{
+	WakeSkipped:        1,
+	WakeAlreadyRunning: 2,
+	WakeFailed:         3,
+	WakeStarted:        4,
+	WakeRebooted:       4,
+}
+
+// Return the domains that may be woken, freeing the rest
+func (w *Waker) eligible(domains []virtwold.WakeableDomain) []virtwold.WakeableDomain {
+	var kept []virtwold.WakeableDomain
+	for _, domain := range domains {
+		// Defined domains that aren't set to autostart, such as templates, can be kept from ever being woken
+		if w.autostart && !domain.Autostart {
+			slog.Debug("Skipping domain without autostart", "event", "not_autostart", "domain", domain.Name)
+			domain.Free()
+			continue
+		}
+		// Names can scope which domains are ever woken, whatever their MACs
+		if w.includeName != nil && !w.includeName.MatchString(domain.Name) {
+			slog.Info("Skipping domain not matching -include-name", "event", "name_excluded", "domain", domain.Name, "reason", "include")
+			domain.Free()
+			continue
+		}
+		if w.excludeName != nil && w.excludeName.MatchString(domain.Name) {
+			slog.Info("Skipping domain matching -exclude-name", "event", "name_excluded", "domain", domain.Name, "reason", "exclude")
+			domain.Free()
+			continue
+		}
+		// A transient domain disappears once stopped, and may be in the middle of being created or torn down
+		if !domain.Persistent && !w.transient {
+			slog.Info("Skipping transient domain, use -allow-transient to wake it", "event", "transient_skipped", "domain", domain.Name)
+			domain.Free()
+			continue
+		}
+		kept = append(kept, domain)
+	}
+	return kept
+}
+
+// Wake a domain matching the MAC, using the libvirt call appropriate to its current state
+func (w *Waker) wakeDomain(ctx context.Context, match virtwold.WakeableDomain, mac string) (WakeOutcome, error) {
+	domain := match.Domain()
+	name := match.Name
+	state := match.DomainState()
+	slog.Debug("Matched domain", "event", "domain_matched", "domain", name, "mac", mac, "state", match.State, "persistent", match.Persistent)
+
+	// The libvirt call appropriate to the state of the VM is picked the same way as by the package
+	method := virtwold.WakeMethod(state)
+	if state == libvirt.DOMAIN_RUNNING && w.rebootRunning {
+		method = "Reboot"
+	}
+
+	var result string // What waking does to the VM, for the webhook
+	outcome := WakeStarted
+	switch {
+	case method == "Create" && state == libvirt.DOMAIN_NOSTATE:
+		// Some hypervisor drivers can't always report a state, and assuming the VM is running would leave it off
+		slog.Warn("Unable to determine the state of the system, trying to start it anyway", "event", "waking_nostate", "domain", name, "mac", mac)
+		result = "started"
+
+	case method == "Create":
+		// A stale packet arriving while the VM shuts down would otherwise start it straight back up
+		if off, recent := w.recentlyRunning(match.Config().UUID); recent {
+			slog.Info("Domain was running too recently, not waking it", "event", "recently_running", "domain", name, "mac", mac, "off_for", off, "off_longer_than", w.offLongerThan)
+			return WakeSkipped, nil
+		}
+		if policy := lifecyclePolicy(match.Config(), state); policy != "" && !w.force {
+			slog.Info("Domain lifecycle policy says not to start it, use -force to override", "event", "policy_skipped", "domain", name, "mac", mac, "policy", policy)
+			return WakeSkipped, nil
+		}
+		slog.Info("Waking system", "event", "waking", "domain", name, "mac", mac)
+		result = "started"
+
+	case method == "PMWakeup":
+		slog.Info("Unsuspending system", "event", "unsuspending", "domain", name, "mac", mac)
+		result = "unsuspended"
+
+	case method == "Resume":
+		slog.Info("Resuming system", "event", "resuming", "domain", name, "mac", mac)
+		result = "resumed"
+
+	case method == "Reboot":
+		slog.Info("Rebooting running system", "event", "rebooting", "domain", name, "mac", mac)
+		result = "rebooted"
+		outcome = WakeRebooted
+
+	case state == libvirt.DOMAIN_RUNNING:
+		slog.Info("System is already running", "event", "not_woken", "domain", name, "mac", mac, "state", state)
+		return WakeAlreadyRunning, nil
+
+	default:
+		slog.Info("System is already running or in a state that cannot be woken from", "event", "not_woken", "domain", name, "mac", mac, "state", state)
+		return WakeAlreadyRunning, nil
+	}
+	wake := func() error {
+		return virtwold.CallWakeMethod(domain, method)
+	}
+
+	// A read-only connection can't wake anything, so say what would have been done and stop
+	if w.readOnly {
+		slog.Info(fmt.Sprintf("[read-only] refusing to wake %s", name), "event", "read_only", "domain", name, "mac", mac, "method", method)
+		return WakeSkipped, nil
+	}
+
+	// In dry-run mode everything but the wake itself happens, so logs and metrics look the same
+	if w.dryRun {
+		slog.Info(fmt.Sprintf("[dry-run] would wake %s", name), "event", "dry_run", "domain", name, "mac", mac, "method", method)
+	} else {
+		hooks := w.rules.Load().hooks[mac]
+		if hooks.preWake != "" {
+			if err := runWakeHook("pre_wake", hooks.preWake, mac, name); err != nil {
+				return WakeFailed, fmt.Errorf("not waking %s: %w", name, err)
+			}
+			slog.Info("Ran pre_wake hook", "event", "pre_wake", "domain", name, "mac", mac)
+		}
+		_, span := startSpan(ctx, "domain.wake", attribute.String("domain", name), attribute.String("mac", mac), attribute.String("method", method))
+		err := w.retryWake(ctx, name, method, wake)
+		endSpan(span, err)
+		if err != nil {
+			return WakeFailed, fmt.Errorf("failed to wake %s with %s: %w", name, method, err)
+		}
+		if w.waitRunning > 0 {
+			if err := waitUntilRunning(domain, w.waitRunning); err != nil {
+				return WakeFailed, fmt.Errorf("woke %s with %s, but %w", name, method, err)
+			}
+		}
+		slog.Info("Successfully woke domain", "event", "domain_woken", "domain", name, "mac", mac, "method", method)
+		if hooks.postWake != "" {
+			if err := runWakeHook("post_wake", hooks.postWake, mac, name); err != nil {
+				slog.Warn("Failed to run post_wake hook", "event", "post_wake_failed", "domain", name, "mac", mac, "error", err)
+			} else {
+				slog.Info("Ran post_wake hook", "event", "post_wake", "domain", name, "mac", mac)
+			}
+		}
+		if lister, ok := domain.(addressLister); ok && w.verifyNetwork > 0 {
+			// The domain is freed once the wake is handled, so the check takes its own reference
+			if err := domain.Ref(); err != nil {
+				slog.Warn("Unable to verify domain on the network", "event", "verify_error", "domain", name, "mac", mac, "error", err)
+			} else {
+				go verifyNetwork(lister, name, mac, w.verifyNetwork)
+			}
+		}
+		if w.webhookURL != "" {
+			notifyWebhook(w.webhookURL, webhookEvent{Domain: name, MAC: mac, State: result})
+		}
+	}
+	wakes.WithLabelValues(name).Inc()
+
+	return outcome, nil
+}
+
+// Call wake, retrying with exponential backoff while it fails with an error that may be transient
+// Starting a VM can fail briefly while its storage or network is still being set up
+// Waiting between attempts stops early once the context is cancelled, so shutdown isn't held up by the backoff
+func (w *Waker) retryWake(ctx context.Context, name string, method string, wake func() error) error {
+	attempts := max(w.attempts, 1)
+	backoff := w.backoff
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = wake(); err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+		slog.Warn("Transient error waking domain", "event", "wake_retry", "domain", name, "method", method, "attempt", attempt, "attempts", attempts, "error", err)
+
+		if attempt < attempts {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("gave up after %d of %d attempts: %w", attempt, attempts, err)
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+// Poll the state of the domain until it's running, giving up after timeout
+func waitUntilRunning(domain virtwold.Domain, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, _, err := domain.GetState()
+		if err != nil {
+			return fmt.Errorf("failed to check domain state: %w", err)
+		}
+		if state == libvirt.DOMAIN_RUNNING {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still %s after waiting %s for it to run", virtwold.StateName(state), timeout)
+		}
+		time.Sleep(waitRunningInterval)
+	}
+}
+
+// Check whether a libvirt error may go away if the call is retried
+func isTransient(err error) bool {
+	var lverr libvirt.Error
+	if !errors.As(err, &lverr) {
+		return false
+	}
+
+	switch lverr.Code {
+	case libvirt.ERR_OPERATION_TIMEOUT, libvirt.ERR_OPERATION_FAILED, libvirt.ERR_SYSTEM_ERROR,
+		libvirt.ERR_INTERNAL_ERROR, libvirt.ERR_RESOURCE_BUSY, libvirt.ERR_AGENT_UNRESPONSIVE,
+		libvirt.ERR_NO_STORAGE_POOL, libvirt.ERR_NO_STORAGE_VOL, libvirt.ERR_NO_NETWORK:
+		return true
+	default:
+		return false
+	}
+}
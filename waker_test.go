@@ -0,0 +1,921 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWakeDomainMethod(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     libvirt.DomainState
+		wantCalls []string
+	}{
+		{"shutoff", libvirt.DOMAIN_SHUTOFF, []string{"Create"}},
+		{"shutdown", libvirt.DOMAIN_SHUTDOWN, []string{"Create"}},
+		{"crashed", libvirt.DOMAIN_CRASHED, []string{"Create"}},
+		{"pmsuspended", libvirt.DOMAIN_PMSUSPENDED, []string{"PMWakeup"}},
+		{"paused", libvirt.DOMAIN_PAUSED, []string{"Resume"}},
+		{"running", libvirt.DOMAIN_RUNNING, nil},
+		{"blocked", libvirt.DOMAIN_BLOCKED, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:12:34:56")
+			fake.state = tt.state
+
+			if _, err := newTestWaker().wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:12:34:56"); err != nil {
+				t.Fatalf("wakeDomain() error = %v", err)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWakeDomainResume(t *testing.T) {
+	fake := newFakeDomain(t, "vm", "52:54:00:12:34:56")
+	fake.state = libvirt.DOMAIN_PAUSED
+
+	if _, err := newTestWaker().wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:12:34:56"); err != nil {
+		t.Fatalf("wakeDomain() error = %v, want nil", err)
+	}
+	if state, _, _ := fake.GetState(); state != libvirt.DOMAIN_RUNNING {
+		t.Errorf("state = %d after resuming, want running", state)
+	}
+}
+
+func TestWakeDomainResumeError(t *testing.T) {
+	failure := errors.New("domain is locked")
+	fake := newFakeDomain(t, "vm", "52:54:00:12:34:56")
+	fake.state = libvirt.DOMAIN_PAUSED
+	fake.wakeErrs = []error{failure}
+
+	if _, err := newTestWaker().wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:12:34:56"); !errors.Is(err, failure) {
+		t.Fatalf("wakeDomain() error = %v, want it to wrap %v", err, failure)
+	}
+	if state, _, _ := fake.GetState(); state != libvirt.DOMAIN_PAUSED {
+		t.Errorf("state = %d after failing to resume, want paused", state)
+	}
+}
+
+func TestWakeDomainDryRun(t *testing.T) {
+	states := []libvirt.DomainState{libvirt.DOMAIN_SHUTOFF, libvirt.DOMAIN_PMSUSPENDED, libvirt.DOMAIN_PAUSED}
+	for _, state := range states {
+		t.Run(fmt.Sprint(state), func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:12:34:56")
+			fake.state = state
+			w := newTestWaker()
+			w.dryRun = true
+
+			if _, err := w.wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:12:34:56"); err != nil {
+				t.Fatalf("wakeDomain() error = %v", err)
+			}
+			if calls := fake.wakeCalls(); len(calls) != 0 {
+				t.Errorf("calls = %v in dry-run mode, want none", calls)
+			}
+		})
+	}
+}
+
+func TestWakeVirtualMachineNormalizedMAC(t *testing.T) {
+	tests := []struct {
+		name      string
+		domainMAC string
+		wantCalls []string
+	}{
+		{"normalized", "52:54:00:ab:cd:ef", []string{"Create"}},
+		{"uppercase", "52:54:00:AB:CD:EF", []string{"Create"}},
+		{"dashes", "52-54-00-ab-cd-ef", []string{"Create"}},
+		{"different", "52:54:00:ab:cd:e0", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", tt.domainMAC)
+			w, _ := newFakeHostWaker(t, fake)
+
+			if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:AB:CD:EF"}); err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls with %s = %v, want %v", tt.domainMAC, calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWakeSecondNIC(t *testing.T) {
+	tests := []struct {
+		name      string
+		mac       string
+		wantCalls []string
+	}{
+		{"first NIC", "52:54:00:00:19:01", []string{"Create"}},
+		{"second NIC", "52:54:00:00:19:02", []string{"Create"}},
+		{"neither NIC", "52:54:00:00:19:03", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := newFakeDomain(t, "other", "52:54:00:00:19:ff")
+			fake := newFakeDomain(t, "vm", "52:54:00:00:19:01", "52:54:00:00:19:02")
+			w, _ := newFakeHostWaker(t, other, fake)
+
+			if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: tt.mac}); err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if calls := other.wakeCalls(); len(calls) != 0 {
+				t.Errorf("other domain calls = %v, want none", calls)
+			}
+		})
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	tests := []struct {
+		name        string
+		cooldown    time.Duration
+		wantLists   int
+		wantCreates int
+	}{
+		{"within cooldown", time.Minute, 1, 1},
+		{"no cooldown", 0, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:24:01")
+			w, connection := newFakeHostWaker(t, fake)
+			w.cooldown = tt.cooldown
+
+			for i := 0; i < 2; i++ {
+				if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:24:01"}); err != nil {
+					t.Fatalf("WakeVirtualMachine() error = %v", err)
+				}
+			}
+
+			// A packet ignored within the cooldown doesn't even list the domains
+			if connection.lists != tt.wantLists {
+				t.Errorf("listed domains %d times, want %d", connection.lists, tt.wantLists)
+			}
+			if calls := fake.wakeCalls(); len(calls) != tt.wantCreates {
+				t.Errorf("calls = %v, want %d Create", calls, tt.wantCreates)
+			}
+		})
+	}
+}
+
+func TestWakeLXCContainer(t *testing.T) {
+	domcfg := &libvirtxml.Domain{
+		Type: "lxc",
+		Name: "container",
+		OS:   &libvirtxml.DomainOS{Type: &libvirtxml.DomainOSType{Type: "exe"}, Init: "/sbin/init"},
+		Devices: &libvirtxml.DomainDeviceList{
+			Emulator: "/usr/libexec/libvirt_lxc",
+			Interfaces: []libvirtxml.DomainInterface{{
+				MAC:    &libvirtxml.DomainInterfaceMAC{Address: "00:16:3E:00:28:01"},
+				Source: &libvirtxml.DomainInterfaceSource{Network: &libvirtxml.DomainInterfaceSourceNetwork{Network: "default"}},
+			}},
+		},
+	}
+	fake := newFakeDomainConfig(t, domcfg)
+	w, _ := newFakeHostWaker(t, fake)
+
+	if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "00:16:3e:00:28:01"}); err != nil {
+		t.Fatalf("WakeVirtualMachine() error = %v", err)
+	}
+	if calls := fake.wakeCalls(); !slices.Equal(calls, []string{"Create"}) {
+		t.Errorf("calls = %v, want [Create]", calls)
+	}
+}
+
+func TestWakeByName(t *testing.T) {
+	tests := []struct {
+		name       string
+		nameMatch  bool
+		packetName string
+		wantCalls  []string
+	}{
+		{"name matched", true, "web01", []string{"Create"}},
+		{"name matching off", false, "web01", nil},
+		{"no name in packet", true, "", nil},
+		{"unknown name", true, "web02", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "web01", "52:54:00:00:30:01")
+			w, _ := newFakeHostWaker(t, fake)
+			w.nameMatch = tt.nameMatch
+
+			// The VM's MAC changed since the packet's sender learned it, so only the name can match
+			wol := &virtwold.MagicPacket{MAC: "52:54:00:00:30:ff", Name: tt.packetName}
+			if _, err := w.WakeVirtualMachine(context.Background(), wol); err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWakeDomainRetry(t *testing.T) {
+	transient := libvirt.Error{Code: libvirt.ERR_OPERATION_TIMEOUT, Message: "storage not ready"}
+	permanent := libvirt.Error{Code: libvirt.ERR_CONFIG_UNSUPPORTED, Message: "unsupported configuration"}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"transient then success", []error{transient}, 2, nil},
+		{"permanent", []error{permanent}, 1, permanent},
+		{"transient every time", []error{transient, transient, transient}, 3, transient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:31:01")
+			fake.wakeErrs = tt.errs
+			w := newTestWaker()
+			w.attempts = 3
+			w.backoff = time.Millisecond
+
+			_, err := w.wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:00:31:01")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("wakeDomain() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls := fake.wakeCalls(); len(calls) != tt.wantCalls {
+				t.Errorf("calls = %v, want %d Create calls", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryWakeCancelled(t *testing.T) {
+	w := newTestWaker()
+	w.attempts = 5
+	w.backoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- w.retryWake(ctx, "vm", "Create", func() error {
+			calls++
+			return libvirt.Error{Code: libvirt.ERR_OPERATION_TIMEOUT}
+		})
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil || calls != 1 {
+			t.Errorf("retryWake() = %v after %d calls, want an error after 1", err, calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retryWake() kept waiting after the context was cancelled")
+	}
+}
+
+func TestWakeDomainLifecyclePolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      libvirt.DomainState
+		onPoweroff string
+		onCrash    string
+		force      bool
+		wantWoken  bool
+	}{
+		{"poweroff destroy", libvirt.DOMAIN_SHUTOFF, "destroy", "", false, true},
+		{"poweroff preserve", libvirt.DOMAIN_SHUTOFF, "preserve", "", false, false},
+		{"poweroff preserve forced", libvirt.DOMAIN_SHUTOFF, "preserve", "", true, true},
+		{"crash restart", libvirt.DOMAIN_CRASHED, "", "restart", false, true},
+		{"crash preserve", libvirt.DOMAIN_CRASHED, "", "preserve", false, false},
+		{"crash coredump-preserve", libvirt.DOMAIN_CRASHED, "", "coredump-preserve", false, false},
+		{"crash preserve forced", libvirt.DOMAIN_CRASHED, "", "preserve", true, true},
+		// A paused domain was never powered off, so its poweroff policy doesn't apply
+		{"paused with poweroff preserve", libvirt.DOMAIN_PAUSED, "preserve", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domcfg := &libvirtxml.Domain{Type: "kvm", Name: "vm", OnPoweroff: tt.onPoweroff, OnCrash: tt.onCrash}
+			fake := newFakeDomainConfig(t, domcfg)
+			fake.state = tt.state
+			w := newTestWaker()
+			w.force = tt.force
+
+			if _, err := w.wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:00:39:01"); err != nil {
+				t.Fatalf("wakeDomain() error = %v", err)
+			}
+			if woken := len(fake.wakeCalls()) > 0; woken != tt.wantWoken {
+				t.Errorf("calls = %v, want woken %v", fake.wakeCalls(), tt.wantWoken)
+			}
+		})
+	}
+}
+
+func TestAutostartOnly(t *testing.T) {
+	tests := []struct {
+		name         string
+		autostart    bool
+		wantTemplate []string
+		wantServer   []string
+	}{
+		{"any domain", false, []string{"Create"}, nil},
+		{"autostart only", true, nil, []string{"Create"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A template cloned into a server shares its MAC, and is listed first
+			template := newFakeDomain(t, "template", "52:54:00:00:40:01")
+			server := newFakeDomain(t, "server", "52:54:00:00:40:01")
+			server.autostart = true
+			w, _ := newFakeHostWaker(t, template, server)
+			w.autostart = tt.autostart
+
+			if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:40:01"}); err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if calls := template.wakeCalls(); !slices.Equal(calls, tt.wantTemplate) {
+				t.Errorf("template calls = %v, want %v", calls, tt.wantTemplate)
+			}
+			if calls := server.wakeCalls(); !slices.Equal(calls, tt.wantServer) {
+				t.Errorf("server calls = %v, want %v", calls, tt.wantServer)
+			}
+		})
+	}
+}
+
+func TestWakeResultOutcomes(t *testing.T) {
+	tests := []struct {
+		name        string
+		state       libvirt.DomainState
+		mac         string
+		wantOutcome WakeOutcome
+		wantDomains []string
+	}{
+		{"started", libvirt.DOMAIN_SHUTOFF, "52:54:00:00:41:01", WakeStarted, []string{"vm"}},
+		{"already running", libvirt.DOMAIN_RUNNING, "52:54:00:00:41:01", WakeAlreadyRunning, []string{"vm"}},
+		{"no match", libvirt.DOMAIN_SHUTOFF, "52:54:00:00:41:02", WakeNoMatch, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:41:01")
+			fake.state = tt.state
+			w, _ := newFakeHostWaker(t, fake)
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: tt.mac})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome || !slices.Equal(result.Domains, tt.wantDomains) {
+				t.Errorf("result = %+v, want %s for %v", result, tt.wantOutcome, tt.wantDomains)
+			}
+			if tt.wantDomains != nil && result.URI != "test:///default" {
+				t.Errorf("URI = %q, want test:///default", result.URI)
+			}
+		})
+	}
+}
+
+func TestTransientDomains(t *testing.T) {
+	tests := []struct {
+		name           string
+		persistent     bool
+		allowTransient bool
+		wantOutcome    WakeOutcome
+		wantCalls      []string
+	}{
+		{"persistent", true, false, WakeStarted, []string{"Create"}},
+		{"transient skipped", false, false, WakeNoMatch, nil},
+		{"transient allowed", false, true, WakeStarted, []string{"Create"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:46:01")
+			fake.persistent = tt.persistent
+			w, _ := newFakeHostWaker(t, fake)
+			w.transient = tt.allowTransient
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:46:01"})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// A clock for scheduled wakes that only fires them when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Duration // How far the clock has been advanced
+	pending []fakeTimer   // Functions waiting to run, in the order they were scheduled
+}
+
+// A function waiting on the fake clock
+type fakeTimer struct {
+	at    time.Duration // When the function is due
+	f     func()        // Function to run
+	timer *time.Timer   // Stand-in timer returned to the caller, stopped to cancel the function
+}
+
+// Make scheduled wakes use a fake clock for the rest of the test
+func withFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	clock := &fakeClock{}
+	original := afterFunc
+	afterFunc = func(d time.Duration, f func()) *time.Timer {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		// The stand-in never fires by itself, but reports whether it was stopped
+		timer := time.NewTimer(time.Hour)
+		clock.pending = append(clock.pending, fakeTimer{at: clock.now + d, f: f, timer: timer})
+		return timer
+	}
+	t.Cleanup(func() { afterFunc = original })
+	return clock
+}
+
+// Advance the clock, running the functions that are now due unless they were cancelled
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d
+	var due []fakeTimer
+	var pending []fakeTimer
+	for _, timer := range c.pending {
+		if timer.at <= c.now {
+			due = append(due, timer)
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	c.pending = pending
+	c.mu.Unlock()
+
+	for _, timer := range due {
+		if timer.timer.Stop() {
+			timer.f()
+		}
+	}
+}
+
+func TestWakeDelay(t *testing.T) {
+	clock := withFakeClock(t)
+	fake := newFakeDomain(t, "vm", "52:54:00:00:47:01")
+	w, _ := newFakeHostWaker(t, fake)
+	w.wakeDelay = 30 * time.Second
+	wol := &virtwold.MagicPacket{MAC: "52:54:00:00:47:01"}
+
+	// Duplicate packets while the wake is scheduled collapse into the one wake
+	for i := 0; i < 2; i++ {
+		result, err := w.WakeVirtualMachine(context.Background(), wol)
+		if err != nil || result.Outcome != WakeScheduled {
+			t.Fatalf("WakeVirtualMachine() = %+v, %v, want %s", result, err, WakeScheduled)
+		}
+	}
+
+	clock.advance(29 * time.Second)
+	if calls := fake.wakeCalls(); len(calls) != 0 {
+		t.Fatalf("calls before the delay = %v, want none", calls)
+	}
+	clock.advance(time.Second)
+	if calls := fake.wakeCalls(); !slices.Equal(calls, []string{"Create"}) {
+		t.Errorf("calls after the delay = %v, want [Create]", calls)
+	}
+}
+
+func TestWakeDelayCancelled(t *testing.T) {
+	clock := withFakeClock(t)
+	fake := newFakeDomain(t, "vm", "52:54:00:00:47:02")
+	w, _ := newFakeHostWaker(t, fake)
+	w.wakeDelay = 30 * time.Second
+
+	if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:47:02"}); err != nil {
+		t.Fatalf("WakeVirtualMachine() error = %v", err)
+	}
+	w.Close()
+	clock.advance(time.Minute)
+
+	if calls := fake.wakeCalls(); len(calls) != 0 {
+		t.Errorf("calls after shutdown = %v, want none", calls)
+	}
+}
+
+// A domain that takes a number of state polls to start running after being created
+type slowStartDomain struct {
+	*fakeDomain
+	polls int // Number of times the state has been polled
+	after int // Number of polls after which the domain is running
+}
+
+func (d *slowStartDomain) GetState() (libvirt.DomainState, int, error) {
+	d.polls++
+	if d.polls > d.after {
+		return libvirt.DOMAIN_RUNNING, 0, nil
+	}
+	return libvirt.DOMAIN_SHUTOFF, 0, nil
+}
+
+func TestWaitUntilRunning(t *testing.T) {
+	tests := []struct {
+		name      string
+		after     int
+		timeout   time.Duration
+		wantErr   bool
+		wantPolls int
+	}{
+		{"already running", 0, time.Minute, false, 1},
+		{"running after two polls", 2, time.Minute, false, 3},
+		{"never running", 1000, 0, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain := &slowStartDomain{fakeDomain: newFakeDomain(t, "vm"), after: tt.after}
+			err := waitUntilRunning(domain, tt.timeout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("waitUntilRunning() error = %v, want error %t", err, tt.wantErr)
+			}
+			if domain.polls != tt.wantPolls {
+				t.Errorf("polled %d times, want %d", domain.polls, tt.wantPolls)
+			}
+		})
+	}
+}
+
+func TestWakeAll(t *testing.T) {
+	permanent := libvirt.Error{Code: libvirt.ERR_CONFIG_UNSUPPORTED, Message: "unsupported configuration"}
+	tests := []struct {
+		name        string
+		wakeAll     bool
+		firstErr    error
+		wantFirst   []string
+		wantSecond  []string
+		wantOutcome WakeOutcome
+		wantErr     error
+	}{
+		{"first only", false, nil, []string{"Create"}, nil, WakeStarted, nil},
+		{"all", true, nil, []string{"Create"}, []string{"Create"}, WakeStarted, nil},
+		{"all despite a failure", true, permanent, []string{"Create"}, []string{"Create"}, WakeStarted, permanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := newFakeDomain(t, "standby-a", "52:54:00:00:58:01")
+			second := newFakeDomain(t, "standby-b", "52:54:00:00:58:01")
+			if tt.firstErr != nil {
+				first.wakeErrs = []error{tt.firstErr}
+			}
+			w, _ := newFakeHostWaker(t, first, second)
+			w.wakeAll = tt.wakeAll
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:58:01"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("WakeVirtualMachine() error = %v, want %v", err, tt.wantErr)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if calls := first.wakeCalls(); !slices.Equal(calls, tt.wantFirst) {
+				t.Errorf("first domain calls = %v, want %v", calls, tt.wantFirst)
+			}
+			if calls := second.wakeCalls(); !slices.Equal(calls, tt.wantSecond) {
+				t.Errorf("second domain calls = %v, want %v", calls, tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestNameFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		want    []string
+	}{
+		{"none", "", "", []string{"web-1", "web-test", "db-1"}},
+		{"include only", "^web-", "", []string{"web-1", "web-test"}},
+		{"exclude only", "", "-test$", []string{"web-1", "db-1"}},
+		{"both", "^web-", "-test$", []string{"web-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domains := []*fakeDomain{
+				newFakeDomain(t, "web-1", "52:54:00:00:65:01"),
+				newFakeDomain(t, "web-test", "52:54:00:00:65:01"),
+				newFakeDomain(t, "db-1", "52:54:00:00:65:01"),
+			}
+			w, _ := newFakeHostWaker(t, domains...)
+			w.wakeAll = true
+			if tt.include != "" {
+				w.includeName = regexp.MustCompile(tt.include)
+			}
+			if tt.exclude != "" {
+				w.excludeName = regexp.MustCompile(tt.exclude)
+			}
+
+			if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:65:01"}); err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			var woken []string
+			for _, domain := range domains {
+				if len(domain.wakeCalls()) != 0 {
+					woken = append(woken, domain.name)
+				}
+			}
+			if !slices.Equal(woken, tt.want) {
+				t.Errorf("woke %v, want %v", woken, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebootRunning(t *testing.T) {
+	tests := []struct {
+		name        string
+		state       libvirt.DomainState
+		reboot      bool
+		wantOutcome WakeOutcome
+		wantCalls   []string
+	}{
+		{"running without the flag", libvirt.DOMAIN_RUNNING, false, WakeAlreadyRunning, nil},
+		{"running with the flag", libvirt.DOMAIN_RUNNING, true, WakeRebooted, []string{"Reboot"}},
+		{"shut off with the flag", libvirt.DOMAIN_SHUTOFF, true, WakeStarted, []string{"Create"}},
+		{"shut off without the flag", libvirt.DOMAIN_SHUTOFF, false, WakeStarted, []string{"Create"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:69:01")
+			fake.state = tt.state
+			w, _ := newFakeHostWaker(t, fake)
+			w.rebootRunning = tt.reboot
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:69:01"})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWakeNoState(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     libvirt.DomainState
+		wantEvent bool
+	}{
+		{"no state", libvirt.DOMAIN_NOSTATE, true},
+		{"shut off", libvirt.DOMAIN_SHUTOFF, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, "text", "info")
+			fake := newFakeDomain(t, "vm", "52:54:00:00:71:01")
+			fake.state = tt.state
+			w, _ := newFakeHostWaker(t, fake)
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:71:01"})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != WakeStarted {
+				t.Errorf("outcome = %s, want %s", result.Outcome, WakeStarted)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, []string{"Create"}) {
+				t.Errorf("calls = %v, want [Create]", calls)
+			}
+			if got := strings.Contains(logs.String(), "event=waking_nostate"); got != tt.wantEvent {
+				t.Errorf("logged waking_nostate = %t, want %t", got, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestWakeByTarget(t *testing.T) {
+	rules := &Config{Targets: []TargetRule{
+		{Interface: "br0", MAC: "52:54:00:00:74:ff", Target: "vnet3"},
+		{Interface: "br1", Target: "vnet3"},
+	}}
+	tests := []struct {
+		name        string
+		iface       string
+		mac         string
+		wantOutcome WakeOutcome
+	}{
+		{"rule for the MAC", "br0", "52:54:00:00:74:ff", WakeStarted},
+		{"rule for any MAC", "br1", "52:54:00:00:74:fe", WakeStarted},
+		{"rule for another MAC", "br0", "52:54:00:00:74:fe", WakeNoMatch},
+		{"no rule for the interface", "eth0", "52:54:00:00:74:ff", WakeNoMatch},
+		{"unknown interface", "", "52:54:00:00:74:ff", WakeNoMatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomainConfig(t, &libvirtxml.Domain{Type: "kvm", Name: "vm", Devices: &libvirtxml.DomainDeviceList{
+				Interfaces: []libvirtxml.DomainInterface{{
+					MAC:    &libvirtxml.DomainInterfaceMAC{Address: "52:54:00:00:74:01"},
+					Source: &libvirtxml.DomainInterfaceSource{Bridge: &libvirtxml.DomainInterfaceSourceBridge{Bridge: "br0"}},
+					Target: &libvirtxml.DomainInterfaceTarget{Dev: "vnet3"},
+				}},
+			}})
+			w, _ := newFakeHostWaker(t, fake)
+			w.SetConfigRules(rules)
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: tt.mac, Interface: tt.iface})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+		})
+	}
+}
+
+func TestWakePausedDomain(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     libvirt.DomainState
+		wantCalls []string
+	}{
+		{"paused", libvirt.DOMAIN_PAUSED, []string{"Resume"}},
+		{"suspended", libvirt.DOMAIN_PMSUSPENDED, []string{"PMWakeup"}},
+		{"shut off", libvirt.DOMAIN_SHUTOFF, []string{"Create"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomain(t, "vm", "52:54:00:00:77:01")
+			fake.state = tt.state
+			w, _ := newFakeHostWaker(t, fake)
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:77:01"})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if !slices.Equal(result.Domains, []string{"vm"}) {
+				t.Errorf("matched %v, want [vm]", result.Domains)
+			}
+			if calls := fake.wakeCalls(); !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWakeByUUID(t *testing.T) {
+	tests := []struct {
+		name       string
+		uuid       string
+		wantFirst  []string
+		wantSecond []string
+	}{
+		{"without UUID", "", []string{"Create"}, nil},
+		{"UUID of the second", "00000000-0000-0000-0000-0000000087b2", nil, []string{"Create"}},
+		{"unknown UUID", "00000000-0000-0000-0000-0000000087ff", []string{"Create"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Both domains have the MAC, as when MACs are reused or randomized
+			first := newFakeDomainConfig(t, &libvirtxml.Domain{Type: "kvm", Name: "first", UUID: "00000000-0000-0000-0000-0000000087b1", Devices: fakeInterfaces("52:54:00:00:87:01")})
+			second := newFakeDomainConfig(t, &libvirtxml.Domain{Type: "kvm", Name: "second", UUID: "00000000-0000-0000-0000-0000000087b2", Devices: fakeInterfaces("52:54:00:00:87:01")})
+			w, _ := newFakeHostWaker(t, first, second)
+
+			if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:87:01", UUID: tt.uuid}); err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if calls := first.wakeCalls(); !slices.Equal(calls, tt.wantFirst) {
+				t.Errorf("first domain calls = %v, want %v", calls, tt.wantFirst)
+			}
+			if calls := second.wakeCalls(); !slices.Equal(calls, tt.wantSecond) {
+				t.Errorf("second domain calls = %v, want %v", calls, tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestWakeInterfaceType(t *testing.T) {
+	tests := []struct {
+		name        string
+		types       map[string]bool
+		mac         string
+		wantOutcome WakeOutcome
+	}{
+		{"any type, bridge MAC", nil, "52:54:00:00:97:01", WakeStarted},
+		{"any type, direct MAC", nil, "52:54:00:00:97:02", WakeStarted},
+		{"bridge only, bridge MAC", map[string]bool{"bridge": true}, "52:54:00:00:97:01", WakeStarted},
+		{"bridge only, direct MAC", map[string]bool{"bridge": true}, "52:54:00:00:97:02", WakeNoMatch},
+		{"direct only, bridge MAC", map[string]bool{"direct": true}, "52:54:00:00:97:01", WakeNoMatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDomainConfig(t, &libvirtxml.Domain{Type: "kvm", Name: "vm", Devices: &libvirtxml.DomainDeviceList{
+				Interfaces: []libvirtxml.DomainInterface{
+					{
+						MAC:    &libvirtxml.DomainInterfaceMAC{Address: "52:54:00:00:97:01"},
+						Source: &libvirtxml.DomainInterfaceSource{Bridge: &libvirtxml.DomainInterfaceSourceBridge{Bridge: "br0"}},
+					},
+					{
+						MAC:    &libvirtxml.DomainInterfaceMAC{Address: "52:54:00:00:97:02"},
+						Source: &libvirtxml.DomainInterfaceSource{Direct: &libvirtxml.DomainInterfaceSourceDirect{Dev: "eth0"}},
+					},
+				},
+			}})
+			w, _ := newFakeHostWaker(t, fake)
+			w.SetInterfaceTypes(tt.types)
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: tt.mac})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+		})
+	}
+}
+
+func TestWakeGroup(t *testing.T) {
+	tests := []struct {
+		name        string
+		running     []string // Names of the members already running
+		members     []string
+		wantOutcome WakeOutcome
+		wantDomains []string
+		wantCalls   map[string][]string
+	}{
+		{"both off", nil, []string{"web", "db"}, WakeStarted, []string{"web", "db"}, map[string][]string{"web": {"Create"}, "db": {"Create"}}},
+		{"one running", []string{"db"}, []string{"web", "db"}, WakeStarted, []string{"web", "db"}, map[string][]string{"web": {"Create"}, "db": nil}},
+		{"both running", []string{"web", "db"}, []string{"web", "db"}, WakeAlreadyRunning, []string{"web", "db"}, map[string][]string{"web": nil, "db": nil}},
+		{"one missing", nil, []string{"web", "missing"}, WakeStarted, []string{"web"}, map[string][]string{"web": {"Create"}, "db": nil}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domains := map[string]*fakeDomain{
+				"web": newFakeDomain(t, "web", "52:54:00:00:a0:01"),
+				"db":  newFakeDomain(t, "db", "52:54:00:00:a0:02"),
+			}
+			for _, name := range tt.running {
+				domains[name].state = libvirt.DOMAIN_RUNNING
+			}
+			w, _ := newFakeHostWaker(t, domains["web"], domains["db"])
+			w.SetConfigRules(&Config{Groups: []Group{{Name: "lab", MAC: "52:54:00:00:a0:ff", Domains: tt.members}}})
+
+			result, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: "52:54:00:00:a0:ff"})
+			if err != nil {
+				t.Fatalf("WakeVirtualMachine() error = %v", err)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", result.Outcome, tt.wantOutcome)
+			}
+			if !slices.Equal(result.Domains, tt.wantDomains) {
+				t.Errorf("domains = %v, want %v", result.Domains, tt.wantDomains)
+			}
+			for name, want := range tt.wantCalls {
+				if calls := domains[name].wakeCalls(); !slices.Equal(calls, want) {
+					t.Errorf("%s calls = %v, want %v", name, calls, want)
+				}
+			}
+		})
+	}
+}
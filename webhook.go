@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const webhookTimeout = 5 * time.Second // How long to wait for the webhook to respond, or the unknown MAC command to finish
+
+// Body POSTed to the webhook after a domain is woken
+type webhookEvent struct {
+	Domain string `json:"domain"` // Name of the domain woken
+	MAC    string `json:"mac"`    // MAC address from the WOL packet
+	State  string `json:"state"`  // What happened to the domain: started, unsuspended, resumed, or rebooted, or unknown if no domain has the MAC
+}
+
+// POST a wake event to the webhook URL
+// Failures are only logged, since they shouldn't affect the result of the wake
+func notifyWebhook(url string, event webhookEvent) {
+	if err := postWebhook(url, event); err != nil {
+		slog.Warn("Failed to notify webhook", "event", "webhook_failed", "domain", event.Domain, "mac", event.MAC, "error", err)
+	}
+}
+
+// Tell the hook that no domain has the (normalized) MAC, so external tooling can decide what to do, such as define one
+// An http:// or https:// URL is POSTed an event with the state unknown, and anything else is run as a command
+// with the MAC as its argument
+// Failures are only logged, since they shouldn't affect packet handling
+func notifyUnknown(hook string, mac string) {
+	var err error
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		err = postWebhook(hook, webhookEvent{MAC: mac, State: "unknown"})
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		var output []byte
+		if output, err = exec.CommandContext(ctx, hook, mac).CombinedOutput(); err != nil {
+			err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+		}
+	}
+
+	if err != nil {
+		slog.Warn("Failed to run the hook for an unknown MAC", "event", "unknown_hook_failed", "mac", mac, "hook", hook, "error", err)
+		return
+	}
+	slog.Info("Ran the hook for an unknown MAC", "event", "unknown_hook", "mac", mac, "hook", hook)
+}
+
+// POST a wake event to the webhook URL as JSON
+func postWebhook(url string, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/scottesandiego/virtwold/v2/pkg/virtwold"
+	"libvirt.org/go/libvirt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start a webhook server recording the events POSTed to it, replying with status
+func newWebhookServer(t *testing.T, status int) (*httptest.Server, func() []webhookEvent) {
+	t.Helper()
+	var mu sync.Mutex
+	var events []webhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("webhook body isn't a JSON event: %v", err)
+		}
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []webhookEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookEvent(nil), events...)
+	}
+}
+
+func TestWebhookAfterWake(t *testing.T) {
+	tests := []struct {
+		state     libvirt.DomainState
+		status    int
+		wantState string
+	}{
+		{libvirt.DOMAIN_SHUTOFF, http.StatusOK, "started"},
+		{libvirt.DOMAIN_PMSUSPENDED, http.StatusNoContent, "unsuspended"},
+		{libvirt.DOMAIN_PAUSED, http.StatusOK, "resumed"},
+		{libvirt.DOMAIN_SHUTOFF, http.StatusInternalServerError, "started"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantState, func(t *testing.T) {
+			server, events := newWebhookServer(t, tt.status)
+			fake := newFakeDomain(t, "vm", "52:54:00:00:23:01")
+			fake.state = tt.state
+			w := newTestWaker()
+			w.webhookURL = server.URL
+
+			// A webhook failing is only logged, so doesn't fail the wake
+			if _, err := w.wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:00:23:01"); err != nil {
+				t.Fatalf("wakeDomain() error = %v", err)
+			}
+
+			want := webhookEvent{Domain: "vm", MAC: "52:54:00:00:23:01", State: tt.wantState}
+			if got := events(); len(got) != 1 || got[0] != want {
+				t.Errorf("webhook events = %+v, want [%+v]", got, want)
+			}
+		})
+	}
+}
+
+func TestWebhookNotSentOnFailure(t *testing.T) {
+	server, events := newWebhookServer(t, http.StatusOK)
+	fake := newFakeDomain(t, "vm", "52:54:00:00:23:01")
+	fake.wakeErrs = []error{libvirt.Error{Code: libvirt.ERR_OPERATION_FAILED, Message: "no"}}
+	w := newTestWaker()
+	w.webhookURL = server.URL
+
+	if _, err := w.wakeDomain(context.Background(), fake.wakeable(t), "52:54:00:00:23:01"); err == nil {
+		t.Fatal("wakeDomain() succeeded, want an error")
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("webhook events = %+v after a failed wake, want none", got)
+	}
+}
+
+func TestOnUnknownWebhook(t *testing.T) {
+	server, events := newWebhookServer(t, http.StatusOK)
+	fake := newFakeDomain(t, "vm", "52:54:00:00:76:01")
+	w, _ := newFakeHostWaker(t, fake)
+	w.onUnknown = server.URL
+
+	for _, mac := range []string{"52:54:00:00:76:01", "52:54:00:00:76:02"} {
+		if _, err := w.WakeVirtualMachine(context.Background(), &virtwold.MagicPacket{MAC: mac}); err != nil {
+			t.Fatalf("WakeVirtualMachine(%s) error = %v", mac, err)
+		}
+	}
+
+	// The hook runs in the background, and only the miss starts it
+	deadline := time.Now().Add(5 * time.Second)
+	for len(events()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := webhookEvent{MAC: "52:54:00:00:76:02", State: "unknown"}
+	if got := events(); len(got) != 1 || got[0] != want {
+		t.Errorf("webhook events = %+v, want [%+v]", got, want)
+	}
+}
+
+func TestOnUnknownCommand(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "mac")
+	script := filepath.Join(dir, "on-unknown")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	notifyUnknown(script, "52:54:00:00:76:03")
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook didn't run: %v", err)
+	}
+	if strings.TrimSpace(string(got)) != "52:54:00:00:76:03" {
+		t.Errorf("hook ran with %q, want 52:54:00:00:76:03", got)
+	}
+}